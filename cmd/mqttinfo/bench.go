@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+	"github.com/spf13/pflag"
+)
+
+var benchCmd = &command{
+	name:    "bench",
+	summary: "measures publish and delivery throughput",
+	setup: func(fs *pflag.FlagSet) func(*options, []string) error {
+		topic := fs.StringP("topic", "t", "mqttinfo/bench", "topic to publish to")
+		count := fs.IntP("count", "c", 1000, "number of messages to publish")
+		size := fs.IntP("size", "s", 64, "payload size in bytes")
+		qos := fs.IntP("qos", "q", 0, "QoS of the messages (0, 1 or 2)")
+		return func(opts *options, args []string) error {
+			return runBench(opts, *topic, *count, *size, *qos)
+		}
+	},
+}
+
+func runBench(opts *options, topic string, count, size, qos int) error {
+
+	if qos < 0 || qos > 2 {
+		return fmt.Errorf("invalid QoS %v", qos)
+	}
+	if count <= 0 || size < 0 {
+		return fmt.Errorf("invalid count or size")
+	}
+
+	b, err := opts.brokerInfo()
+	if err != nil {
+		return err
+	}
+
+	sub, err := b.NewClient(packet.V311)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+
+	code, err := sub.Subscribe(topic, byte(qos))
+	if err != nil {
+		return err
+	}
+	if code >= 0x80 {
+		return fmt.Errorf("subscription rejected (code 0x%02x)", code)
+	}
+
+	pub, err := b.NewClient(packet.V311)
+	if err != nil {
+		return err
+	}
+	defer pub.Close()
+
+	// Counts deliveries until all messages arrived, or none arrived
+	// for a while
+	received := make(chan int, 1)
+	go func() {
+		n := 0
+		for n < count {
+			if _, err := sub.Next(5 * time.Second); err != nil {
+				break
+			}
+			n++
+		}
+		received <- n
+	}()
+
+	payload := make([]byte, size)
+	start := time.Now()
+	for i := 0; i < count; i++ {
+		if err = pub.Publish(topic, payload, byte(qos), false); err != nil {
+			return err
+		}
+	}
+	published := time.Since(start)
+
+	n := <-received
+	delivered := time.Since(start)
+
+	fmt.Printf("published %v messages in %v (%.0f msg/s)\n",
+		count, published, float64(count)/published.Seconds())
+	fmt.Printf("received %v/%v messages in %v (%.0f msg/s)\n",
+		n, count, delivered, float64(n)/delivered.Seconds())
+
+	return nil
+}
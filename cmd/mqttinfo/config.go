@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// config is the content of the configuration file, for example:
+//
+//	default: prod-eu
+//	profiles:
+//	  prod-eu:
+//	    host: broker.eu.example.com
+//	    port: 1883
+//	    user: monitoring
+//	    password_file: ~/.config/mqttinfo/prod-eu.pwd
+type config struct {
+	Default  string              `yaml:"default"`
+	Profiles map[string]*profile `yaml:"profiles"`
+}
+
+// profile holds the connection options of a broker
+type profile struct {
+	Host         string `yaml:"host"`
+	Port         int    `yaml:"port"`
+	User         string `yaml:"user"`
+	PasswordFile string `yaml:"password_file"`
+	PasswordEnv  string `yaml:"password_env"`
+
+	// mqttinfo only connects over plain TCP: these keys are parsed so
+	// that they can be rejected with a clear error instead of ignored
+	TLS   interface{} `yaml:"tls"`
+	Proxy interface{} `yaml:"proxy"`
+}
+
+// check rejects the keys that mqttinfo doesn't support
+func (p *profile) check(name string) error {
+	if p.TLS != nil {
+		return fmt.Errorf("profile %q: tls is not supported, mqttinfo only connects over plain TCP", name)
+	}
+	if p.Proxy != nil {
+		return fmt.Errorf("profile %q: proxy is not supported, mqttinfo only connects directly to the broker", name)
+	}
+	return nil
+}
+
+// Environment variables overriding the configuration file
+const (
+	envConfig       = "MQTTINFO_CONFIG"
+	envProfile      = "MQTTINFO_PROFILE"
+	envHost         = "MQTTINFO_HOST"
+	envPort         = "MQTTINFO_PORT"
+	envUser         = "MQTTINFO_USER"
+	envPassword     = "MQTTINFO_PASSWORD"
+	envPasswordFile = "MQTTINFO_PASSWORD_FILE"
+)
+
+// defaultConfigPath returns $XDG_CONFIG_HOME/mqttinfo/config.yaml,
+// or ~/.config/mqttinfo/config.yaml if XDG_CONFIG_HOME isn't set
+func defaultConfigPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "mqttinfo", "config.yaml")
+}
+
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[2:])
+}
+
+// loadConfig reads a configuration file. A missing file is only an error
+// if its path was given explicitly.
+func loadConfig(path string, explicit bool) (*config, error) {
+	cfg := &config{}
+	data, err := ioutil.ReadFile(expandHome(path))
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return cfg, nil
+		}
+		return nil, err
+	}
+	if err = yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	for name, p := range cfg.Profiles {
+		if p == nil {
+			return nil, fmt.Errorf("%v: profile %q is empty", path, name)
+		}
+		if err = p.check(name); err != nil {
+			return nil, fmt.Errorf("%v: %v", path, err)
+		}
+	}
+	return cfg, nil
+}
+
+// readPasswordFile returns the first line of a file
+func readPasswordFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(expandHome(path))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(strings.SplitN(string(data), "\n", 2)[0], "\r"), nil
+}
+
+// resolve completes the options given on the command line with the
+// environment, then with the selected profile. Flags take precedence
+// over environment variables, which take precedence over the profile.
+func (o *options) resolve(fs *pflag.FlagSet) error {
+
+	path := o.config
+	explicit := fs.Changed("config")
+	if !explicit {
+		if env := os.Getenv(envConfig); env != "" {
+			path = env
+			explicit = true
+		} else {
+			path = defaultConfigPath()
+		}
+	}
+
+	cfg, err := loadConfig(path, explicit)
+	if err != nil {
+		return err
+	}
+
+	name := o.profile
+	if !fs.Changed("profile") {
+		if env := os.Getenv(envProfile); env != "" {
+			name = env
+		} else {
+			name = cfg.Default
+		}
+	}
+
+	p := &profile{}
+	if name != "" {
+		var ok bool
+		if p, ok = cfg.Profiles[name]; !ok {
+			return fmt.Errorf("profile %q not found in %v", name, path)
+		}
+	}
+
+	if !fs.Changed("host") {
+		if env := os.Getenv(envHost); env != "" {
+			o.hostname = env
+		} else if p.Host != "" {
+			o.hostname = p.Host
+		}
+	}
+
+	if !fs.Changed("port") {
+		if env := os.Getenv(envPort); env != "" {
+			if o.port, err = strconv.Atoi(env); err != nil {
+				return fmt.Errorf("invalid %v: %v", envPort, env)
+			}
+		} else if p.Port != 0 {
+			o.port = p.Port
+		}
+	}
+
+	if !fs.Changed("user") {
+		if env := os.Getenv(envUser); env != "" {
+			o.username = env
+		} else if p.User != "" {
+			o.username = p.User
+		}
+	}
+
+	if fs.Changed("pwd") {
+		return nil
+	}
+	passwordFile := o.passwordFile
+	if !fs.Changed("pwd-file") {
+		if env := os.Getenv(envPassword); env != "" {
+			o.password = env
+			return nil
+		}
+		passwordFile = os.Getenv(envPasswordFile)
+	}
+	if passwordFile == "" && p.PasswordEnv != "" {
+		if env, ok := os.LookupEnv(p.PasswordEnv); ok {
+			o.password = env
+			return nil
+		}
+		return fmt.Errorf("profile %q: %v is not set", name, p.PasswordEnv)
+	}
+	if passwordFile == "" {
+		passwordFile = p.PasswordFile
+	}
+	if passwordFile != "" {
+		if o.password, err = readPasswordFile(passwordFile); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+const testConfig = `default: prod
+profiles:
+  prod:
+    host: prod.example.com
+    port: 8883
+    user: monitoring
+    password_file: %DIR%/prod.pwd
+  staging:
+    host: staging.example.com
+    user: staging
+    password_env: MQTTINFO_TEST_STAGING_PASSWORD
+`
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		env      map[string]string
+		args     []string
+		host     string
+		port     int
+		user     string
+		password string
+		err      string
+	}{
+		{
+			name: "no config file",
+			host: "localhost",
+			port: 1883,
+		},
+		{
+			name:     "default profile",
+			config:   testConfig,
+			host:     "prod.example.com",
+			port:     8883,
+			user:     "monitoring",
+			password: "prod secret",
+		},
+		{
+			name:     "selected profile",
+			config:   testConfig,
+			env:      map[string]string{"MQTTINFO_TEST_STAGING_PASSWORD": "staging secret"},
+			args:     []string{"--profile", "staging"},
+			host:     "staging.example.com",
+			port:     1883,
+			user:     "staging",
+			password: "staging secret",
+		},
+		{
+			name:     "profile from the environment",
+			config:   testConfig,
+			env:      map[string]string{envProfile: "staging", "MQTTINFO_TEST_STAGING_PASSWORD": "staging secret"},
+			host:     "staging.example.com",
+			port:     1883,
+			user:     "staging",
+			password: "staging secret",
+		},
+		{
+			name:   "password_env not set",
+			config: testConfig,
+			args:   []string{"--profile", "staging"},
+			err:    "MQTTINFO_TEST_STAGING_PASSWORD is not set",
+		},
+		{
+			name:     "environment overrides the profile",
+			config:   testConfig,
+			env:      map[string]string{envHost: "env.example.com", envPort: "1884", envUser: "env", envPassword: "env secret"},
+			host:     "env.example.com",
+			port:     1884,
+			user:     "env",
+			password: "env secret",
+		},
+		{
+			name:     "password file from the environment",
+			config:   testConfig,
+			env:      map[string]string{envPasswordFile: "%DIR%/other.pwd"},
+			host:     "prod.example.com",
+			port:     8883,
+			user:     "monitoring",
+			password: "other secret",
+		},
+		{
+			name:     "flags override the environment",
+			config:   testConfig,
+			env:      map[string]string{envHost: "env.example.com", envPassword: "env secret"},
+			args:     []string{"--host", "flag.example.com", "--pwd", "flag secret"},
+			host:     "flag.example.com",
+			port:     8883,
+			user:     "monitoring",
+			password: "flag secret",
+		},
+		{
+			name:     "password file flag",
+			config:   testConfig,
+			env:      map[string]string{envPassword: "env secret"},
+			args:     []string{"--pwd-file", "%DIR%/other.pwd"},
+			host:     "prod.example.com",
+			port:     8883,
+			user:     "monitoring",
+			password: "other secret",
+		},
+		{
+			name:   "unknown profile",
+			config: testConfig,
+			args:   []string{"--profile", "dev"},
+			err:    `profile "dev" not found`,
+		},
+		{
+			name:   "invalid port",
+			config: testConfig,
+			env:    map[string]string{envPort: "mqtt"},
+			err:    "invalid MQTTINFO_PORT",
+		},
+		{
+			name:   "tls",
+			config: "profiles:\n  prod:\n    host: prod.example.com\n    tls:\n      ca_file: ca.pem\n",
+			err:    "tls is not supported",
+		},
+		{
+			name:   "proxy",
+			config: "profiles:\n  prod:\n    proxy: socks5://localhost:1080\n",
+			err:    "proxy is not supported",
+		},
+		{
+			name:   "unknown key",
+			config: "profiles:\n  prod:\n    hostname: prod.example.com\n",
+			err:    "field hostname not found",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			write := func(name, content string) {
+				content = strings.ReplaceAll(content, "%DIR%", dir)
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			write("prod.pwd", "prod secret\nignored\n")
+			write("other.pwd", "other secret\r\n")
+
+			for _, env := range []string{envConfig, envProfile, envHost, envPort, envUser, envPassword, envPasswordFile} {
+				t.Setenv(env, "")
+			}
+			t.Setenv("XDG_CONFIG_HOME", dir)
+			t.Setenv("MQTTINFO_TEST_STAGING_PASSWORD", "")
+			os.Unsetenv("MQTTINFO_TEST_STAGING_PASSWORD")
+			for k, v := range test.env {
+				t.Setenv(k, strings.ReplaceAll(v, "%DIR%", dir))
+			}
+			if test.config != "" {
+				if err := os.MkdirAll(filepath.Join(dir, "mqttinfo"), 0700); err != nil {
+					t.Fatal(err)
+				}
+				write("mqttinfo/config.yaml", test.config)
+			}
+
+			var o options
+			fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+			o.register(fs)
+			args := make([]string, len(test.args))
+			for i, arg := range test.args {
+				args[i] = strings.ReplaceAll(arg, "%DIR%", dir)
+			}
+			if err := fs.Parse(args); err != nil {
+				t.Fatal(err)
+			}
+
+			err := o.resolve(fs)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("resolve() = %v, want an error containing %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolve() = %v", err)
+			}
+			if o.hostname != test.host || o.port != test.port || o.username != test.user || o.password != test.password {
+				t.Errorf("resolve() gave %v:%v, user %q, password %q; want %v:%v, user %q, password %q",
+					o.hostname, o.port, o.username, o.password, test.host, test.port, test.user, test.password)
+			}
+		})
+	}
+}
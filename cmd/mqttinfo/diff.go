@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+
+	"github.com/spf13/pflag"
+)
+
+var diffCmd = &command{
+	name:    "diff",
+	args:    "OLD.json NEW.json",
+	summary: "compares two JSON reports written by scan --json",
+	setup: func(fs *pflag.FlagSet) func(*options, []string) error {
+		return func(opts *options, args []string) error {
+			if len(args) != 2 {
+				return fmt.Errorf("expected two report files")
+			}
+			return runDiff(args[0], args[1])
+		}
+	},
+}
+
+// readReport returns the last report of a JSON lines file
+func readReport(path string) (map[string]interface{}, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var last []byte
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			last = append(last[:0], scanner.Bytes()...)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if last == nil {
+		return nil, fmt.Errorf("%v: no report found", path)
+	}
+
+	report := make(map[string]interface{})
+	if err = json.Unmarshal(last, &report); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return report, nil
+}
+
+func runDiff(oldPath, newPath string) error {
+
+	old, err := readReport(oldPath)
+	if err != nil {
+		return err
+	}
+	cur, err := readReport(newPath)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]bool)
+	for k := range old {
+		keys[k] = true
+	}
+	for k := range cur {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	changes := 0
+	for _, k := range sorted {
+		a, inOld := old[k]
+		b, inNew := cur[k]
+		switch {
+		case !inOld:
+			fmt.Printf("+ %v: %v\n", k, b)
+		case !inNew:
+			fmt.Printf("- %v: %v\n", k, a)
+		case !reflect.DeepEqual(a, b):
+			fmt.Printf("~ %v: %v -> %v\n", k, a, b)
+		default:
+			continue
+		}
+		changes++
+	}
+
+	fmt.Printf("%v differences\n", changes)
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+	"github.com/spf13/pflag"
+)
+
+var discoverCmd = &command{
+	name:    "discover",
+	summary: "lists the topics on which messages are published",
+	setup: func(fs *pflag.FlagSet) func(*options, []string) error {
+		duration := fs.DurationP("duration", "d", 10*time.Second, "how long to listen for messages")
+		sys := fs.BoolP("sys", "s", false, "also listens to the $SYS tree")
+		return func(opts *options, args []string) error {
+			return runDiscover(opts, *duration, *sys)
+		}
+	},
+}
+
+func runDiscover(opts *options, duration time.Duration, sys bool) error {
+
+	b, err := opts.brokerInfo()
+	if err != nil {
+		return err
+	}
+
+	c, err := b.NewClient(packet.V311)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	filters := []string{"#"}
+	if sys {
+		filters = append(filters, "$SYS/#")
+	}
+	for _, filter := range filters {
+		code, err := c.Subscribe(filter, 0)
+		if err != nil {
+			return err
+		}
+		if code >= 0x80 {
+			fmt.Printf("subscription to %v rejected (code 0x%02x)\n", filter, code)
+		}
+	}
+
+	fmt.Printf("Listening for %v...\n", duration)
+
+	topics := make(map[string]int)
+	deadline := time.Now().Add(duration)
+	for {
+		left := time.Until(deadline)
+		if left <= 0 {
+			break
+		}
+		pub, err := c.Next(left)
+		if err != nil {
+			if _, ok := err.(net.Error); ok || time.Until(deadline) <= 0 {
+				break
+			}
+			return err
+		}
+		topics[pub.Topic]++
+	}
+
+	names := make([]string, 0, len(topics))
+	for topic := range topics {
+		names = append(names, topic)
+	}
+	sort.Strings(names)
+
+	fmt.Printf("%v topics found\n", len(names))
+	for _, topic := range names {
+		fmt.Printf("%6d  %v\n", topics[topic], topic)
+	}
+
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/pflag"
+)
+
+var fingerprintCmd = &command{
+	name:    "fingerprint",
+	summary: "guesses the broker software",
+	setup: func(fs *pflag.FlagSet) func(*options, []string) error {
+		return func(opts *options, args []string) error {
+			return runFingerprint(opts)
+		}
+	},
+}
+
+func runFingerprint(opts *options) error {
+
+	b, err := opts.brokerInfo()
+	if err != nil {
+		return err
+	}
+	defer cleanupOnExit(b)()
+
+	fmt.Printf("Target: %v:%v\n", b.Host, b.Port)
+
+	err = b.CheckConnectionV4()
+	if err != nil {
+		return fmt.Errorf("%v check failed: %v", v4, err)
+	}
+	if !b.V4 {
+		return fmt.Errorf("broker does not support %v", v4)
+	}
+
+	// GuessBroker relies on the $SYS publication check
+	fmt.Println("Trying to guess broker software...")
+	err = b.AnalyzeV4()
+	if err != nil {
+		return fmt.Errorf("analysis failed: %v", err)
+	}
+	err = b.GuessBroker()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("looks like %v\n", b.TypeGuessed)
+
+	return nil
+}
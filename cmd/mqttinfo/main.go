@@ -1,9 +1,12 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 
 	"github.com/spf13/pflag"
 
@@ -17,6 +20,7 @@ var gitTag string
 var buildDate string
 
 const (
+	v3 = "MQTT v3.1"
 	v4 = "MQTT v3.1.1"
 	v5 = "MQTT v5.0"
 )
@@ -29,154 +33,319 @@ func res(val bool) interface{} {
 	}
 }
 
-func main() {
+// command is a subcommand of mqttinfo. setup registers the command's own
+// flags and returns the function running it. repeats is set by commands
+// running any number of scans, which a recording, a replay or a capture
+// can't hold.
+type command struct {
+	name    string
+	args    string
+	summary string
+	repeats bool
+	setup   func(fs *pflag.FlagSet) func(opts *options, args []string) error
+}
 
-	fs := pflag.NewFlagSet(os.Args[0], pflag.ExitOnError)
+// scan comes first, it's the default command
+var commands = []*command{
+	scanCmd,
+	fingerprintCmd,
+	discoverCmd,
+	benchCmd,
+	watchCmd,
+	subCmd,
+	pubCmd,
+	diffCmd,
+	serveCmd,
+}
 
-	hostname := fs.StringP("host", "h", "localhost", "MQTT broker to connect to")
-	port := fs.IntP("port", "p", 1883, "network port to connect to")
-	username := fs.StringP("user", "u", "", "username, if authentication is needed")
-	password := fs.StringP("pwd", "P", "", "password, if authentication is needed")
-	help := fs.BoolP("help", "", false, "shows this")
-	jsonout := fs.BoolP("json", "j", false, "writes JSON-formatted output to mqttinfo.json")
+// options are shared by all commands
+type options struct {
+	config       string
+	profile      string
+	hostname     string
+	port         int
+	username     string
+	password     string
+	passwordFile string
+	record       string
+	replay       string
+	pcap         string
+	trace        bool
+	logLevel     string
+	logFile      string
 
-	fs.Parse(os.Args[1:])
+	logger     mqttinfo.Logger
+	logOutput  *os.File
+	recordFile *os.File
+	recorder   *mqttinfo.Recorder
+	replayer   *mqttinfo.Replayer
+	pcapFile   *os.File
+	pcapWriter *mqttinfo.PcapWriter
+}
 
-	if *help {
-		fs.PrintDefaults()
-		return
+func (o *options) register(fs *pflag.FlagSet) {
+	fs.StringVar(&o.config, "config", defaultConfigPath(), "configuration file holding broker profiles")
+	fs.StringVar(&o.profile, "profile", "", "broker profile to use, from the configuration file")
+	fs.StringVarP(&o.hostname, "host", "h", "localhost", "MQTT broker to connect to")
+	fs.IntVarP(&o.port, "port", "p", 1883, "network port to connect to")
+	fs.StringVarP(&o.username, "user", "u", "", "username, if authentication is needed")
+	fs.StringVarP(&o.password, "pwd", "P", "", "password, if authentication is needed (visible to other users, prefer --pwd-file)")
+	fs.StringVar(&o.passwordFile, "pwd-file", "", "file holding the password, if authentication is needed")
+	fs.StringVar(&o.record, "record", "", "records the traffic with the broker to a file, credentials included")
+	fs.StringVar(&o.replay, "replay", "", "replays a recording instead of connecting to the broker")
+	fs.StringVar(&o.pcap, "pcap", "", "writes the traffic with the broker to a pcapng file, credentials included")
+	fs.BoolVarP(&o.trace, "trace", "v", false, "logs every packet exchanged, same as --log-level trace")
+	fs.StringVar(&o.logLevel, "log-level", "warn", "log level: error, warn, info, debug or trace")
+	fs.StringVar(&o.logFile, "log-file", "", "writes logs to a file instead of stderr")
+}
+
+func (o *options) validate() error {
+	if len(o.username) >= 0x10000 ||
+		len(o.password) >= 0x10000 ||
+		o.port >= 0x10000 {
+		return fmt.Errorf("invalid username, password or port")
 	}
+	return nil
+}
 
-	if len(*username) >= 0x10000 ||
-		len(*password) >= 0x10000 ||
-		*port >= 0x10000 {
-		fs.PrintDefaults()
-		return
+// open prepares the logs, the recording or the replay, and the capture
+func (o *options) open() error {
+	level, err := mqttinfo.ParseLevel(o.logLevel)
+	if err != nil {
+		return err
+	}
+	if o.trace {
+		level = mqttinfo.LevelTrace
 	}
+	output := os.Stderr
+	if o.logFile != "" {
+		output, err = os.OpenFile(o.logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		o.logOutput = output
+	}
+	o.logger = mqttinfo.NewLogger(output, level)
 
-	if len(gitTag) == 0 {
-		fmt.Printf("MQTTinfo – version %v-%v\n", buildDate, gitCommit)
-	} else {
-		fmt.Printf("MQTTinfo – version %s (%v-%v)\n", gitTag, buildDate, gitCommit)
+	if o.replay != "" {
+		file, err := os.Open(o.replay)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		events, err := mqttinfo.ReadRecording(file)
+		if err != nil {
+			return fmt.Errorf("%v: %v", o.replay, err)
+		}
+		o.replayer = mqttinfo.NewReplayer(events)
 	}
 
-	fmt.Println("Copyright (c) Teserakt AG, 2019")
+	if o.record != "" {
+		file, err := os.OpenFile(o.record, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		o.recordFile = file
+		o.recorder = mqttinfo.NewRecorder(file)
+	}
 
-	// info will hold the results of the analysis
-	b, err := mqttinfo.NewBrokerInfo(*hostname, *port, *username, *password)
-	if err != nil {
-		fmt.Printf("BrokerInfo creation failed: %v\n", err)
-		b.Failed = true
-		b.Error = err.Error()
-		return
+	if o.pcap != "" {
+		file, err := os.OpenFile(o.pcap, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		o.pcapFile = file
+		o.pcapWriter, err = mqttinfo.NewPcapWriter(file)
+		if err != nil {
+			return fmt.Errorf("%v: %v", o.pcap, err)
+		}
 	}
 
-	fmt.Printf("\nTarget: %v:%v\n", b.Host, b.Port)
+	return nil
+}
 
-	// v3.1.1 tests
-	fmt.Printf("\nChecking %v broker interface...\n", v4)
-	err = b.CheckConnectionV4()
-	if err != nil {
-		fmt.Printf("%v check failed: %v\n", v4, err)
-		b.Failed = true
-		b.Error = err.Error()
-		return
-	} else {
-		fmt.Printf("%v support\t%v\n", v4, res(b.V4))
-		if b.V4 {
-			fmt.Printf("needs authentication\t%v\n", res(!b.V4Anonymous))
+// close ends the logs, the recording and the capture, and reports their
+// errors and replay errors
+func (o *options) close() error {
+	var err error
+	if o.logOutput != nil {
+		err = o.logOutput.Close()
+	}
+	if o.replayer != nil && err == nil {
+		err = o.replayer.Err()
+	}
+	if o.recorder != nil {
+		if rerr := o.recorder.Err(); rerr != nil && err == nil {
+			err = fmt.Errorf("recording failed: %v", rerr)
+		}
+		if cerr := o.recordFile.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	if o.pcapWriter != nil {
+		if perr := o.pcapWriter.Err(); perr != nil && err == nil {
+			err = fmt.Errorf("capture failed: %v", perr)
+		}
+		if cerr := o.pcapFile.Close(); cerr != nil && err == nil {
+			err = cerr
 		}
 	}
+	return err
+}
 
-	// v5.0 tests
-	fmt.Printf("\nChecking %v broker interface...\n", v5)
-	err = b.CheckConnectionV5()
+// brokerInfo returns a BrokerInfo for the target given by the options
+func (o *options) brokerInfo() (*mqttinfo.BrokerInfo, error) {
+	b, err := mqttinfo.NewBrokerInfo(o.hostname, o.port, o.username, o.password)
 	if err != nil {
-		fmt.Printf("%v check failed: %v\n", v5, err)
-		b.Failed = true
-		b.Error = err.Error()
-		return
-	} else {
-		fmt.Printf("%v support\t%v\n", v5, res(b.V5))
-		if b.V5 {
-			fmt.Printf("needs authentication\t%v\n", res(!b.V5Anonymous))
-		}
+		return b, err
+	}
+	b.Logger = o.logger
+	if o.replayer != nil {
+		b.Dialer = o.replayer.Dial
+		b.RunID = o.replayer.RunID()
+		b.SCRAMNonces = o.replayer.SCRAMNonces()
 	}
+	if o.recorder != nil {
+		b.Dialer = o.recorder.Wrap(b.Dialer)
+	}
+	if o.pcapWriter != nil {
+		b.Dialer = o.pcapWriter.Wrap(b.Dialer)
+	}
+	return b, nil
+}
 
-	if b.V4 {
-		fmt.Printf("\nAnalyzing %v broker interface...\n", v4)
-		err = b.AnalyzeV4()
-		if err != nil {
-			fmt.Printf("Analysis failed: %v\n", err)
-			b.Failed = true
-			b.Error = err.Error()
-			return
-		} else {
-
-			// Shows correct behavior as OK/green
-			fmt.Printf("supports QoS1\t\t%v\n", res(b.V4QoS1))
-			fmt.Printf("supports QoS2\t\t%v\n", res(b.V4QoS2))
-			fmt.Printf("rejects QoS3\t\t%v\n", res(!b.V4QoS3Response))
-			fmt.Printf("forbids subscribe to #\t%v\n", res(!b.V4SubscribeAll))
-			fmt.Printf("rejects invalid topic\t%v\n", res(!b.V4InvalidTopics))
-			fmt.Printf("rejects invalid UTF-8\t%v\n", res(!b.V4InvalidUTF8Topic))
-			fmt.Printf("rejects $SYS publishs\t%v\n", res(!b.V4PublishSYS))
-			if b.V4PublishSYS {
-				fmt.Printf("filters $SYS publishs\t%v\n", res(b.V4FilterSYS))
-			}
+// cleanupOnExit clears the retained messages left by the checks of b if
+// the command is interrupted. The function returned clears them at the
+// end of the command, and may be called more than once.
+func cleanupOnExit(b *mqttinfo.BrokerInfo) func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case <-signals:
+			// A second interrupt kills us
+			signal.Stop(signals)
+			fmt.Fprintln(os.Stderr, "\nInterrupted, clearing retained messages...")
+			cleanup(b)
+			os.Exit(130)
+		case <-done:
 		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(signals)
+			close(done)
+			cleanup(b)
+		})
 	}
+}
 
-	if b.V5 {
-		fmt.Printf("\nAnalyzing %v broker interface...\n", v5)
-		err = b.AnalyzeV5()
-		if err != nil {
-			fmt.Printf("Analysis failed: %v\n", err)
-			b.Failed = true
-			b.Error = err.Error()
-			return
-		} else {
-
-			// Shows correct behavior as OK/green
-			fmt.Printf("supports QoS1\t\t%v\n", res(b.V5QoS1))
-			fmt.Printf("supports QoS2\t\t%v\n", res(b.V5QoS2))
-			fmt.Printf("rejects QoS3\t\t%v\n", res(!b.V5QoS3Response))
-			fmt.Printf("forbids subscribe to #\t%v\n", res(!b.V5SubscribeAll))
-			fmt.Printf("rejects invalid topic\t%v\n", res(!b.V5InvalidTopics))
-			fmt.Printf("rejects invalid UTF-8\t%v\n", res(!b.V5InvalidUTF8Topic))
-			fmt.Printf("rejects $SYS publishs\t%v\n", res(!b.V5PublishSYS))
-			if b.V5PublishSYS {
-				fmt.Printf("filters $SYS publishs\t%v\n", res(b.V5FilterSYS))
-			}
+// cleanup clears the retained messages left by the checks of b, and
+// lists those that must be cleared by hand, including by an earlier
+// cleanup such as Scan's
+func cleanup(b *mqttinfo.BrokerInfo) {
+	if b.Cleanup(); len(b.CleanupFailed) > 0 {
+		fmt.Fprintf(os.Stderr, "Cleanup failed, retained messages left on the broker:\n")
+		for _, f := range b.CleanupFailed {
+			fmt.Fprintf(os.Stderr, "  %v\n", f)
 		}
 	}
+}
 
-	fmt.Println("\nTrying to guess broker software...")
-	err = b.GuessBroker()
-	if err != nil {
-		fmt.Printf("Failed: %v\n", err)
+func printBanner() {
+	if len(gitTag) == 0 {
+		fmt.Printf("MQTTinfo – version %v-%v\n", buildDate, gitCommit)
 	} else {
-		fmt.Printf("looks like %v\n", b.TypeGuessed)
+		fmt.Printf("MQTTinfo – version %s (%v-%v)\n", gitTag, buildDate, gitCommit)
 	}
 
-	if !*jsonout {
-		return
+	fmt.Println("Copyright (c) Teserakt AG, 2019")
+}
+
+func printUsage() {
+	printBanner()
+	fmt.Printf("\nUsage: %v [command] [flags]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Printf("  %-12v %v\n", cmd.name, cmd.summary)
 	}
+	fmt.Printf("\nRun '%v <command> --help' for the flags of a command.\n", os.Args[0])
+}
 
-	js, err := json.Marshal(b)
-	if err != nil {
-		fmt.Println(err)
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
 	}
-	file, err := os.OpenFile("mqttinfo.json", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-	if err != nil {
-		fmt.Printf("Error opening mqttinfo.json: %v\n", err)
-		return
+	return nil
+}
+
+func main() {
+
+	args := os.Args[1:]
+
+	// Without a command name, runs scan for compatibility with
+	// earlier versions
+	cmd := scanCmd
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		if args[0] == "help" {
+			printUsage()
+			return
+		}
+		cmd = findCommand(args[0])
+		if cmd == nil {
+			fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+			printUsage()
+			os.Exit(2)
+		}
+		args = args[1:]
 	}
-	defer file.Close()
-	_, err = file.WriteString(string(js) + "\n")
-	if err != nil {
-		fmt.Printf("Error writing JSON: %v\n", err)
+
+	fs := pflag.NewFlagSet(cmd.name, pflag.ExitOnError)
+	opts := &options{}
+	opts.register(fs)
+	help := fs.BoolP("help", "", false, "shows this")
+	run := cmd.setup(fs)
+
+	fs.Parse(args)
+
+	if *help {
+		fmt.Printf("Usage: %v %v [flags] %v\n\n%v\n\n", os.Args[0], cmd.name, cmd.args, cmd.summary)
+		fs.PrintDefaults()
 		return
 	}
 
+	if err := opts.resolve(fs); err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", cmd.name, err)
+		os.Exit(2)
+	}
+
+	if err := opts.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n\n", cmd.name, err)
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
+
+	if cmd.repeats && (opts.record != "" || opts.replay != "" || opts.pcap != "") {
+		fmt.Fprintf(os.Stderr, "%v: --record, --replay and --pcap can't be used with this command\n", cmd.name)
+		os.Exit(2)
+	}
+
+	if err := opts.open(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", cmd.name, err)
+		os.Exit(2)
+	}
+
+	err := run(opts, fs.Args())
+	if cerr := opts.close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", cmd.name, err)
+		os.Exit(1)
+	}
 }
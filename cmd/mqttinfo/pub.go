@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+	"github.com/spf13/pflag"
+)
+
+var pubCmd = &command{
+	name:    "pub",
+	summary: "publishes a message",
+	setup: func(fs *pflag.FlagSet) func(*options, []string) error {
+		topic := fs.StringP("topic", "t", "", "topic to publish to")
+		message := fs.StringP("message", "m", "", "message payload")
+		qos := fs.IntP("qos", "q", 0, "QoS of the message (0, 1 or 2)")
+		retain := fs.BoolP("retain", "r", false, "sets the retain flag")
+		return func(opts *options, args []string) error {
+			return runPub(opts, *topic, *message, *qos, *retain)
+		}
+	},
+}
+
+func runPub(opts *options, topic, message string, qos int, retain bool) error {
+
+	if topic == "" {
+		return fmt.Errorf("missing --topic")
+	}
+	if qos < 0 || qos > 2 {
+		return fmt.Errorf("invalid QoS %v", qos)
+	}
+
+	b, err := opts.brokerInfo()
+	if err != nil {
+		return err
+	}
+
+	c, err := b.NewClient(packet.V311)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	return c.Publish(topic, []byte(message), byte(qos), retain)
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	mqttinfo "github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib"
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+	"github.com/spf13/pflag"
+)
+
+var scanCmd = &command{
+	name:    "scan",
+	summary: "runs all checks against the broker (default command)",
+	setup: func(fs *pflag.FlagSet) func(*options, []string) error {
+		jsonout := fs.BoolP("json", "j", false, "writes JSON-formatted output to mqttinfo.json")
+		maxPacketSize := fs.Int("max-packet-size", 1<<20, "largest PUBLISH tried by the packet size checks, in bytes")
+		return func(opts *options, args []string) error {
+			return runScan(opts, *jsonout, *maxPacketSize)
+		}
+	},
+}
+
+func runScan(opts *options, jsonout bool, maxPacketSize int) error {
+
+	printBanner()
+
+	// info will hold the results of the analysis
+	b, err := opts.brokerInfo()
+	if err != nil {
+		return fmt.Errorf("BrokerInfo creation failed: %v", err)
+	}
+	b.PacketSizeCap = maxPacketSize
+
+	// Clears the retained messages we publish, even if interrupted
+	done := cleanupOnExit(b)
+	defer done()
+
+	fmt.Printf("\nTarget: %v:%v\n", b.Host, b.Port)
+
+	b.BeforeStep = func(s mqttinfo.ScanStep) {
+		if s.Name == mqttinfo.StepGuess {
+			fmt.Println("\nTrying to guess broker software...")
+			return
+		}
+		fmt.Printf("\nChecking %v %v...\n", versionLabel(s.Version), s.Name)
+	}
+	b.AfterStep = func(s mqttinfo.ScanStep, err error) {
+		if err != nil {
+			fmt.Printf("Failed: %v\n", err)
+			return
+		}
+		printStep(b, s)
+	}
+	scanErr := b.Scan()
+
+	// Before writing JSON, which lists the cleanup failures
+	done()
+
+	// Failed scans are written too, with their errors
+	if jsonout {
+		if err := writeJSON(b); err != nil {
+			return err
+		}
+	}
+
+	return scanErr
+}
+
+// writeJSON appends b to mqttinfo.json, as a JSON line
+func writeJSON(b *mqttinfo.BrokerInfo) error {
+	js, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile("mqttinfo.json", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.WriteString(string(js) + "\n"); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// versionLabel returns the name of a protocol level
+func versionLabel(version byte) string {
+	switch version {
+	case packet.V31:
+		return v3
+	case packet.V311:
+		return v4
+	}
+	return v5
+}
+
+// printStep shows the results of a scan step
+func printStep(b *mqttinfo.BrokerInfo, s mqttinfo.ScanStep) {
+	v5 := s.Version == packet.V5
+	switch r := s.Result.(type) {
+	case *mqttinfo.RetainInfo:
+		printRetain(r, v5)
+	case *mqttinfo.WillInfo:
+		printWill(r, v5)
+	case *mqttinfo.SessionInfo:
+		printSession(r, v5)
+	case *mqttinfo.SharedInfo:
+		printShared(r, v5)
+	case *mqttinfo.TopicAliasInfo:
+		printTopicAlias(r)
+	case *mqttinfo.ExpiryInfo:
+		printExpiry(r)
+	case *mqttinfo.ForwardingInfo:
+		printForwarding(r)
+	case *mqttinfo.SubOptionsInfo:
+		printSubOptions(r)
+	case *mqttinfo.AuthInfo:
+		printAuth(r)
+	case *mqttinfo.PacketSizeInfo:
+		printPacketSize(r, v5)
+	case *mqttinfo.TopicLimitsInfo:
+		printTopicLimits(r)
+	case *mqttinfo.ClientIDInfo:
+		printClientID(r, v5)
+	case *mqttinfo.KeepAliveInfo:
+		printKeepAlive(r, v5)
+	case *mqttinfo.FlowControlInfo:
+		printFlowControl(r, v5)
+	case *mqttinfo.QoSDeliveryInfo:
+		printQoSDelivery(r, v5)
+	case *mqttinfo.QoS2Info:
+		printQoS2(r, v5)
+	case *mqttinfo.UnsubscribeInfo:
+		printUnsubscribe(r, v5)
+	}
+
+	switch s.Name {
+	case mqttinfo.StepConnection:
+		printConnection(b, s.Version)
+	case mqttinfo.StepAnalysis:
+		printAnalysis(b, s.Version)
+	case mqttinfo.StepGuess:
+		fmt.Printf("looks like %v\n", b.TypeGuessed)
+	}
+}
+
+// printConnection shows the results of a connection check
+func printConnection(b *mqttinfo.BrokerInfo, version byte) {
+	supported, anonymous := b.V5, b.V5Anonymous
+	switch version {
+	case packet.V31:
+		supported, anonymous = b.V3, b.V3Anonymous
+	case packet.V311:
+		supported, anonymous = b.V4, b.V4Anonymous
+	}
+	fmt.Printf("%v support\t%v\n", versionLabel(version), res(supported))
+	if supported {
+		fmt.Printf("needs authentication\t%v\n", res(!anonymous))
+	}
+}
+
+// printAnalysis shows the results of the analysis of a protocol level
+func printAnalysis(b *mqttinfo.BrokerInfo, version byte) {
+	qos1, qos2, qos3, subAll := b.V5QoS1, b.V5QoS2, b.V5QoS3Response, b.V5SubscribeAll
+	invalid, invalidUTF8 := b.V5InvalidTopics, b.V5InvalidUTF8Topic
+	publishSYS, filterSYS := b.V5PublishSYS, b.V5FilterSYS
+	switch version {
+	case packet.V31:
+		qos1, qos2, qos3, subAll = b.V3QoS1, b.V3QoS2, b.V3QoS3Response, b.V3SubscribeAll
+		invalid, invalidUTF8 = b.V3InvalidTopics, b.V3InvalidUTF8Topic
+		publishSYS, filterSYS = b.V3PublishSYS, b.V3FilterSYS
+	case packet.V311:
+		qos1, qos2, qos3, subAll = b.V4QoS1, b.V4QoS2, b.V4QoS3Response, b.V4SubscribeAll
+		invalid, invalidUTF8 = b.V4InvalidTopics, b.V4InvalidUTF8Topic
+		publishSYS, filterSYS = b.V4PublishSYS, b.V4FilterSYS
+	}
+
+	// Shows correct behavior as OK/green
+	fmt.Printf("supports QoS1\t\t%v\n", res(qos1))
+	fmt.Printf("supports QoS2\t\t%v\n", res(qos2))
+	fmt.Printf("rejects QoS3\t\t%v\n", res(!qos3))
+	fmt.Printf("forbids subscribe to #\t%v\n", res(!subAll))
+	fmt.Printf("rejects invalid topic\t%v\n", res(!invalid))
+	fmt.Printf("rejects invalid UTF-8\t%v\n", res(!invalidUTF8))
+	fmt.Printf("rejects $SYS publishs\t%v\n", res(!publishSYS))
+	if publishSYS {
+		fmt.Printf("filters $SYS publishs\t%v\n", res(filterSYS))
+	}
+}
+
+// printTopicAlias shows the results of the topic alias check
+func printTopicAlias(a *mqttinfo.TopicAliasInfo) {
+	fmt.Printf("topic alias maximum\t%v\n", a.Maximum)
+	if a.Maximum > 0 {
+		fmt.Printf("delivers with aliases\t%v\n", res(a.Delivered))
+	}
+	switch {
+	case a.Maximum >= mqttinfo.MaxTopicAlias:
+		fmt.Printf("rejects above maximum\tuntried, no alias above\n")
+	case a.ExceedDisconnect:
+		fmt.Printf("rejects above maximum\t%v (code 0x%02x)\n", res(true), a.ExceedReason)
+	default:
+		fmt.Printf("rejects above maximum\t%v\n", res(false))
+	}
+	fmt.Printf("sets topic aliases\t%v\n", res(a.Outbound))
+}
+
+// printExpiry shows the results of the message expiry check
+func printExpiry(e *mqttinfo.ExpiryInfo) {
+	fmt.Printf("expires retained\t%v\n", res(e.Retained))
+	fmt.Printf("expires queued\t\t%v\n", res(e.Queued))
+	fmt.Printf("decrements expiry\t%v\n", res(e.Decremented))
+}
+
+// printForwarding shows the results of the property forwarding check
+func printForwarding(f *mqttinfo.ForwardingInfo) {
+	fmt.Printf("delivers with props\t%v\n", res(f.Delivered))
+	if f.Delivered {
+		fmt.Printf("forwards unaltered\t%v\n", res(len(f.Dropped) == 0 && len(f.Altered) == 0))
+		for _, name := range f.Dropped {
+			fmt.Printf("  dropped\t\t%v\n", name)
+		}
+		for _, name := range f.Altered {
+			fmt.Printf("  altered\t\t%v\n", name)
+		}
+	}
+}
+
+// printSubOptions shows the results of the subscription option check
+func printSubOptions(so *mqttinfo.SubOptionsInfo) {
+	fmt.Printf("honors no local\t\t%v\n", res(so.NoLocal))
+	fmt.Printf("sub ids available\t%v\n", res(so.IDAvailable))
+	fmt.Printf("delivers sub ids\t%v\n", res(so.IDDelivered))
+	fmt.Printf("matches CONNACK\t\t%v\n", res(so.IDMatches))
+	fmt.Printf("overlap copies\t\t%v\n", so.OverlapCopies)
+	if so.IDAvailable {
+		fmt.Printf("overlap with all ids\t%v\n", res(so.OverlapIDs))
+	}
+}
+
+// printAuth shows the results of the enhanced authentication check
+func printAuth(a *mqttinfo.AuthInfo) {
+	for _, r := range a.Methods {
+		fmt.Printf("%-24v%v", r.Method, r.Result)
+		if r.ReasonCode != 0x00 {
+			fmt.Printf(" (code 0x%02x)", r.ReasonCode)
+		}
+		fmt.Println()
+	}
+}
+
+// printRetain shows the results of a retain check, with the v5.0 ones
+// if v5 is true
+func printRetain(r *mqttinfo.RetainInfo, v5 bool) {
+	if v5 {
+		fmt.Printf("retain available\t%v\n", res(r.Available))
+		fmt.Printf("honors retain available\t%v\n", res(r.AvailableHonored))
+		if !r.Available {
+			return
+		}
+	}
+	fmt.Printf("delivers retained\t%v\n", res(r.Delivered))
+	fmt.Printf("clears retained\t\t%v\n", res(r.Cleared))
+	if v5 {
+		fmt.Printf("retain as published\t%v\n", res(r.RetainAsPublished))
+		fmt.Printf("retain handling 0\t%v\n", res(r.RetainHandling0))
+		fmt.Printf("retain handling 1\t%v\n", res(r.RetainHandling1))
+		fmt.Printf("retain handling 2\t%v\n", res(r.RetainHandling2))
+	}
+}
+
+// printWill shows the results of a will check, with the v5.0 ones if v5
+// is true
+func printWill(w *mqttinfo.WillInfo, v5 bool) {
+	fmt.Printf("publishes will\t\t%v\n", res(w.Published))
+	fmt.Printf("not after DISCONNECT\t%v\n", res(w.Suppressed))
+	fmt.Printf("honors will QoS\t\t%v\n", res(w.QoS))
+	fmt.Printf("honors will retain\t%v\n", res(w.Retain))
+	if v5 {
+		fmt.Printf("honors will delay\t%v\n", res(w.Delay))
+	}
+}
+
+// printSession shows the results of a session check, with the v5.0 ones
+// if v5 is true
+func printSession(s *mqttinfo.SessionInfo, v5 bool) {
+	fmt.Printf("resumes sessions\t%v\n", res(s.SessionPresent))
+	fmt.Printf("queues offline messages\t%v\n", res(s.Queued))
+	if v5 {
+		fmt.Printf("expires sessions\t%v\n", res(s.Expiry))
+	}
+}
+
+// printShared shows the results of a shared subscription check, with the
+// v5.0 ones if v5 is true
+func printShared(s *mqttinfo.SharedInfo, v5 bool) {
+	if v5 {
+		fmt.Printf("shared subs available\t%v\n", res(s.Available))
+	}
+	fmt.Printf("supports shared subs\t%v\n", res(s.Supported))
+	if s.Supported {
+		fmt.Printf("distribution\t\t%v\n", s.Distribution)
+	}
+	if v5 {
+		fmt.Printf("matches CONNACK\t\t%v\n", res(s.AvailableMatches))
+	}
+}
+
+// printPacketSize shows the results of a packet size check, with the
+// v5.0 ones if v5 is true
+func printPacketSize(s *mqttinfo.PacketSizeInfo, v5 bool) {
+	if s.CapReached {
+		fmt.Printf("largest PUBLISH\t\t%v bytes or more\n", s.Largest)
+	} else {
+		fmt.Printf("largest PUBLISH\t\t%v bytes\n", s.Largest)
+		fmt.Printf("oversize refusal\t%v", s.Refusal)
+		if s.Refusal == mqttinfo.RefusalDisconnect || s.Refusal == mqttinfo.RefusalAck {
+			fmt.Printf(" (code 0x%02x)", s.RefusalReason)
+		}
+		fmt.Println()
+	}
+	if v5 {
+		if s.Advertised > 0 {
+			fmt.Printf("advertised maximum\t%v bytes\n", s.Advertised)
+		} else {
+			fmt.Printf("advertised maximum\tnone\n")
+		}
+		fmt.Printf("matches CONNACK\t\t%v\n", res(s.AdvertisedMatches))
+	}
+}
+
+// printTopicLimits shows the results of a topic limits check
+func printTopicLimits(t *mqttinfo.TopicLimitsInfo) {
+	fmt.Printf("topic length\t\t%v\n", limit(t.Length, t.LengthCapped, "bytes"))
+	fmt.Printf("topic levels\t\t%v\n", limit(t.Levels, t.LevelsCapped, "levels"))
+	fmt.Printf("filter wildcards\t%v\n", limit(t.FilterWildcards, t.FilterWildcardsCapped, "wildcards"))
+}
+
+// limit describes a limit found, or the largest value tried if capped
+func limit(n int, capped bool, unit string) string {
+	if capped {
+		return fmt.Sprintf("no limit up to %v %v", n, unit)
+	}
+	return fmt.Sprintf("%v %v", n, unit)
+}
+
+// printClientID shows the results of a client ID check, with the v5.0
+// ones if v5 is true
+func printClientID(ci *mqttinfo.ClientIDInfo, v5 bool) {
+	fmt.Printf("accepts empty ID\t%v\n", res(ci.Empty))
+	if v5 && ci.Empty {
+		fmt.Printf("assigns client ID\t%v\n", res(ci.Assigned))
+	}
+	fmt.Printf("client ID length\t%v\n", limit(ci.Length, ci.LengthCapped, "bytes"))
+	if ci.RefusedCharacters != "" {
+		fmt.Printf("refused characters\t%q\n", ci.RefusedCharacters)
+	} else {
+		fmt.Printf("refused characters\tnone\n")
+	}
+	fmt.Printf("duplicate client ID\t%v", ci.Duplicate)
+	if ci.TakeoverReason != 0x00 {
+		fmt.Printf(" (code 0x%02x)", ci.TakeoverReason)
+	}
+	fmt.Println()
+}
+
+// printKeepAlive shows the results of a keep-alive check, with the v5.0
+// ones if v5 is true
+func printKeepAlive(k *mqttinfo.KeepAliveInfo, v5 bool) {
+	if v5 {
+		if k.ServerDisabled {
+			fmt.Printf("server keep-alive\t0 (disabled) for %vs\n", k.KeepAlive)
+		} else if k.ServerKeepAlive > 0 {
+			fmt.Printf("server keep-alive\t%vs for %vs\n", k.ServerKeepAlive, k.KeepAlive)
+		} else {
+			fmt.Printf("server keep-alive\tnone\n")
+		}
+	}
+	fmt.Printf("enforces keep-alive\t%v", res(k.Enforced))
+	if k.Enforced {
+		fmt.Printf(" (after %v", k.ClosedAfter.Round(100*time.Millisecond))
+		if k.Reason != 0x00 {
+			fmt.Printf(", code 0x%02x", k.Reason)
+		}
+		fmt.Printf(")")
+	}
+	fmt.Println()
+	if k.ServerDisabled {
+		fmt.Printf("keeps it open\t\t%v\n", res(k.WithinSpec))
+	} else {
+		fmt.Printf("within 1.5x keep-alive\t%v\n", res(k.WithinSpec))
+	}
+	fmt.Printf("accepts keep-alive 0\t%v\n", res(k.ZeroAccepted))
+	if v5 && k.ZeroServerKeepAlive > 0 {
+		fmt.Printf("server keep-alive\t%vs for 0\n", k.ZeroServerKeepAlive)
+	}
+	if k.ZeroAccepted {
+		fmt.Printf("keeps 0 open\t\t%v\n", res(k.ZeroKeptOpen))
+	}
+}
+
+// printFlowControl shows the results of a flow control check, with the
+// v5.0 ones if v5 is true
+func printFlowControl(f *mqttinfo.FlowControlInfo, v5 bool) {
+	if v5 {
+		fmt.Printf("receive maximum sent\t%v\n", f.ReceiveMaximum)
+	}
+	fmt.Printf("unacked QoS 1 sent\t%v\n", f.InflightQoS1)
+	if f.QoS2 {
+		fmt.Printf("unacked QoS 2 sent\t%v\n", f.InflightQoS2)
+	} else {
+		fmt.Printf("unacked QoS 2 sent\tQoS 2 not granted\n")
+	}
+	if v5 {
+		fmt.Printf("honors receive max\t%v\n", res(f.Honored))
+	}
+	fmt.Printf("resumes once acked\t%v\n", res(f.Resumed))
+	if v5 {
+		fmt.Printf("broker receive max\t%v\n", f.BrokerReceiveMaximum)
+	}
+	fmt.Printf("back-to-back QoS 1\t%v\n", limit(f.Accepted, f.AcceptedCapped, "messages"))
+	if f.Refusal != "" {
+		fmt.Printf("stopped acking by\t%v", f.Refusal)
+		if f.Refusal == mqttinfo.RefusalDisconnect || f.Refusal == mqttinfo.RefusalAck {
+			fmt.Printf(" (code 0x%02x)", f.RefusalReason)
+		}
+		fmt.Println()
+	}
+	if !f.QoS2 {
+		return
+	}
+	fmt.Printf("unreleased QoS 2\t%v\n", limit(f.Unreleased, f.UnreleasedCapped, "messages"))
+	if f.UnreleasedRefusal != "" {
+		fmt.Printf("excess refusal\t\t%v", f.UnreleasedRefusal)
+		if f.UnreleasedRefusal == mqttinfo.RefusalDisconnect || f.UnreleasedRefusal == mqttinfo.RefusalAck {
+			fmt.Printf(" (code 0x%02x)", f.UnreleasedReason)
+		}
+		fmt.Println()
+	}
+	if v5 {
+		fmt.Printf("matches CONNACK\t\t%v\n", res(f.AdvertisedMatches))
+	}
+}
+
+// printQoSDelivery shows the results of a QoS delivery check, with the
+// v5.0 ones if v5 is true
+func printQoSDelivery(q *mqttinfo.QoSDeliveryInfo, v5 bool) {
+	for s, granted := range q.Granted {
+		fmt.Printf("QoS %v subscription\t", s)
+		if granted >= 0x80 {
+			fmt.Printf("refused (code 0x%02x)\n", granted)
+			continue
+		}
+		delivered := make([]string, len(q.Delivered[s]))
+		for p, qos := range q.Delivered[s] {
+			delivered[p] = "-"
+			if qos >= 0 {
+				delivered[p] = fmt.Sprint(qos)
+			}
+		}
+		fmt.Printf("granted %v, QoS 0/1/2 delivered as %v\n", granted, strings.Join(delivered, "/"))
+	}
+	fmt.Printf("delivery matches\t%v\n", res(q.DeliveryMatches))
+	if q.Refusal != "" {
+		fmt.Printf("refused publish\t\tQoS %v, %v", q.RefusedQoS, q.Refusal)
+		if q.Refusal == mqttinfo.RefusalDisconnect || q.Refusal == mqttinfo.RefusalAck {
+			fmt.Printf(" (code 0x%02x)", q.RefusalReason)
+		}
+		fmt.Println()
+	}
+	if v5 {
+		fmt.Printf("maximum QoS\t\t%v\n", q.MaximumQoS)
+		fmt.Printf("honors maximum QoS\t%v\n", res(q.MaximumHonored))
+	}
+}
+
+// printQoS2 shows the results of a QoS 2 check, with the v5.0 reason
+// codes if v5 is true
+func printQoS2(q *mqttinfo.QoS2Info, v5 bool) {
+	if !q.Supported {
+		fmt.Printf("QoS 2\t\t\tnot granted\n")
+		return
+	}
+	fmt.Printf("DUP deliveries\t\t%v\n", q.DupDeliveries)
+	fmt.Printf("unknown PUBREL\t\t%v\n", pubcomp(q.UnknownPubcomp, q.UnknownReason, v5))
+	fmt.Printf("packet ID reuse\t\t%v\n", res(q.IDReused))
+	fmt.Printf("resumed PUBREL\t\t%v\n", pubcomp(q.ResumeCompleted, q.ResumeReason, v5))
+	fmt.Printf("resumed deliveries\t%v\n", q.ResumeDeliveries)
+}
+
+// pubcomp describes the answer to a PUBREL
+func pubcomp(received bool, code byte, v5 bool) string {
+	switch {
+	case !received:
+		return "no PUBCOMP"
+	case v5:
+		return fmt.Sprintf("PUBCOMP (code 0x%02x)", code)
+	}
+	return "PUBCOMP"
+}
+
+// printUnsubscribe shows the results of an unsubscribe check, with the
+// v5.0 ones if v5 is true
+func printUnsubscribe(u *mqttinfo.UnsubscribeInfo, v5 bool) {
+	fmt.Printf("UNSUBACK received\t%v\n", res(u.Acked))
+	if v5 {
+		fmt.Printf("UNSUBACK codes\t\t0x%02x, 0x%02x for none\n", u.Reason, u.MissingReason)
+		fmt.Printf("codes as expected\t%v\n", res(u.ReasonsMatch))
+	}
+	if u.Delivered {
+		fmt.Printf("stops delivery\t\t%v\n", res(u.Stopped))
+	} else {
+		fmt.Printf("stops delivery\t\tunknown, nothing delivered before\n")
+	}
+	switch u.InvalidRefusal {
+	case "":
+		fmt.Printf("invalid filter\t\taccepted\n")
+	case mqttinfo.RefusalDisconnect, mqttinfo.RefusalAck:
+		fmt.Printf("invalid filter\t\t%v (code 0x%02x)\n", u.InvalidRefusal, u.InvalidReason)
+	default:
+		fmt.Printf("invalid filter\t\t%v\n", u.InvalidRefusal)
+	}
+}
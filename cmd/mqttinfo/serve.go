@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/spf13/pflag"
+)
+
+var serveCmd = &command{
+	name:    "serve",
+	summary: "serves scan results over HTTP, as JSON",
+	repeats: true,
+	setup: func(fs *pflag.FlagSet) func(*options, []string) error {
+		listen := fs.StringP("listen", "l", "localhost:8080", "address to listen on")
+		return func(opts *options, args []string) error {
+			return runServe(opts, *listen)
+		}
+	},
+}
+
+// runServe answers GET /scan requests with a scan report of the broker
+// given by the options. The target can't be changed by requests, which
+// would send its credentials anywhere. A scan opens dozens of
+// connections, so requests made while one runs get 429 Too Many
+// Requests.
+func runServe(opts *options, listen string) error {
+
+	// Holds a value while a scan runs
+	scanning := make(chan struct{}, 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/scan", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		select {
+		case scanning <- struct{}{}:
+			defer func() { <-scanning }()
+		default:
+			http.Error(w, "a scan is already running", http.StatusTooManyRequests)
+			return
+		}
+
+		b, err := opts.brokerInfo()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Failures are reported in the JSON document, which lists the
+		// cleanup failures
+		done := cleanupOnExit(b)
+		b.Scan()
+		done()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(b)
+	})
+
+	fmt.Printf("Listening on http://%v/scan\n", listen)
+
+	return http.ListenAndServe(listen, mux)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+	"github.com/spf13/pflag"
+)
+
+var subCmd = &command{
+	name:    "sub",
+	summary: "subscribes to a topic filter and prints the messages received",
+	setup: func(fs *pflag.FlagSet) func(*options, []string) error {
+		topic := fs.StringP("topic", "t", "#", "topic filter to subscribe to")
+		qos := fs.IntP("qos", "q", 0, "maximum QoS of the subscription (0, 1 or 2)")
+		count := fs.IntP("count", "c", 0, "exits after this many messages (0 for no limit)")
+		return func(opts *options, args []string) error {
+			return runSub(opts, *topic, *qos, *count)
+		}
+	},
+}
+
+func runSub(opts *options, topic string, qos, count int) error {
+
+	if qos < 0 || qos > 2 {
+		return fmt.Errorf("invalid QoS %v", qos)
+	}
+
+	b, err := opts.brokerInfo()
+	if err != nil {
+		return err
+	}
+
+	c, err := b.NewClient(packet.V311)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	code, err := c.Subscribe(topic, byte(qos))
+	if err != nil {
+		return err
+	}
+	if code >= 0x80 {
+		return fmt.Errorf("subscription rejected (code 0x%02x)", code)
+	}
+
+	for i := 0; count == 0 || i < count; i++ {
+		pub, err := c.Next(0)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%v %s\n", pub.Topic, pub.Payload)
+	}
+
+	return nil
+}
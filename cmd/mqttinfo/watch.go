@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+var watchCmd = &command{
+	name:    "watch",
+	summary: "periodically checks that the broker accepts connections",
+	setup: func(fs *pflag.FlagSet) func(*options, []string) error {
+		interval := fs.DurationP("interval", "i", 30*time.Second, "time between two checks")
+		return func(opts *options, args []string) error {
+			return runWatch(opts, *interval)
+		}
+	},
+}
+
+func runWatch(opts *options, interval time.Duration) error {
+
+	if interval <= 0 {
+		return fmt.Errorf("invalid interval %v", interval)
+	}
+
+	for {
+		b, err := opts.brokerInfo()
+		if err != nil {
+			return err
+		}
+
+		// each version is checked even if another one failed
+		start := time.Now()
+		now := start.Format(time.RFC3339)
+		errV3 := b.CheckConnectionV3()
+		errV4 := b.CheckConnectionV4()
+		errV5 := b.CheckConnectionV5()
+		elapsed := time.Since(start).Round(time.Millisecond)
+
+		fmt.Printf("%v  %v:%v  %v  %v  %v  (%v)\n", now, b.Host, b.Port,
+			watchResult(v3, b.V3, errV3), watchResult(v4, b.V4, errV4),
+			watchResult(v5, b.V5, errV5), elapsed)
+
+		time.Sleep(interval)
+	}
+}
+
+// watchResult formats the result of a connection check, with its error
+func watchResult(version string, accepted bool, err error) string {
+	if err != nil {
+		return fmt.Sprintf("%v %v (%v)", version, res(false), err)
+	}
+	return fmt.Sprintf("%v %v", version, res(accepted))
+}
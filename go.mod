@@ -1,7 +1,12 @@
 module github.com/Teserakt-io/mqttinfo
 
+go 1.21
+
 require (
 	github.com/eclipse/paho.mqtt.golang v1.1.1
 	github.com/logrusorgru/aurora v0.0.0-20181002194514-a7b3b318ed4e
 	github.com/spf13/pflag v1.0.3
+	gopkg.in/yaml.v2 v2.4.0
 )
+
+require gopkg.in/check.v1 v0.0.0-20161208181325-20d25e280405 // indirect
@@ -0,0 +1,136 @@
+package mqttinfo
+
+import (
+	"bytes"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+// TopicAliasInfo holds the results of the v5.0 topic alias checks
+type TopicAliasInfo struct {
+	// Topic Alias Maximum advertised in CONNACK, and delivery of
+	// messages published with aliases up to it
+	Maximum   uint32
+	Delivered bool
+
+	// Publishing with an alias above the maximum gets a DISCONNECT,
+	// with this reason code (0x94 expected). Not tried if the maximum is
+	// the largest alias.
+	ExceedDisconnect bool
+	ExceedReason     byte
+
+	// Aliases set by the broker in messages sent to us
+	Outbound bool
+}
+
+// clientAliasMaximum is the Topic Alias Maximum sent in our CONNECT,
+// to see if the broker uses aliases
+const clientAliasMaximum = 10
+
+// MaxTopicAlias is the largest Topic Alias, a two byte integer
+const MaxTopicAlias = 65535
+
+// aliasPublish sends a QoS 1 message with a topic alias, and returns
+// the broker's PUBACK
+func (c *Client) aliasPublish(topic string, alias uint32, payload []byte) (*packet.Ack, error) {
+	return c.publish(&packet.Publish{
+		Topic:      topic,
+		QoS:        1,
+		Properties: packet.Properties{packet.IntProperty(packet.PropTopicAlias, alias)},
+		Payload:    payload,
+	})
+}
+
+// CheckTopicAliasV5 checks topic aliases, in both directions
+func (b *BrokerInfo) CheckTopicAliasV5() error {
+
+	a := &b.V5TopicAlias
+	topic := b.probeTopic("alias")
+	wait := b.quiet()
+
+	// The subscriber accepts aliases, to see if the broker sets them
+	connect := b.connectPacket(packet.V5)
+	connect.Properties = packet.Properties{packet.IntProperty(packet.PropTopicAliasMaximum, clientAliasMaximum)}
+	sub, err := b.newClient(connect)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+	if _, err = sub.subscribeWait(packet.Subscription{Filter: topic, Options: 1}, wait); err != nil {
+		return err
+	}
+
+	pub, err := b.probeClient(packet.V5)
+	if err != nil {
+		return err
+	}
+	defer pub.Close()
+	a.Maximum, _ = pub.Connack.Properties.Int(packet.PropTopicAliasMaximum)
+
+	// Set alias 1, then publish with it only
+	if a.Maximum > 0 {
+		b.beginCheck("v5.0 topic alias")
+		payloads := [][]byte{[]byte("mqttinfo alias set"), []byte("mqttinfo alias used")}
+		if _, err = pub.aliasPublish(topic, 1, payloads[0]); err != nil {
+			return err
+		}
+		ack, err := pub.aliasPublish("", 1, payloads[1])
+		if err != nil {
+			return err
+		}
+		if ack.ReasonCode < 0x80 {
+			delivered := 0
+			for _, payload := range payloads {
+				got, err := sub.receivePayload(payload, wait)
+				if err != nil {
+					return err
+				}
+				if got != nil && got.Topic == topic {
+					delivered++
+				}
+				if got != nil {
+					_, ok := got.Properties.Int(packet.PropTopicAlias)
+					a.Outbound = a.Outbound || ok
+				}
+			}
+			a.Delivered = delivered == len(payloads)
+		}
+	}
+
+	// Without aliases from us, the broker may still set them
+	if !a.Outbound {
+		b.beginCheck("v5.0 outbound topic alias")
+		for i := 0; i < 2; i++ {
+			payload := []byte("mqttinfo alias outbound")
+			if err = pub.Publish(topic, payload, 1, false); err != nil {
+				return err
+			}
+			got, err := sub.receivePayload(payload, wait)
+			if err != nil {
+				return err
+			}
+			if got != nil && bytes.Equal(got.Payload, payload) {
+				_, ok := got.Properties.Int(packet.PropTopicAlias)
+				a.Outbound = a.Outbound || ok
+			}
+		}
+	}
+
+	// One above the maximum must be refused, it's the last check since
+	// it ends the connection. None is above the largest maximum.
+	if a.Maximum >= MaxTopicAlias {
+		return nil
+	}
+	b.beginCheck("v5.0 topic alias above maximum")
+	_, err = pub.aliasPublish(topic, a.Maximum+1, []byte("mqttinfo alias exceeded"))
+	if err == nil {
+		return nil
+	}
+	if pub.Disconnect != nil {
+		a.ExceedDisconnect = true
+		a.ExceedReason = pub.Disconnect.ReasonCode
+	}
+	b.logf(LevelDebug, "alias above maximum: %v", err)
+
+	return nil
+}
@@ -0,0 +1,49 @@
+package mqttinfo
+
+import (
+	"testing"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/fakebroker"
+)
+
+func TestCheckTopicAlias(t *testing.T) {
+	outbound := fakebroker.HiveMQ()
+	outbound.OutboundAliases = true
+
+	noAliases := fakebroker.Mosquitto()
+	noAliases.ConnackProperties = nil
+
+	tests := []struct {
+		name     string
+		behavior fakebroker.Behavior
+		want     TopicAliasInfo
+	}{
+		{"mosquitto", fakebroker.Mosquitto(), TopicAliasInfo{
+			Maximum: 10, Delivered: true, ExceedDisconnect: true, ExceedReason: 0x94,
+		}},
+		{"outbound aliases", outbound, TopicAliasInfo{
+			Maximum: 5, Delivered: true, ExceedDisconnect: true, ExceedReason: 0x94, Outbound: true,
+		}},
+		{"largest maximum", fakebroker.EMQX(), TopicAliasInfo{
+			Maximum: 65535, Delivered: true,
+		}},
+		{"no aliases", noAliases, TopicAliasInfo{
+			ExceedDisconnect: true, ExceedReason: 0x94,
+		}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			b := newTestBrokerInfo(t, tt.behavior)
+
+			if err := b.CheckTopicAliasV5(); err != nil {
+				t.Fatalf("CheckTopicAliasV5() error = %v", err)
+			}
+			if b.V5TopicAlias != tt.want {
+				t.Errorf("V5TopicAlias = %+v, want %+v", b.V5TopicAlias, tt.want)
+			}
+		})
+	}
+}
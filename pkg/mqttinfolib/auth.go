@@ -0,0 +1,259 @@
+package mqttinfo
+
+import (
+	"fmt"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/scram"
+)
+
+// Outcomes of a v5.0 enhanced authentication method
+const (
+	// CONNACK success naming the method
+	AuthAccepted = "accepted"
+	// CONNACK or DISCONNECT with an error, or the connection closed
+	AuthRejected = "rejected"
+	// CONNACK success without the method, as if none was sent
+	AuthIgnored = "ignored"
+	// The broker's Authentication Data failed our verification
+	AuthUnverified = "unverified"
+)
+
+// AuthInfo holds the results of the v5.0 enhanced authentication check
+type AuthInfo struct {
+	Methods []AuthResult
+}
+
+// AuthResult is the outcome of an authentication method, with the reason
+// code of the CONNACK or DISCONNECT ending the exchange
+type AuthResult struct {
+	Method     string
+	Result     string
+	ReasonCode byte
+}
+
+// Authenticator is the client side of a v5.0 enhanced authentication
+// method
+type Authenticator interface {
+	// Method returns the Authentication Method name
+	Method() string
+	// Start returns the Authentication Data sent in CONNECT, nil for none
+	Start() ([]byte, error)
+	// Continue answers the Authentication Data of an AUTH from the broker
+	Continue(data []byte) ([]byte, error)
+	// Finish checks the Authentication Data of a successful CONNACK
+	Finish(data []byte) error
+}
+
+// SCRAM authenticates with SCRAM-SHA-1 or SCRAM-SHA-256
+type SCRAM struct {
+	client *scram.Client
+	name   string
+}
+
+// NewSCRAM returns a SCRAM authenticator for the given method and
+// credentials
+func NewSCRAM(method, username, password string) (*SCRAM, error) {
+	return newSCRAM(method, username, password, "")
+}
+
+// newSCRAM is NewSCRAM with the given client nonce, or a random one if
+// empty
+func newSCRAM(method, username, password, nonce string) (*SCRAM, error) {
+	mech, ok := scram.Lookup(method)
+	if !ok {
+		return nil, fmt.Errorf("unsupported SCRAM method %v", method)
+	}
+	if nonce == "" {
+		return &SCRAM{client: scram.NewClient(mech, username, password), name: method}, nil
+	}
+	return &SCRAM{client: scram.NewClientNonce(mech, username, password, nonce), name: method}, nil
+}
+
+// Method returns the SCRAM variant
+func (s *SCRAM) Method() string {
+	return s.name
+}
+
+// Start returns the client-first-message
+func (s *SCRAM) Start() ([]byte, error) {
+	return s.client.First(), nil
+}
+
+// Continue answers the server-first-message
+func (s *SCRAM) Continue(data []byte) ([]byte, error) {
+	return s.client.Final(data)
+}
+
+// Finish verifies the server-final-message
+func (s *SCRAM) Finish(data []byte) error {
+	return s.client.Verify(data)
+}
+
+// ChallengeResponse is a generic authentication method: Initial is sent
+// in CONNECT, and Respond answers each challenge of the broker
+type ChallengeResponse struct {
+	Name    string
+	Initial []byte
+	Respond func(challenge []byte) ([]byte, error)
+}
+
+// Method returns the method name
+func (cr *ChallengeResponse) Method() string {
+	return cr.Name
+}
+
+// Start returns the initial data
+func (cr *ChallengeResponse) Start() ([]byte, error) {
+	return cr.Initial, nil
+}
+
+// Continue answers a challenge
+func (cr *ChallengeResponse) Continue(data []byte) ([]byte, error) {
+	if cr.Respond == nil {
+		return nil, fmt.Errorf("no response to challenge of %v", cr.Name)
+	}
+	return cr.Respond(data)
+}
+
+// Finish accepts any final data
+func (cr *ChallengeResponse) Finish(data []byte) error {
+	return nil
+}
+
+// unknownAuthMethod is a method no broker knows, which must be refused
+const unknownAuthMethod = "mqttinfo-unknown"
+
+// authenticators returns the methods tried: SCRAM with the BrokerInfo's
+// credentials, an unknown method, then those set by the caller
+func (b *BrokerInfo) authenticators() []Authenticator {
+	var methods []Authenticator
+	for _, name := range []string{scram.SHA1.Name, scram.SHA256.Name} {
+		s, _ := newSCRAM(name, b.Username, b.Password, b.SCRAMNonces[name])
+		methods = append(methods, s)
+	}
+	methods = append(methods, &ChallengeResponse{Name: unknownAuthMethod})
+	return append(methods, b.Authenticators...)
+}
+
+// CheckAuthV5 tries enhanced authentication methods, and reports which
+// the broker accepts, rejects or ignores
+func (b *BrokerInfo) CheckAuthV5() error {
+	b.V5Auth.Methods = nil
+	for _, a := range b.authenticators() {
+		b.beginCheck("v5.0 authentication " + a.Method())
+		r, err := b.authenticate(a)
+		if err != nil {
+			return err
+		}
+		b.logf(LevelDebug, "%v %v (code 0x%02x)", r.Method, r.Result, r.ReasonCode)
+		b.V5Auth.Methods = append(b.V5Auth.Methods, r)
+	}
+	return nil
+}
+
+// authenticate connects with an authentication method, and runs its AUTH
+// exchange until CONNACK
+func (b *BrokerInfo) authenticate(a Authenticator) (AuthResult, error) {
+	r := AuthResult{Method: a.Method(), Result: AuthRejected}
+
+	data, err := a.Start()
+	if err != nil {
+		return r, err
+	}
+	// The method carries the credentials, if any
+	connect := b.connectPacket(packet.V5)
+	connect.HasUsername, connect.Username = false, ""
+	connect.HasPassword, connect.Password = false, nil
+	connect.Properties = authProperties(a.Method(), data)
+
+	conn, err := b.dial()
+	if err != nil {
+		return r, fmt.Errorf("TCP connection failed: %v", err)
+	}
+	c := &Client{conn: conn, version: packet.V5, timeout: b.timeout()}
+	defer conn.Close()
+	if err = c.write(connect.Encode()); err != nil {
+		return r, err
+	}
+
+	for {
+		p, err := c.read(c.timeout)
+		if err != nil {
+			// Closed without a reason code
+			b.logf(LevelDebug, "%v: %v", a.Method(), err)
+			return r, nil
+		}
+		switch p.Type {
+		case packet.CONNACK:
+			connack, err := packet.ParseConnack(p, c.version)
+			if err != nil {
+				return r, err
+			}
+			r.ReasonCode = connack.ReasonCode
+			if connack.ReasonCode >= 0x80 {
+				return r, nil
+			}
+			c.Close()
+			method, _ := connack.Properties.Str(packet.PropAuthMethod)
+			if method != a.Method() {
+				r.Result = AuthIgnored
+				return r, nil
+			}
+			data, _ := connack.Properties.Str(packet.PropAuthData)
+			if err = a.Finish([]byte(data)); err != nil {
+				b.logf(LevelDebug, "%v: %v", a.Method(), err)
+				r.Result = AuthUnverified
+				return r, nil
+			}
+			r.Result = AuthAccepted
+			return r, nil
+
+		case packet.AUTH:
+			auth, err := packet.ParseDisconnect(p, c.version)
+			if err != nil {
+				return r, err
+			}
+			r.ReasonCode = auth.ReasonCode
+			if auth.ReasonCode != 0x18 {
+				// Only "continue authentication" is valid before CONNACK
+				return r, nil
+			}
+			challenge, _ := auth.Properties.Str(packet.PropAuthData)
+			response, err := a.Continue([]byte(challenge))
+			if err != nil {
+				b.logf(LevelDebug, "%v: %v", a.Method(), err)
+				r.Result = AuthUnverified
+				return r, nil
+			}
+			reply := &packet.Disconnect{
+				Type:       packet.AUTH,
+				ReasonCode: 0x18,
+				Properties: authProperties(a.Method(), response),
+			}
+			if err = c.write(reply.Encode(c.version)); err != nil {
+				return r, err
+			}
+
+		case packet.DISCONNECT:
+			dis, err := packet.ParseDisconnect(p, c.version)
+			if err != nil {
+				return r, err
+			}
+			r.ReasonCode = dis.ReasonCode
+			return r, nil
+
+		default:
+			return r, fmt.Errorf("unexpected %v during authentication", packet.TypeName(p.Type))
+		}
+	}
+}
+
+// authProperties returns the properties of a CONNECT or AUTH packet
+func authProperties(method string, data []byte) packet.Properties {
+	props := packet.Properties{packet.StringProperty(packet.PropAuthMethod, method)}
+	if data != nil {
+		props = append(props, packet.StringProperty(packet.PropAuthData, string(data)))
+	}
+	return props
+}
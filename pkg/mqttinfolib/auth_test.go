@@ -0,0 +1,81 @@
+package mqttinfo
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/fakebroker"
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/scram"
+)
+
+func TestCheckAuth(t *testing.T) {
+	withSCRAM := fakebroker.Mosquitto()
+	withSCRAM.AuthMethods = []string{"SCRAM-SHA-1", "SCRAM-SHA-256"}
+	withSCRAM.Username = "user"
+	withSCRAM.Password = "pencil"
+
+	sha256Only := withSCRAM
+	sha256Only.AuthMethods = []string{"SCRAM-SHA-256"}
+
+	ignoring := fakebroker.Mosquitto()
+	ignoring.IgnoreAuthMethods = true
+
+	// A custom method running SCRAM through the generic hook
+	client := scram.NewClient(scram.SHA256, "user", "pencil")
+	custom := &ChallengeResponse{Name: "SCRAM-SHA-256", Initial: client.First(), Respond: client.Final}
+
+	refused := func(method string) AuthResult {
+		return AuthResult{Method: method, Result: AuthRejected, ReasonCode: 0x8c}
+	}
+
+	tests := []struct {
+		name           string
+		behavior       fakebroker.Behavior
+		password       string
+		authenticators []Authenticator
+		want           []AuthResult
+	}{
+		{"mosquitto", fakebroker.Mosquitto(), "", nil, []AuthResult{
+			refused("SCRAM-SHA-1"), refused("SCRAM-SHA-256"), refused(unknownAuthMethod),
+		}},
+		{"scram", withSCRAM, "pencil", nil, []AuthResult{
+			{Method: "SCRAM-SHA-1", Result: AuthAccepted},
+			{Method: "SCRAM-SHA-256", Result: AuthAccepted},
+			refused(unknownAuthMethod),
+		}},
+		{"scram wrong password", withSCRAM, "pen", nil, []AuthResult{
+			{Method: "SCRAM-SHA-1", Result: AuthRejected, ReasonCode: 0x87},
+			{Method: "SCRAM-SHA-256", Result: AuthRejected, ReasonCode: 0x87},
+			refused(unknownAuthMethod),
+		}},
+		{"methods ignored", ignoring, "", nil, []AuthResult{
+			{Method: "SCRAM-SHA-1", Result: AuthIgnored},
+			{Method: "SCRAM-SHA-256", Result: AuthIgnored},
+			{Method: unknownAuthMethod, Result: AuthIgnored},
+		}},
+		{"custom method", sha256Only, "pencil", []Authenticator{custom}, []AuthResult{
+			refused("SCRAM-SHA-1"),
+			{Method: "SCRAM-SHA-256", Result: AuthAccepted},
+			refused(unknownAuthMethod),
+			{Method: "SCRAM-SHA-256", Result: AuthAccepted},
+		}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			b := newTestBrokerInfo(t, tt.behavior)
+			b.Username = tt.behavior.Username
+			b.Password = tt.password
+			b.Authenticators = tt.authenticators
+
+			if err := b.CheckAuthV5(); err != nil {
+				t.Fatalf("CheckAuthV5() error = %v", err)
+			}
+			if !reflect.DeepEqual(b.V5Auth.Methods, tt.want) {
+				t.Errorf("V5Auth.Methods = %+v, want %+v", b.V5Auth.Methods, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,438 @@
+package mqttinfo
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+// Client is a minimal MQTT client, used by the commands that exchange
+// messages with the broker rather than probe it
+type Client struct {
+	conn     net.Conn
+	version  byte
+	packetID uint16
+	timeout  time.Duration
+
+	// Connack is the broker's response to our CONNECT
+	Connack *packet.Connack
+
+	// Disconnect is the broker's DISCONNECT, if it sent one
+	Disconnect *packet.Disconnect
+
+	// probe records the retained messages published by the clients
+	// of checks, for cleanup
+	probe *BrokerInfo
+
+	// aliases are the topic aliases set by the broker
+	aliases map[uint32]string
+}
+
+// clientKeepAlive is the keep-alive sent by clients, in seconds
+const clientKeepAlive = 60
+
+// connectPacket returns a CONNECT with a client ID distinct from the
+// other clients of b, so that they can be connected at the same time
+func (b *BrokerInfo) connectPacket(version byte) *packet.Connect {
+	prefix := b.clientID()
+	b.mu.Lock()
+	b.clients++
+	id := b.clients
+	b.mu.Unlock()
+
+	return b.newConnect(version, fmt.Sprintf("%v%v", prefix, id))
+}
+
+// NewClient connects to the broker with the given protocol version
+func (b *BrokerInfo) NewClient(version byte) (*Client, error) {
+	return b.newClient(b.connectPacket(version))
+}
+
+// probeClient connects a client whose retained messages are cleared
+// by Cleanup
+func (b *BrokerInfo) probeClient(version byte) (*Client, error) {
+	c, err := b.NewClient(version)
+	if err != nil {
+		return nil, err
+	}
+	c.probe = b
+	return c, nil
+}
+
+func (b *BrokerInfo) newClient(connect *packet.Connect) (*Client, error) {
+
+	conn, err := b.dial()
+	if err != nil {
+		return nil, fmt.Errorf("TCP connection failed: %v", err)
+	}
+
+	c := &Client{conn: conn, version: connect.Level, timeout: b.timeout()}
+	if err = c.write(connect.Encode()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	p, err := c.read(c.timeout)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("CONNACK read failed: %v", err)
+	}
+	if p.Type != packet.CONNACK {
+		conn.Close()
+		return nil, fmt.Errorf("expected CONNACK, got %v", packet.TypeName(p.Type))
+	}
+	c.Connack, err = packet.ParseConnack(p, c.version)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if c.Connack.ReasonCode != 0x00 {
+		conn.Close()
+		return nil, fmt.Errorf("Connection request rejected (code %v)", c.Connack.ReasonCode)
+	}
+
+	return c, nil
+}
+
+func (c *Client) write(b []byte) error {
+	_, err := c.conn.Write(b)
+	return err
+}
+
+func (c *Client) read(timeout time.Duration) (*packet.Packet, error) {
+	err := c.conn.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+	return packet.Read(c.conn)
+}
+
+func (c *Client) nextPacketID() uint16 {
+	c.packetID++
+	if c.packetID == 0 {
+		c.packetID = 1
+	}
+	return c.packetID
+}
+
+// awaitAck reads packets until an acknowledgement of the given type and
+// packet ID, and ignores messages received meanwhile
+func (c *Client) awaitAck(t byte, id uint16) (*packet.Ack, error) {
+	for {
+		p, err := c.read(c.timeout)
+		if err != nil {
+			return nil, err
+		}
+		if p.Type == packet.DISCONNECT {
+			return nil, c.disconnected(p)
+		}
+		if p.Type != t {
+			continue
+		}
+		ack, err := packet.ParseAck(p, c.version)
+		if err != nil {
+			return nil, err
+		}
+		if ack.PacketID == id {
+			return ack, nil
+		}
+	}
+}
+
+// disconnected records the broker's DISCONNECT and returns an error
+func (c *Client) disconnected(p *packet.Packet) error {
+	dis, err := packet.ParseDisconnect(p, c.version)
+	if err != nil {
+		return err
+	}
+	c.Disconnect = dis
+	return fmt.Errorf("disconnected by broker (code 0x%02x)", dis.ReasonCode)
+}
+
+// publish sends a message and completes its QoS flow. It returns the
+// PUBACK or PUBREC, or nil for QoS 0.
+func (c *Client) publish(pub *packet.Publish) (*packet.Ack, error) {
+	if c.probe != nil && pub.Retain && len(pub.Payload) > 0 {
+		c.probe.trackRetained(pub.Topic, c.version)
+	}
+	ack, err := c.publishFlow(pub)
+	if c.probe != nil && pub.Retain {
+		switch {
+		case c.Disconnect != nil || (ack != nil && ack.ReasonCode >= 0x80):
+			// Refused, nothing was retained
+			c.probe.untrackRetained(pub.Topic, c.version)
+		case err == nil && len(pub.Payload) == 0:
+			c.probe.untrackRetained(pub.Topic, 0)
+		}
+	}
+	return ack, err
+}
+
+func (c *Client) publishFlow(pub *packet.Publish) (*packet.Ack, error) {
+	if pub.QoS > 0 && pub.PacketID == 0 {
+		pub.PacketID = c.nextPacketID()
+	}
+	if err := c.write(pub.Encode(c.version)); err != nil {
+		return nil, err
+	}
+
+	switch pub.QoS {
+	case 1:
+		ack, err := c.awaitAck(packet.PUBACK, pub.PacketID)
+		if err != nil {
+			return nil, fmt.Errorf("PUBACK read failed: %w", err)
+		}
+		return ack, nil
+	case 2:
+		ack, err := c.awaitAck(packet.PUBREC, pub.PacketID)
+		if err != nil {
+			return nil, fmt.Errorf("PUBREC read failed: %w", err)
+		}
+		if ack.ReasonCode >= 0x80 {
+			return ack, nil
+		}
+		rel := &packet.Ack{Type: packet.PUBREL, PacketID: pub.PacketID}
+		if err = c.write(rel.Encode(c.version)); err != nil {
+			return nil, err
+		}
+		if _, err = c.awaitAck(packet.PUBCOMP, pub.PacketID); err != nil {
+			return nil, fmt.Errorf("PUBCOMP read failed: %v", err)
+		}
+		return ack, nil
+	}
+
+	return nil, nil
+}
+
+// Publish sends a message and completes its QoS flow
+func (c *Client) Publish(topic string, payload []byte, qos byte, retain bool) error {
+	pub := &packet.Publish{Topic: topic, Payload: payload, QoS: qos, Retain: retain}
+	ack, err := c.publish(pub)
+	if err != nil {
+		return err
+	}
+	if ack != nil && ack.ReasonCode >= 0x80 {
+		return fmt.Errorf("publish rejected (code 0x%02x)", ack.ReasonCode)
+	}
+	return nil
+}
+
+// subscribe sends a SUBSCRIBE and returns the matching SUBACK
+func (c *Client) subscribe(props packet.Properties, subs ...packet.Subscription) (*packet.SubAck, error) {
+	sub := &packet.Subscribe{
+		PacketID:      c.nextPacketID(),
+		Properties:    props,
+		Subscriptions: subs,
+	}
+	if err := c.write(sub.Encode(c.version)); err != nil {
+		return nil, err
+	}
+
+	for {
+		p, err := c.read(c.timeout)
+		if err != nil {
+			return nil, fmt.Errorf("SUBACK read failed: %v", err)
+		}
+		if p.Type == packet.DISCONNECT {
+			return nil, c.disconnected(p)
+		}
+		if p.Type != packet.SUBACK {
+			continue
+		}
+		suback, err := packet.ParseSubAck(p, c.version)
+		if err != nil {
+			return nil, err
+		}
+		if suback.PacketID == sub.PacketID {
+			return suback, nil
+		}
+	}
+}
+
+// Subscribe subscribes to a topic filter and returns the SUBACK code,
+// which is the granted QoS on success
+func (c *Client) Subscribe(filter string, qos byte) (byte, error) {
+	suback, err := c.subscribe(nil, packet.Subscription{Filter: filter, Options: qos})
+	if err != nil {
+		return 0, err
+	}
+	if len(suback.ReasonCodes) != 1 {
+		return 0, fmt.Errorf("SUBACK has %v reason codes", len(suback.ReasonCodes))
+	}
+	return suback.ReasonCodes[0], nil
+}
+
+// subscribeOK subscribes with properties, and errors if refused
+func (c *Client) subscribeOK(props packet.Properties, sub packet.Subscription) error {
+	suback, err := c.subscribe(props, sub)
+	if err != nil {
+		return err
+	}
+	if len(suback.ReasonCodes) != 1 || suback.ReasonCodes[0] >= 0x80 {
+		return fmt.Errorf("subscription to %v refused (codes % x)", sub.Filter, suback.ReasonCodes)
+	}
+	return nil
+}
+
+// subscribeWait subscribes and returns the first message received
+// before wait, or nil
+func (c *Client) subscribeWait(sub packet.Subscription, wait time.Duration) (*packet.Publish, error) {
+	if err := c.subscribeOK(nil, sub); err != nil {
+		return nil, err
+	}
+	return c.receive(wait)
+}
+
+// unsubscribe sends an UNSUBSCRIBE and returns the matching UNSUBACK
+func (c *Client) unsubscribe(filters ...string) (*packet.SubAck, error) {
+	unsub := &packet.Unsubscribe{PacketID: c.nextPacketID(), Filters: filters}
+	if err := c.write(unsub.Encode(c.version)); err != nil {
+		return nil, err
+	}
+
+	for {
+		p, err := c.read(c.timeout)
+		if err != nil {
+			return nil, fmt.Errorf("UNSUBACK read failed: %w", err)
+		}
+		if p.Type == packet.DISCONNECT {
+			return nil, c.disconnected(p)
+		}
+		if p.Type != packet.UNSUBACK {
+			continue
+		}
+		unsuback, err := packet.ParseSubAck(p, c.version)
+		if err != nil {
+			return nil, err
+		}
+		if unsuback.PacketID == unsub.PacketID {
+			return unsuback, nil
+		}
+	}
+}
+
+// receive waits for the next message and acknowledges it. It returns nil
+// if no message arrived before the timeout, and keeps the connection
+// alive while waiting if the timeout is zero.
+func (c *Client) receive(timeout time.Duration) (*packet.Publish, error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	for {
+		wait := clientKeepAlive * time.Second / 2
+		if timeout > 0 {
+			left := time.Until(deadline)
+			if left <= 0 {
+				return nil, nil
+			}
+			if left < wait {
+				wait = left
+			}
+		}
+
+		p, err := c.read(wait)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if timeout > 0 {
+					continue
+				}
+				if err = c.write(packet.Simple(packet.PINGREQ)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			return nil, err
+		}
+
+		switch p.Type {
+		case packet.PUBLISH:
+			pub, err := packet.ParsePublish(p, c.version)
+			if err != nil {
+				return nil, err
+			}
+			c.resolveAlias(pub)
+			switch pub.QoS {
+			case 1:
+				ack := &packet.Ack{Type: packet.PUBACK, PacketID: pub.PacketID}
+				err = c.write(ack.Encode(c.version))
+			case 2:
+				ack := &packet.Ack{Type: packet.PUBREC, PacketID: pub.PacketID}
+				err = c.write(ack.Encode(c.version))
+			}
+			if err != nil {
+				return nil, err
+			}
+			return pub, nil
+		case packet.PUBREL:
+			ack, err := packet.ParseAck(p, c.version)
+			if err != nil {
+				return nil, err
+			}
+			comp := &packet.Ack{Type: packet.PUBCOMP, PacketID: ack.PacketID}
+			if err = c.write(comp.Encode(c.version)); err != nil {
+				return nil, err
+			}
+		case packet.DISCONNECT:
+			return nil, c.disconnected(p)
+		}
+	}
+}
+
+// receivePayload returns the first message with the given payload
+// received before wait, or nil
+func (c *Client) receivePayload(payload []byte, wait time.Duration) (*packet.Publish, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return nil, nil
+		}
+		pub, err := c.receive(left)
+		if pub == nil || err != nil {
+			return nil, err
+		}
+		if bytes.Equal(pub.Payload, payload) {
+			return pub, nil
+		}
+	}
+}
+
+// resolveAlias sets the topic of a message sent with a topic alias,
+// and records the aliases that the broker sets
+func (c *Client) resolveAlias(pub *packet.Publish) {
+	alias, ok := pub.Properties.Int(packet.PropTopicAlias)
+	if !ok {
+		return
+	}
+	if pub.Topic != "" {
+		if c.aliases == nil {
+			c.aliases = make(map[uint32]string)
+		}
+		c.aliases[alias] = pub.Topic
+		return
+	}
+	pub.Topic = c.aliases[alias]
+}
+
+// Next waits for the next message, acknowledges it and returns it.
+// It keeps the connection alive while waiting, and returns an error
+// after the given duration, or never if it is zero.
+func (c *Client) Next(timeout time.Duration) (*packet.Publish, error) {
+	pub, err := c.receive(timeout)
+	if err == nil && pub == nil {
+		return nil, fmt.Errorf("no message received after %v", timeout)
+	}
+	return pub, err
+}
+
+// Close sends a DISCONNECT and closes the connection
+func (c *Client) Close() error {
+	dis := &packet.Disconnect{}
+	c.write(dis.Encode(c.version))
+	return c.conn.Close()
+}
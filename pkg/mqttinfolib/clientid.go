@@ -0,0 +1,193 @@
+package mqttinfo
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+// Answers to a client connecting with the client ID of a connected one
+const (
+	// The connected client is disconnected, as MQTT requires
+	DuplicateTakeover = "takeover"
+	// The new client is refused
+	DuplicateRejected = "rejected"
+	// Both stay connected
+	DuplicateCoexist = "coexist"
+)
+
+// ClientIDInfo holds the results of the client identifier checks
+type ClientIDInfo struct {
+	// Empty client ID accepted, with clean session in v3.1.1, and the
+	// v5.0 Assigned Client Identifier sent
+	Empty    bool
+	Assigned bool
+
+	// Longest client ID accepted, in bytes, Capped if no limit was found
+	// up to the longest string of MQTT
+	Length       int
+	LengthCapped bool
+
+	// Characters refused in client IDs among those tried, MQTT only
+	// requires 0-9, a-z and A-Z
+	RefusedCharacters string
+
+	// Answer to a duplicate client ID, empty if the broker refused the
+	// client ID tried, and the reason code of the DISCONNECT of the client
+	// taken over, if any
+	Duplicate      string
+	TakeoverReason byte
+}
+
+// clientIDCharacters are tried one at a time in client IDs
+const clientIDCharacters = ` !"#$%&'()*+,-./:;<=>?@[\]^_{|}~é中`
+
+// minClientIDLength is the length that brokers must accept
+const minClientIDLength = 23
+
+// tryConnect sends a CONNECT, and returns the client if the broker
+// accepted it, and the CONNACK, nil if the broker closed the connection
+// without one
+func (b *BrokerInfo) tryConnect(connect *packet.Connect) (*Client, *packet.Connack, error) {
+	conn, err := b.dial()
+	if err != nil {
+		return nil, nil, fmt.Errorf("TCP connection failed: %v", err)
+	}
+	c := &Client{conn: conn, version: connect.Level, timeout: b.timeout()}
+	if err = c.write(connect.Encode()); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	p, err := c.read(c.timeout)
+	if err != nil {
+		b.logf(LevelDebug, "client ID %q: %v", connect.ClientID, err)
+		conn.Close()
+		return nil, nil, nil
+	}
+	if p.Type != packet.CONNACK {
+		conn.Close()
+		return nil, nil, fmt.Errorf("expected CONNACK, got %v", packet.TypeName(p.Type))
+	}
+	connack, err := packet.ParseConnack(p, c.version)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if connack.ReasonCode != 0x00 {
+		b.logf(LevelDebug, "client ID %q refused (code 0x%02x)", connect.ClientID, connack.ReasonCode)
+		conn.Close()
+		return nil, connack, nil
+	}
+	c.Connack = connack
+	return c, connack, nil
+}
+
+// acceptsClientID tells whether the broker accepts a client ID
+func (b *BrokerInfo) acceptsClientID(version byte, id string) (bool, error) {
+	c, _, err := b.tryConnect(b.newConnect(version, id))
+	if c == nil {
+		return false, err
+	}
+	c.Close()
+	return true, nil
+}
+
+// CheckClientIDV3 checks the handling of client IDs in v3.1
+func (b *BrokerInfo) CheckClientIDV3() error {
+	return b.checkClientID(packet.V31, &b.V3ClientID)
+}
+
+// CheckClientIDV4 checks the handling of client IDs in v3.1.1
+func (b *BrokerInfo) CheckClientIDV4() error {
+	return b.checkClientID(packet.V311, &b.V4ClientID)
+}
+
+// CheckClientIDV5 checks the handling of client IDs in v5.0, including
+// assigned ones
+func (b *BrokerInfo) CheckClientIDV5() error {
+	return b.checkClientID(packet.V5, &b.V5ClientID)
+}
+
+// checkClientID tries empty, long and unusual client IDs, and connects
+// twice with the same one
+func (b *BrokerInfo) checkClientID(version byte, ci *ClientIDInfo) error {
+
+	name := versionName(version)
+	prefix := b.clientID()
+	*ci = ClientIDInfo{}
+
+	b.beginCheck(name + " empty client ID")
+	c, _, err := b.tryConnect(b.newConnect(version, ""))
+	if err != nil {
+		return err
+	}
+	if c != nil {
+		ci.Empty = true
+		_, ci.Assigned = c.Connack.Properties.Str(packet.PropAssignedClientID)
+		c.Close()
+	}
+
+	// A long RunID makes longer prefixes
+	b.beginCheck(name + " client ID length")
+	ci.Length, ci.LengthCapped, err = searchLimit(max(minClientIDLength, len(prefix)+1), maxTopicLength, func(n int) (bool, error) {
+		return b.acceptsClientID(version, prefix+strings.Repeat("a", n-len(prefix)))
+	})
+	if err != nil {
+		return err
+	}
+
+	b.beginCheck(name + " client ID characters")
+	var refused strings.Builder
+	for _, r := range clientIDCharacters {
+		ok, err := b.acceptsClientID(version, prefix+string(r))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			refused.WriteRune(r)
+		}
+	}
+	ci.RefusedCharacters = refused.String()
+
+	b.beginCheck(name + " duplicate client ID")
+	id := prefix + "d"
+	first, _, err := b.tryConnect(b.newConnect(version, id))
+	if err != nil {
+		return err
+	}
+	if first == nil {
+		b.logf(LevelDebug, "client ID %v refused, no duplicate tried", id)
+		return nil
+	}
+	defer first.abort()
+
+	second, _, err := b.tryConnect(b.newConnect(version, id))
+	if err != nil {
+		return err
+	}
+	if second == nil {
+		ci.Duplicate = DuplicateRejected
+		return nil
+	}
+	defer second.Close()
+
+	ci.Duplicate = DuplicateCoexist
+	p, err := first.read(b.quiet())
+	switch {
+	case err == nil && p.Type == packet.DISCONNECT:
+		ci.Duplicate = DuplicateTakeover
+		if dis, err := packet.ParseDisconnect(p, version); err == nil {
+			ci.TakeoverReason = dis.ReasonCode
+		}
+	case err != nil && !errors.Is(err, os.ErrDeadlineExceeded):
+		// Closed without DISCONNECT
+		ci.Duplicate = DuplicateTakeover
+	}
+	b.logf(LevelDebug, "duplicate client ID: %v", ci.Duplicate)
+
+	return nil
+}
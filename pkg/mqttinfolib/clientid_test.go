@@ -0,0 +1,110 @@
+package mqttinfo
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/fakebroker"
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+func TestCheckClientID(t *testing.T) {
+	noEmpty := fakebroker.Mosquitto()
+	noEmpty.NoEmptyClientID = true
+
+	short := fakebroker.Mosquitto()
+	short.MaxClientIDLength = 23
+
+	alphanumeric := fakebroker.Mosquitto()
+	alphanumeric.AlphanumericClientIDs = true
+
+	rejecting := fakebroker.Mosquitto()
+	rejecting.DuplicateClientID = fakebroker.DuplicateReject
+
+	coexisting := fakebroker.Mosquitto()
+	coexisting.DuplicateClientID = fakebroker.DuplicateCoexist
+
+	tiny := fakebroker.Mosquitto()
+	tiny.MaxClientIDLength = 16
+
+	tests := []struct {
+		name     string
+		behavior fakebroker.Behavior
+		version  byte
+		want     ClientIDInfo
+	}{
+		{"mosquitto", fakebroker.Mosquitto(), packet.V5, ClientIDInfo{
+			Empty: true, Assigned: true, Length: 65535, LengthCapped: true,
+			Duplicate: DuplicateTakeover, TakeoverReason: 0x8e,
+		}},
+		{"v3.1.1", fakebroker.Mosquitto(), packet.V311, ClientIDInfo{
+			Empty: true, Length: 65535, LengthCapped: true, Duplicate: DuplicateTakeover,
+		}},
+		{"no empty", noEmpty, packet.V5, ClientIDInfo{
+			Length: 65535, LengthCapped: true, Duplicate: DuplicateTakeover, TakeoverReason: 0x8e,
+		}},
+		{"short", short, packet.V5, ClientIDInfo{
+			Empty: true, Assigned: true, Length: 23, Duplicate: DuplicateTakeover, TakeoverReason: 0x8e,
+		}},
+		{"alphanumeric", alphanumeric, packet.V311, ClientIDInfo{
+			Empty: true, Length: 65535, LengthCapped: true,
+			RefusedCharacters: clientIDCharacters, Duplicate: DuplicateTakeover,
+		}},
+		{"rejecting", rejecting, packet.V5, ClientIDInfo{
+			Empty: true, Assigned: true, Length: 65535, LengthCapped: true, Duplicate: DuplicateRejected,
+		}},
+		{"coexisting", coexisting, packet.V311, ClientIDInfo{
+			Empty: true, Length: 65535, LengthCapped: true, Duplicate: DuplicateCoexist,
+		}},
+		{"shorter than our IDs", tiny, packet.V311, ClientIDInfo{
+			Empty: true, Length: 22, RefusedCharacters: clientIDCharacters,
+		}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			b := newTestBrokerInfo(t, tt.behavior)
+
+			ci := &b.V5ClientID
+			if tt.version == packet.V311 {
+				ci = &b.V4ClientID
+			}
+			if err := b.checkClientID(tt.version, ci); err != nil {
+				t.Fatalf("checkClientID() error = %v", err)
+			}
+			if *ci != tt.want {
+				t.Errorf("ClientIDInfo = %+v, want %+v", *ci, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIDLongRunID(t *testing.T) {
+	b := newTestBrokerInfo(t, fakebroker.Mosquitto())
+	b.RunID = strings.Repeat("r", 30)
+
+	if err := b.checkClientID(packet.V311, &b.V4ClientID); err != nil {
+		t.Fatalf("checkClientID() error = %v", err)
+	}
+	if !b.V4ClientID.LengthCapped {
+		t.Errorf("ClientIDInfo = %+v, want no length limit", b.V4ClientID)
+	}
+}
+
+func TestClientIDRandom(t *testing.T) {
+	a := newTestBrokerInfo(t, fakebroker.Mosquitto())
+	b := newTestBrokerInfo(t, fakebroker.Mosquitto())
+
+	if a.clientID() == b.clientID() {
+		t.Errorf("client IDs of two scans are both %v", a.clientID())
+	}
+	if a.clientID() != a.clientID() {
+		t.Errorf("client ID of a scan changed")
+	}
+	id := a.connectPacket(packet.V31).ClientID
+	if !strings.HasPrefix(id, a.clientID()) || len(id) > 23 {
+		t.Errorf("client ID %v, want prefix %v and at most 23 bytes", id, a.clientID())
+	}
+}
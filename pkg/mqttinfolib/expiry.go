@@ -0,0 +1,173 @@
+package mqttinfo
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+// ExpiryInfo holds the results of the v5.0 message expiry checks
+type ExpiryInfo struct {
+	// Retained message, and message queued for an offline session, not
+	// delivered once their Message Expiry Interval has elapsed
+	Retained bool
+	Queued   bool
+
+	// Message Expiry Interval sent to subscribers decremented by the
+	// time the broker held the message
+	Decremented bool
+}
+
+// Message Expiry Intervals tested, in seconds
+const (
+	messageExpiry      = 60
+	shortMessageExpiry = 1
+)
+
+// Payloads of the messages expiring soon and late
+var (
+	expiryShort = []byte("mqttinfo expiry short")
+	expiryLong  = []byte("mqttinfo expiry long")
+)
+
+// expiringPublish sends a QoS 1 message with a Message Expiry Interval
+func (c *Client) expiringPublish(topic string, payload []byte, expiry uint32, retain bool) error {
+	ack, err := c.publish(&packet.Publish{
+		Topic:      topic,
+		QoS:        1,
+		Retain:     retain,
+		Properties: packet.Properties{packet.IntProperty(packet.PropMessageExpiry, expiry)},
+		Payload:    payload,
+	})
+	if err == nil && ack.ReasonCode >= 0x80 {
+		err = fmt.Errorf("publication to %v refused (code %#02x)", topic, ack.ReasonCode)
+	}
+	return err
+}
+
+// receiveExpiring returns the messages expiring soon and late received
+// before the broker goes quiet for wait, nil for those not received
+func (c *Client) receiveExpiring(wait time.Duration) (short, long *packet.Publish, err error) {
+	for {
+		pub, err := c.receive(wait)
+		if pub == nil || err != nil {
+			return short, long, err
+		}
+		switch {
+		case bytes.Equal(pub.Payload, expiryShort):
+			short = pub
+		case bytes.Equal(pub.Payload, expiryLong):
+			long = pub
+		}
+	}
+}
+
+// CheckExpiryV5 checks that retained and queued messages are dropped
+// after their Message Expiry Interval, and that the interval forwarded is
+// decremented
+func (b *BrokerInfo) CheckExpiryV5() error {
+
+	e := &b.V5Expiry
+	topic := b.probeTopic("expiry")
+	retainedShort, retainedLong := topic+"/retained/short", topic+"/retained/long"
+	queued := topic + "/queued"
+	wait := b.quiet()
+
+	// Subscribe in a persistent session, then go offline
+	connect := b.persistentConnect(packet.V5, sessionExpiry)
+	c, err := b.newClient(connect)
+	if err != nil {
+		return err
+	}
+	defer b.discardSession(connect)
+	if _, err = c.subscribeWait(packet.Subscription{Filter: queued, Options: 1}, wait); err != nil {
+		c.Close()
+		return err
+	}
+	c.Close()
+	time.Sleep(wait)
+
+	b.beginCheck("v5.0 message expiry")
+	pub, err := b.probeClient(packet.V5)
+	if err != nil {
+		return err
+	}
+	defer pub.Close()
+	// Retained messages are refused if Retain Available is 0
+	available, ok := pub.Connack.Properties.Int(packet.PropRetainAvailable)
+	retain := !ok || available == 1
+	publications := []struct {
+		topic   string
+		payload []byte
+		expiry  uint32
+		retain  bool
+	}{
+		{retainedShort, expiryShort, shortMessageExpiry, true},
+		{retainedLong, expiryLong, messageExpiry, true},
+		{queued, expiryShort, shortMessageExpiry, false},
+		{queued, expiryLong, messageExpiry, false},
+	}
+	for _, p := range publications {
+		if p.retain && !retain {
+			continue
+		}
+		if err = pub.expiringPublish(p.topic, p.payload, p.expiry, p.retain); err != nil {
+			return err
+		}
+	}
+	defer func() {
+		if retain {
+			pub.Publish(retainedShort, nil, 1, true)
+			pub.Publish(retainedLong, nil, 1, true)
+		}
+	}()
+
+	time.Sleep(b.seconds(shortMessageExpiry) + wait)
+
+	// Held for longer than the short expiry, only the long messages may
+	// be delivered, with less time left
+	var delivered []*packet.Publish
+	later, err := b.probeClient(packet.V5)
+	if err != nil {
+		return err
+	}
+	defer later.Close()
+	if err = later.subscribeOK(nil, packet.Subscription{Filter: topic + "/retained/+", Options: 1}); err != nil {
+		return err
+	}
+	short, long, err := later.receiveExpiring(wait)
+	if err != nil {
+		return err
+	}
+	e.Retained = short == nil && long != nil
+	if long != nil {
+		delivered = append(delivered, long)
+	}
+
+	c, err = b.newClient(connect)
+	if err != nil {
+		return err
+	}
+	short, long, err = c.receiveExpiring(wait)
+	c.Close()
+	if err != nil {
+		return err
+	}
+	e.Queued = c.Connack.SessionPresent && short == nil && long != nil
+	if long != nil {
+		delivered = append(delivered, long)
+	}
+
+	e.Decremented = len(delivered) > 0
+	for _, p := range delivered {
+		left, ok := p.Properties.Int(packet.PropMessageExpiry)
+		b.logf(LevelDebug, "message expiry left for %v: %v (present %v)", p.Topic, left, ok)
+		if !ok || left >= messageExpiry {
+			e.Decremented = false
+		}
+	}
+
+	return nil
+}
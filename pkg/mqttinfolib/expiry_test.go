@@ -0,0 +1,44 @@
+package mqttinfo
+
+import (
+	"testing"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/fakebroker"
+)
+
+func TestCheckExpiry(t *testing.T) {
+	noExpiry := fakebroker.Mosquitto()
+	noExpiry.IgnoreMessageExpiry = true
+
+	noSessions := fakebroker.Mosquitto()
+	noSessions.NoSessions = true
+
+	noRetain := fakebroker.Mosquitto()
+	noRetain.NoRetain = true
+
+	tests := []struct {
+		name     string
+		behavior fakebroker.Behavior
+		want     ExpiryInfo
+	}{
+		{"mosquitto", fakebroker.Mosquitto(), ExpiryInfo{Retained: true, Queued: true, Decremented: true}},
+		{"message expiry ignored", noExpiry, ExpiryInfo{}},
+		{"no sessions", noSessions, ExpiryInfo{Retained: true, Decremented: true}},
+		{"no retain", noRetain, ExpiryInfo{Queued: true, Decremented: true}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			b := newTestBrokerInfo(t, tt.behavior)
+
+			if err := b.CheckExpiryV5(); err != nil {
+				t.Fatalf("CheckExpiryV5() error = %v", err)
+			}
+			if b.V5Expiry != tt.want {
+				t.Errorf("V5Expiry = %+v, want %+v", b.V5Expiry, tt.want)
+			}
+		})
+	}
+}
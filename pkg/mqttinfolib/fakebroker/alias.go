@@ -0,0 +1,46 @@
+package fakebroker
+
+import "github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+
+// resolveAlias applies the topic alias of a message from c, and
+// disconnects c if the alias is invalid
+func (b *Broker) resolveAlias(c *client, pub *packet.Publish) bool {
+	alias, ok := pub.Properties.Int(packet.PropTopicAlias)
+	if !ok {
+		return true
+	}
+
+	max, _ := b.Behavior.ConnackProperties.Int(packet.PropTopicAliasMaximum)
+	if alias == 0 || alias > max {
+		// Topic Alias invalid
+		c.write((&packet.Disconnect{ReasonCode: 0x94}).Encode(c.version))
+		return false
+	}
+	if pub.Topic != "" {
+		c.aliases[alias] = pub.Topic
+		return true
+	}
+	topic, ok := c.aliases[alias]
+	if !ok {
+		// Protocol error
+		c.write((&packet.Disconnect{ReasonCode: 0x82}).Encode(c.version))
+		return false
+	}
+	pub.Topic = topic
+	return true
+}
+
+// outboundAlias returns the alias of a topic sent to c, and whether the
+// topic was sent with it before. It returns 0 if there is no alias, c.mu
+// must be held.
+func (c *client) outboundAlias(topic string) (uint32, bool) {
+	if alias, ok := c.outAliases[topic]; ok {
+		return alias, true
+	}
+	if uint32(len(c.outAliases)) >= c.aliasMax {
+		return 0, false
+	}
+	alias := uint32(len(c.outAliases)) + 1
+	c.outAliases[topic] = alias
+	return alias, false
+}
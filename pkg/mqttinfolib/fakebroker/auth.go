@@ -0,0 +1,71 @@
+package fakebroker
+
+import (
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/scram"
+)
+
+// SCRAM parameters of the accepted credentials
+var scramSalt = []byte("fakebroker salt")
+
+const scramIterations = 4096
+
+// authenticate runs the v5.0 enhanced authentication of a CONNECT, and
+// returns the CONNACK reason code and the properties ending the exchange
+func (b *Broker) authenticate(c *client, connect *packet.Connect, method string) (byte, packet.Properties) {
+	bh := &b.Behavior
+
+	mech, ok := scram.Lookup(method)
+	if !ok || !hasMethod(bh.AuthMethods, method) {
+		// Bad authentication method
+		return 0x8c, nil
+	}
+
+	s := scram.NewServer(mech, bh.Username, bh.Password, scramSalt, scramIterations)
+	clientFirst, _ := connect.Properties.Str(packet.PropAuthData)
+	serverFirst, err := s.First([]byte(clientFirst))
+	if err != nil {
+		return 0x87, nil
+	}
+	challenge := &packet.Disconnect{
+		Type:       packet.AUTH,
+		ReasonCode: 0x18,
+		Properties: packet.Properties{
+			packet.StringProperty(packet.PropAuthMethod, method),
+			packet.StringProperty(packet.PropAuthData, string(serverFirst)),
+		},
+	}
+	c.write(challenge.Encode(c.version))
+
+	p, err := packet.Read(c.conn)
+	if err != nil || p.Type != packet.AUTH {
+		return 0x82, nil
+	}
+	auth, err := packet.ParseDisconnect(p, c.version)
+	if err != nil {
+		return 0x81, nil
+	}
+	if m, _ := auth.Properties.Str(packet.PropAuthMethod); auth.ReasonCode != 0x18 || m != method {
+		// Protocol error
+		return 0x82, nil
+	}
+	clientFinal, _ := auth.Properties.Str(packet.PropAuthData)
+	serverFinal, err := s.Final([]byte(clientFinal))
+	if err != nil {
+		return 0x87, nil
+	}
+
+	return 0x00, packet.Properties{
+		packet.StringProperty(packet.PropAuthMethod, method),
+		packet.StringProperty(packet.PropAuthData, string(serverFinal)),
+	}
+}
+
+func hasMethod(methods []string, method string) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package fakebroker
+
+import "github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+
+// The behaviors below reproduce what mqttinfo observes on default
+// installations of each product, rather than the products themselves
+
+// Mosquitto mimics mosquitto: a $SYS tree under $SYS/broker, and client
+// publications to $SYS accepted but not forwarded
+func Mosquitto() Behavior {
+	return Behavior{
+		Name:                "mosquitto",
+		V3:                  true,
+		V4:                  true,
+		V5:                  true,
+		Anonymous:           true,
+		MaxQoS:              2,
+		SubscribeAll:        true,
+		ValidateTopics:      true,
+		SharedSubscriptions: RoundRobin,
+		PublishSYS:          true,
+		SysTopics: []string{
+			"$SYS/broker/version",
+			"$SYS/broker/clients/connected",
+			"$SYS/broker/load/messages/sent/1min",
+		},
+		ConnackProperties: packet.Properties{
+			packet.IntProperty(packet.PropTopicAliasMaximum, 10),
+		},
+	}
+}
+
+// HiveMQ mimics HiveMQ: no $SYS tree, and connections closed on
+// publications to $SYS
+func HiveMQ() Behavior {
+	return Behavior{
+		Name:                "HiveMQ",
+		V3:                  true,
+		V4:                  true,
+		V5:                  true,
+		Anonymous:           true,
+		MaxQoS:              2,
+		SubscribeAll:        true,
+		ValidateTopics:      true,
+		SharedSubscriptions: RoundRobin,
+		ConnackProperties: packet.Properties{
+			packet.IntProperty(packet.PropReceiveMaximum, 10),
+			packet.IntProperty(packet.PropTopicAliasMaximum, 5),
+			packet.IntProperty(packet.PropMaximumPacketSize, 268435460),
+		},
+	}
+}
+
+// VerneMQ mimics VerneMQ: a $SYS tree per cluster node, including
+// router metrics
+func VerneMQ() Behavior {
+	return Behavior{
+		Name:                "VerneMQ",
+		V3:                  true,
+		V4:                  true,
+		V5:                  true,
+		Anonymous:           true,
+		MaxQoS:              2,
+		SubscribeAll:        true,
+		ValidateTopics:      true,
+		SharedSubscriptions: Random,
+		PublishSYS:          true,
+		SysTopics: []string{
+			"$SYS/VerneMQ@127.0.0.1/router/subscriptions",
+			"$SYS/VerneMQ@127.0.0.1/socket_open",
+		},
+	}
+}
+
+// EMQX mimics EMQX: a $SYS tree under $SYS/brokers, with the node name
+func EMQX() Behavior {
+	return Behavior{
+		Name:                "EMQX",
+		V3:                  true,
+		V4:                  true,
+		V5:                  true,
+		Anonymous:           true,
+		MaxQoS:              2,
+		SubscribeAll:        true,
+		ValidateTopics:      true,
+		SharedSubscriptions: Random,
+		PublishSYS:          true,
+		SysTopics: []string{
+			"$SYS/brokers/emqx@127.0.0.1/version",
+			"$SYS/brokers/emqx@127.0.0.1/uptime",
+		},
+		MaxPacketSize: 1048576,
+		ConnackProperties: packet.Properties{
+			packet.IntProperty(packet.PropRetainAvailable, 1),
+			packet.IntProperty(packet.PropMaximumPacketSize, 1048576),
+			packet.IntProperty(packet.PropTopicAliasMaximum, 65535),
+			packet.IntProperty(packet.PropWildcardSubAvailable, 1),
+			packet.IntProperty(packet.PropSubscriptionIDAvailable, 1),
+			packet.IntProperty(packet.PropSharedSubAvailable, 1),
+		},
+	}
+}
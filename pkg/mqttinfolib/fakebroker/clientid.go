@@ -0,0 +1,99 @@
+package fakebroker
+
+import (
+	"fmt"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+// Answers to a CONNECT with the client ID of a connected client
+const (
+	// Disconnect the connected client, 0x8e for v5.0, as MQTT requires
+	DuplicateTakeover = "takeover"
+	// Refuse the new client
+	DuplicateReject = "reject"
+	// Keep both connected
+	DuplicateCoexist = "coexist"
+)
+
+// clientIDCode returns the CONNACK reason code for the client ID of a
+// CONNECT, 0x00 if accepted
+func (b *Broker) clientIDCode(c *client, connect *packet.Connect) byte {
+	bh := &b.Behavior
+	id := connect.ClientID
+
+	ok := true
+	switch {
+	case id == "":
+		// v3.1.1 sessions of empty client IDs couldn't be resumed
+		ok = !bh.NoEmptyClientID && (connect.CleanStart || c.version == packet.V5)
+	case bh.MaxClientIDLength > 0 && len(id) > bh.MaxClientIDLength:
+		ok = false
+	case bh.AlphanumericClientIDs && !alphanumeric(id):
+		ok = false
+	case bh.DuplicateClientID == DuplicateReject:
+		b.mu.Lock()
+		ok = b.connected(id) == nil
+		b.mu.Unlock()
+	}
+
+	switch {
+	case ok:
+		return 0x00
+	case c.version == packet.V5:
+		return 0x85
+	}
+	return 0x02
+}
+
+// assignClientID sets the client ID of a v5.0 CONNECT without one, and
+// returns it
+func (b *Broker) assignClientID(connect *packet.Connect) string {
+	b.mu.Lock()
+	b.assigned++
+	connect.ClientID = fmt.Sprintf("fakebroker-%v", b.assigned)
+	b.mu.Unlock()
+	return connect.ClientID
+}
+
+// takeOver registers c under its client ID, and disconnects the clients
+// connected with the same one, including those still closing
+func (b *Broker) takeOver(c *client, id string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c.id = id
+	if id == "" || b.Behavior.DuplicateClientID == DuplicateCoexist {
+		return
+	}
+	for old := range b.clients {
+		if old == c || old.id != id {
+			continue
+		}
+		if old.version == packet.V5 {
+			// Session taken over
+			old.write((&packet.Disconnect{ReasonCode: 0x8e}).Encode(old.version))
+		}
+		old.conn.Close()
+	}
+}
+
+// connected returns the client connected with a client ID, b.mu must be
+// held
+func (b *Broker) connected(id string) *client {
+	for c := range b.clients {
+		if c.id == id && id != "" {
+			return c
+		}
+	}
+	return nil
+}
+
+func alphanumeric(s string) bool {
+	for _, r := range s {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') {
+			return false
+		}
+	}
+	return true
+}
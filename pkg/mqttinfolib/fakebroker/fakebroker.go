@@ -0,0 +1,1015 @@
+// Package fakebroker is an in-process MQTT broker whose behavior can be
+// scripted to mimic broker products, so that mqttinfolib can be tested
+// without network
+package fakebroker
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+// Behavior describes how the broker reacts to clients
+type Behavior struct {
+	Name string
+
+	// Protocol levels accepted in CONNECT, V3 is v3.1 with protocol
+	// name MQIsdp
+	V3 bool
+	V4 bool
+	V5 bool
+
+	// Anonymous accepts clients without credentials, Username and
+	// Password are the only credentials accepted if set
+	Anonymous bool
+	Username  string
+	Password  string
+
+	// ConnackCode, if set, returns the CONNACK reason code of a
+	// supported protocol level
+	ConnackCode func(c *packet.Connect) byte
+
+	// ConnackProperties are sent in v5.0 CONNACKs
+	ConnackProperties packet.Properties
+
+	// MaxQoS is the highest QoS accepted in PUBLISH and granted in
+	// SUBACK, publications above it close the connection
+	MaxQoS byte
+
+	// DropAboveMaxQoS drops publications above MaxQoS instead
+	DropAboveMaxQoS bool
+
+	// SubscribeAll grants subscriptions to "#"
+	SubscribeAll bool
+
+	// NoWildcards refuses subscriptions with wildcards. v5.0 clients are
+	// told in CONNACK.
+	NoWildcards bool
+
+	// ValidateTopics rejects topic filters with misplaced wildcards or
+	// invalid UTF-8
+	ValidateTopics bool
+
+	// PublishSYS accepts client publications to $SYS topics, otherwise
+	// the connection is closed. ForwardSYS also delivers and retains them.
+	PublishSYS bool
+	ForwardSYS bool
+
+	// SysTopics are published every SysInterval, 100ms if zero
+	SysTopics   []string
+	SysInterval time.Duration
+
+	// NoRetain doesn't retain messages. v5.0 clients are told in
+	// CONNACK, and disconnected if they publish retained messages.
+	NoRetain bool
+
+	// IgnoreRetainOptions treats v5.0 subscriptions as v3.1.1 ones,
+	// ignoring retain handling and retain as published
+	IgnoreRetainOptions bool
+
+	// IgnoreWillDelay publishes wills as soon as the connection is
+	// lost, ignoring the v5.0 Will Delay Interval
+	IgnoreWillDelay bool
+
+	// SharedSubscriptions is the strategy distributing the messages of
+	// $share/{group}/{filter} subscriptions: RoundRobin, Random or
+	// Sticky. Such filters are ordinary ones if it is empty.
+	SharedSubscriptions string
+
+	// OutboundAliases assigns topic aliases to the messages sent to
+	// v5.0 clients accepting them
+	OutboundAliases bool
+
+	// NoSessions starts a new session at every connection.
+	// IgnoreSessionExpiry keeps v5.0 sessions forever once they outlive
+	// the connection.
+	NoSessions          bool
+	IgnoreSessionExpiry bool
+
+	// IgnoreMessageExpiry keeps retained and queued messages past their
+	// v5.0 Message Expiry Interval, and forwards it unchanged
+	IgnoreMessageExpiry bool
+
+	// StripProperties are PUBLISH properties not forwarded to
+	// subscribers, such as packet.PropUserProperty
+	StripProperties []byte
+
+	// IgnoreNoLocal sends v5.0 clients their own messages even on No
+	// Local subscriptions
+	IgnoreNoLocal bool
+
+	// NoSubscriptionIDs drops the v5.0 Subscription Identifiers of
+	// subscriptions, instead of sending them with the messages
+	NoSubscriptionIDs bool
+
+	// DuplicateOverlaps sends a message once per subscription of a client
+	// it matches, instead of once with the highest QoS
+	DuplicateOverlaps bool
+
+	// AuthMethods are the v5.0 enhanced authentication methods accepted,
+	// among "SCRAM-SHA-1" and "SCRAM-SHA-256", for Username and Password.
+	// Other methods are refused, unless IgnoreAuthMethods connects clients
+	// as if they had sent none.
+	AuthMethods       []string
+	IgnoreAuthMethods bool
+
+	// MaxPacketSize, if set, refuses larger PUBLISH packets as set by
+	// OversizeRefusal: OversizeDisconnect, the default, OversizeClose or
+	// OversizeDrop
+	MaxPacketSize   int
+	OversizeRefusal string
+
+	// MaxTopicLength, MaxTopicLevels and MaxFilterWildcards, if set,
+	// limit topic names and filters. Publications above them disconnect
+	// v5.0 clients with 0x90 and close v3.1.1 ones, subscriptions are
+	// refused.
+	MaxTopicLength     int
+	MaxTopicLevels     int
+	MaxFilterWildcards int
+
+	// NoEmptyClientID refuses empty client IDs, which are otherwise
+	// accepted with clean session, and assigned one in v5.0.
+	// MaxClientIDLength, if set, and AlphanumericClientIDs restrict
+	// client IDs.
+	NoEmptyClientID       bool
+	MaxClientIDLength     int
+	AlphanumericClientIDs bool
+
+	// DuplicateClientID answers a client connecting with the ID of a
+	// connected one: DuplicateTakeover, the default, DuplicateReject or
+	// DuplicateCoexist
+	DuplicateClientID string
+
+	// Silent clients are disconnected after KeepAliveFactor times their
+	// keep-alive, 1.5 if zero, unless IgnoreKeepAlive. ServerKeepAlive,
+	// if set, replaces the keep-alive of v5.0 clients.
+	KeepAliveFactor float64
+	IgnoreKeepAlive bool
+	ServerKeepAlive uint16
+
+	// MaxInflight, if set, limits the QoS 1 and 2 messages sent to a
+	// client awaiting its acknowledgement, the others wait. So does the
+	// v5.0 Receive Maximum of clients, unless IgnoreReceiveMaximum.
+	MaxInflight          int
+	IgnoreReceiveMaximum bool
+
+	// LaxReceiveMaximum accepts more QoS 2 messages awaiting PUBREL than
+	// the Receive Maximum in ConnackProperties. Otherwise the next one
+	// disconnects v5.0 clients with 0x93, and closes v3.1.1 ones.
+	LaxReceiveMaximum bool
+
+	// DuplicateQoS2 delivers QoS 2 messages again when resent before
+	// PUBREL. CompleteUnknownPubrel answers PUBREL for unknown packet IDs
+	// without 0x92 in v5.0.
+	DuplicateQoS2         bool
+	CompleteUnknownPubrel bool
+
+	// UnsubackSuccess answers the UNSUBSCRIBE of filters without
+	// subscription with 0x00 in v5.0, instead of 0x11. KeepUnsubscribed
+	// acknowledges UNSUBSCRIBE without ending subscriptions.
+	UnsubackSuccess  bool
+	KeepUnsubscribed bool
+
+	// IgnoreGrantedQoS delivers messages to connected clients with the
+	// QoS they were published with, even above the QoS granted
+	IgnoreGrantedQoS bool
+
+	// Second is how long the seconds of keep-alives, expiry intervals
+	// and will delays last, time.Second if zero, so that tests can
+	// shorten them
+	Second time.Duration
+}
+
+// seconds returns the duration of n seconds of the protocol
+func (bh *Behavior) seconds(n uint32) time.Duration {
+	if bh.Second == 0 {
+		return time.Duration(n) * time.Second
+	}
+	return time.Duration(n) * bh.Second
+}
+
+// Ways of refusing PUBLISH packets above MaxPacketSize
+const (
+	// DISCONNECT 0x95 to v5.0 clients, then close
+	OversizeDisconnect = "disconnect"
+	// Close without DISCONNECT
+	OversizeClose = "close"
+	// Acknowledge without delivering
+	OversizeDrop = "drop"
+)
+
+// Broker is a running fake broker
+type Broker struct {
+	Behavior Behavior
+
+	mu       sync.Mutex
+	clients  map[*client]bool
+	retained map[string]*message
+	sessions map[string]*session
+	shared   map[string]*shareGroup
+	dials    int
+	assigned int
+	done     chan struct{}
+	closed   bool
+}
+
+// client is a connected client and its subscriptions
+type client struct {
+	conn    net.Conn
+	version byte
+
+	// id is the client ID, set once connected, b.mu guards it
+	id string
+
+	// keepAlive is the silence after which the client is disconnected,
+	// 0 for none
+	keepAlive time.Duration
+
+	mu       sync.Mutex
+	packetID uint16
+	subs     map[string]subscription
+	session  *session
+
+	// will is published when the connection ends without DISCONNECT,
+	// after willDelay
+	will      *packet.Will
+	willDelay time.Duration
+
+	// Topic aliases set by the client, and those we set, up to aliasMax
+	aliases    map[uint32]string
+	outAliases map[string]uint32
+	aliasMax   uint32
+
+	// Messages sent awaiting an acknowledgement, up to sendMax if set,
+	// and those waiting for room
+	inflight map[uint16]bool
+	waiting  []*packet.Publish
+	sendMax  int
+
+	// received are the QoS 2 messages from the client awaiting PUBREL,
+	// kept with its session, b.mu guards it
+	received map[uint16]bool
+}
+
+// New starts a broker with the given behavior
+func New(behavior Behavior) *Broker {
+	b := &Broker{
+		Behavior: behavior,
+		clients:  make(map[*client]bool),
+		retained: make(map[string]*message),
+		sessions: make(map[string]*session),
+		shared:   make(map[string]*shareGroup),
+		done:     make(chan struct{}),
+	}
+	if len(behavior.SysTopics) > 0 {
+		go b.publishSys()
+	}
+	return b
+}
+
+// Dial connects a new client to the broker. It has the signature of
+// net.DialTimeout, to be used as a BrokerInfo's Dialer.
+func (b *Broker) Dial(network, address string, timeout time.Duration) (net.Conn, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.ErrClosed}
+	}
+
+	b.dials++
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000 + b.dials}
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1883}
+	conn, server := pipe(local, remote)
+
+	c := &client{
+		conn:       server,
+		subs:       make(map[string]subscription),
+		aliases:    make(map[uint32]string),
+		outAliases: make(map[string]uint32),
+		inflight:   make(map[uint16]bool),
+		received:   make(map[uint16]bool),
+	}
+	b.clients[c] = true
+	go b.serve(c)
+
+	return conn, nil
+}
+
+// Close disconnects all clients and stops the broker
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+	b.closed = true
+	close(b.done)
+	for c := range b.clients {
+		c.conn.Close()
+	}
+}
+
+// Retained returns the topics holding a retained message, sorted
+func (b *Broker) Retained() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var topics []string
+	for topic := range b.retained {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+func (b *Broker) publishSys() {
+	interval := b.Behavior.SysInterval
+	if interval == 0 {
+		interval = 100 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+			for _, topic := range b.Behavior.SysTopics {
+				b.route(&packet.Publish{Topic: topic, Payload: []byte("1")}, nil)
+			}
+		}
+	}
+}
+
+func (b *Broker) serve(c *client) {
+	defer func() {
+		b.mu.Lock()
+		delete(b.clients, c)
+		b.endSession(c)
+		b.leaveShareLocked(c, "")
+		b.mu.Unlock()
+		c.conn.Close()
+		if c.will != nil {
+			b.publishWill(c.will, c.willDelay)
+		}
+	}()
+
+	p, err := packet.Read(c.conn)
+	if err != nil || p.Type != packet.CONNECT {
+		return
+	}
+	connect, err := packet.ParseConnect(p)
+	if err != nil || !b.accept(c, connect) {
+		return
+	}
+
+	for {
+		if c.keepAlive > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.keepAlive))
+		}
+		p, err = packet.Read(c.conn)
+		if errors.Is(err, os.ErrDeadlineExceeded) && c.version == packet.V5 {
+			// Keep alive timeout
+			c.write((&packet.Disconnect{ReasonCode: 0x8d}).Encode(c.version))
+		}
+		if err != nil || !b.handle(c, p) {
+			return
+		}
+	}
+}
+
+// accept answers a CONNECT, and returns whether the client is connected
+func (b *Broker) accept(c *client, connect *packet.Connect) bool {
+	bh := &b.Behavior
+
+	switch {
+	case connect.ProtocolName == "MQIsdp" && connect.Level == packet.V31 && bh.V3:
+		c.version = packet.V31
+	case connect.ProtocolName == "MQTT" && connect.Level == packet.V311 && bh.V4:
+		c.version = packet.V311
+	case connect.ProtocolName == "MQTT" && connect.Level == packet.V5 && bh.V5:
+		c.version = packet.V5
+	default:
+		// Unacceptable protocol version, answered as v3.1.1 does
+		c.write((&packet.Connack{ReasonCode: 0x01}).Encode(packet.V311))
+		return false
+	}
+
+	var code byte
+	var authProps packet.Properties
+	method, auth := connect.Properties.Str(packet.PropAuthMethod)
+	switch {
+	case bh.ConnackCode != nil:
+		code = bh.ConnackCode(connect)
+	case auth && c.version == packet.V5 && !bh.IgnoreAuthMethods:
+		code, authProps = b.authenticate(c, connect, method)
+	case !connect.HasUsername && !bh.Anonymous:
+		code = 0x05
+		if c.version == packet.V5 {
+			code = 0x87
+		}
+	case connect.HasUsername && bh.Username != "" &&
+		(connect.Username != bh.Username || string(connect.Password) != bh.Password):
+		code = 0x04
+		if c.version == packet.V5 {
+			code = 0x86
+		}
+	}
+	if code == 0x00 && c.version == packet.V5 && bh.NoRetain && connect.Will != nil && connect.Will.Retain {
+		// Retain not supported
+		code = 0x9a
+	}
+	if code == 0x00 {
+		code = b.clientIDCode(c, connect)
+	}
+	var assigned string
+	if code == 0x00 && c.version == packet.V5 && connect.ClientID == "" {
+		assigned = b.assignClientID(connect)
+	}
+
+	if code == 0x00 && c.version == packet.V5 && bh.OutboundAliases {
+		c.mu.Lock()
+		c.aliasMax, _ = connect.Properties.Int(packet.PropTopicAliasMaximum)
+		c.mu.Unlock()
+	}
+
+	if code == 0x00 {
+		c.mu.Lock()
+		c.sendMax = b.sendMaximum(c, connect)
+		c.mu.Unlock()
+	}
+
+	if code == 0x00 && connect.Will != nil {
+		c.will = connect.Will
+		if c.version == packet.V5 && !bh.IgnoreWillDelay {
+			// The will is published when the session ends, if earlier
+			delay, _ := connect.Will.Properties.Int(packet.PropWillDelay)
+			expiry, _ := connect.Properties.Int(packet.PropSessionExpiry)
+			if expiry < delay {
+				delay = expiry
+			}
+			c.willDelay = bh.seconds(delay)
+		}
+	}
+
+	keepAlive := connect.KeepAlive
+	if code == 0x00 && c.version == packet.V5 && bh.ServerKeepAlive > 0 {
+		keepAlive = bh.ServerKeepAlive
+	}
+	if !bh.IgnoreKeepAlive {
+		factor := bh.KeepAliveFactor
+		if factor == 0 {
+			factor = 1.5
+		}
+		c.keepAlive = time.Duration(float64(keepAlive) * factor * float64(bh.seconds(1)))
+	}
+
+	connack := &packet.Connack{ReasonCode: code, Properties: bh.ConnackProperties}
+	if bh.NoRetain || bh.NoWildcards || len(authProps) > 0 || assigned != "" || keepAlive != connect.KeepAlive {
+		props := append(packet.Properties(nil), bh.ConnackProperties...)
+		if bh.NoRetain {
+			props = append(props, packet.IntProperty(packet.PropRetainAvailable, 0))
+		}
+		if bh.NoWildcards {
+			props = append(props, packet.IntProperty(packet.PropWildcardSubAvailable, 0))
+		}
+		if assigned != "" {
+			props = append(props, packet.StringProperty(packet.PropAssignedClientID, assigned))
+		}
+		if keepAlive != connect.KeepAlive {
+			props = append(props, packet.IntProperty(packet.PropServerKeepAlive, uint32(keepAlive)))
+		}
+		connack.Properties = append(props, authProps...)
+	}
+	if code != 0x00 {
+		c.write(connack.Encode(c.version))
+		return false
+	}
+
+	b.takeOver(c, connect.ClientID)
+	var queue []*message
+	connack.SessionPresent, queue = b.startSession(c, connect)
+	c.write(connack.Encode(c.version))
+	for _, m := range queue {
+		c.deliver(m, m.pub.QoS, false, m.ids)
+	}
+
+	return true
+}
+
+// refuseOversize refuses a PUBLISH above MaxPacketSize, and returns false
+// to close the connection
+func (b *Broker) refuseOversize(c *client, pub *packet.Publish) bool {
+	switch b.Behavior.OversizeRefusal {
+	case OversizeClose:
+		return false
+	case OversizeDrop:
+		ack := &packet.Ack{PacketID: pub.PacketID}
+		switch pub.QoS {
+		case 1:
+			ack.Type = packet.PUBACK
+			c.write(ack.Encode(c.version))
+		case 2:
+			ack.Type = packet.PUBREC
+			c.write(ack.Encode(c.version))
+		}
+		return true
+	}
+	if c.version == packet.V5 {
+		c.write((&packet.Disconnect{ReasonCode: 0x95}).Encode(c.version))
+	}
+	return false
+}
+
+// handle processes a packet, and returns false to close the connection
+func (b *Broker) handle(c *client, p *packet.Packet) bool {
+	bh := &b.Behavior
+
+	switch p.Type {
+	case packet.PINGREQ:
+		c.write(packet.Simple(packet.PINGRESP))
+
+	case packet.PUBLISH:
+		if (p.Flags>>1)&0x03 == 0x03 {
+			// Malformed, QoS 3 doesn't exist
+			return false
+		}
+		pub, err := packet.ParsePublish(p, c.version)
+		if err != nil {
+			return false
+		}
+		if bh.MaxPacketSize > 0 && len(p.Bytes()) > bh.MaxPacketSize {
+			return b.refuseOversize(c, pub)
+		}
+		if pub.QoS > bh.MaxQoS {
+			if bh.DropAboveMaxQoS {
+				return true
+			}
+			if c.version == packet.V5 {
+				c.write((&packet.Disconnect{ReasonCode: 0x9b}).Encode(c.version))
+			}
+			return false
+		}
+		if c.version == packet.V5 && !b.resolveAlias(c, pub) {
+			return false
+		}
+		if !validTopic(pub.Topic, false) {
+			return false
+		}
+		if !withinLimits(bh, pub.Topic) {
+			if c.version == packet.V5 {
+				c.write((&packet.Disconnect{ReasonCode: 0x90}).Encode(c.version))
+			}
+			return false
+		}
+		if pub.Retain && bh.NoRetain {
+			if c.version == packet.V5 {
+				c.write((&packet.Disconnect{ReasonCode: 0x9a}).Encode(c.version))
+				return false
+			}
+			pub.Retain = false
+		}
+		fresh := true
+		if pub.QoS == 2 {
+			var ok bool
+			if fresh, ok = b.receiving(c, pub.PacketID); !ok {
+				if c.version == packet.V5 {
+					// Receive Maximum exceeded
+					c.write((&packet.Disconnect{ReasonCode: 0x93}).Encode(c.version))
+				}
+				return false
+			}
+		}
+		delivered := 0
+		switch {
+		case !fresh && !bh.DuplicateQoS2:
+			// Resent before PUBREL, already routed
+			delivered = 1
+		case strings.HasPrefix(pub.Topic, "$SYS"):
+			if !bh.PublishSYS {
+				return false
+			}
+			if bh.ForwardSYS {
+				delivered = b.route(pub, c)
+			}
+		default:
+			delivered = b.route(pub, c)
+		}
+		ack := &packet.Ack{PacketID: pub.PacketID}
+		if c.version == packet.V5 && delivered == 0 {
+			// No matching subscribers
+			ack.ReasonCode = 0x10
+		}
+		switch pub.QoS {
+		case 1:
+			ack.Type = packet.PUBACK
+			c.write(ack.Encode(c.version))
+		case 2:
+			ack.Type = packet.PUBREC
+			c.write(ack.Encode(c.version))
+		}
+
+	case packet.PUBREL:
+		rel, err := packet.ParseAck(p, c.version)
+		if err != nil {
+			return false
+		}
+		comp := &packet.Ack{Type: packet.PUBCOMP, PacketID: rel.PacketID}
+		if !b.released(c, rel.PacketID) && c.version == packet.V5 && !bh.CompleteUnknownPubrel {
+			// Packet Identifier not found
+			comp.ReasonCode = 0x92
+		}
+		c.write(comp.Encode(c.version))
+
+	case packet.PUBREC:
+		rec, err := packet.ParseAck(p, c.version)
+		if err != nil {
+			return false
+		}
+		if rec.ReasonCode >= 0x80 {
+			// The flow ends without PUBREL
+			c.acknowledged(rec.PacketID)
+			break
+		}
+		rel := &packet.Ack{Type: packet.PUBREL, PacketID: rec.PacketID}
+		c.write(rel.Encode(c.version))
+
+	case packet.PUBACK, packet.PUBCOMP:
+		ack, err := packet.ParseAck(p, c.version)
+		if err != nil {
+			return false
+		}
+		c.acknowledged(ack.PacketID)
+
+	case packet.SUBSCRIBE:
+		if p.Flags != 0x02 {
+			return false
+		}
+		sub, err := packet.ParseSubscribe(p, c.version)
+		if err != nil || len(sub.Subscriptions) == 0 {
+			return false
+		}
+		suback := &packet.SubAck{Type: packet.SUBACK, PacketID: sub.PacketID}
+		var id uint32
+		if c.version == packet.V5 && !bh.NoSubscriptionIDs {
+			id, _ = sub.Properties.Int(packet.PropSubscriptionID)
+		}
+		var granted, retained []packet.Subscription
+		for _, s := range sub.Subscriptions {
+			code := s.Options & 0x03
+			if code > bh.MaxQoS {
+				code = bh.MaxQoS
+			}
+			switch {
+			case bh.ValidateTopics && !validTopic(s.Filter, true), !withinLimits(bh, s.Filter):
+				code = 0x80
+				if c.version == packet.V5 {
+					code = 0x8f
+				}
+			case bh.NoWildcards && strings.ContainsAny(s.Filter, "+#"):
+				code = 0x80
+				if c.version == packet.V5 {
+					// Wildcard Subscriptions not supported
+					code = 0xa2
+				}
+			case s.Filter == "#" && !bh.SubscribeAll:
+				code = 0x80
+				if c.version == packet.V5 {
+					code = 0x87
+				}
+			case bh.SharedSubscriptions != "" && strings.HasPrefix(s.Filter, "$share/"):
+				// No retained messages for shared subscriptions
+				_, filter, ok := parseShare(s.Filter)
+				if !ok {
+					code = 0x80
+					if c.version == packet.V5 {
+						code = 0x8f
+					}
+					break
+				}
+				b.joinShare(c, s.Filter, filter, code)
+			default:
+				options := s.Options&^0x03 | code
+				if c.version != packet.V5 || bh.IgnoreRetainOptions {
+					options = code
+				}
+				granted = append(granted, packet.Subscription{Filter: s.Filter, Options: options})
+			}
+			suback.ReasonCodes = append(suback.ReasonCodes, code)
+		}
+		c.mu.Lock()
+		for _, s := range granted {
+			_, exists := c.subs[s.Filter]
+			switch s.Options >> 4 & 0x03 {
+			case 0:
+				retained = append(retained, s)
+			case 1:
+				if !exists {
+					retained = append(retained, s)
+				}
+			}
+			c.subs[s.Filter] = subscription{options: s.Options, id: id}
+		}
+		c.mu.Unlock()
+		c.write(suback.Encode(c.version))
+		b.sendRetained(c, retained, id)
+
+	case packet.UNSUBSCRIBE:
+		if p.Flags != 0x02 {
+			return false
+		}
+		unsub, err := packet.ParseUnsubscribe(p, c.version)
+		if err != nil || len(unsub.Filters) == 0 {
+			return false
+		}
+		if c.version != packet.V5 && bh.ValidateTopics {
+			// No reason codes to refuse invalid filters with
+			for _, f := range unsub.Filters {
+				if !validTopic(f, true) {
+					return false
+				}
+			}
+		}
+		unsuback := &packet.SubAck{Type: packet.UNSUBACK, PacketID: unsub.PacketID}
+		c.mu.Lock()
+		for _, f := range unsub.Filters {
+			var code byte
+			if bh.ValidateTopics && !validTopic(f, true) {
+				// Topic Filter invalid
+				unsuback.ReasonCodes = append(unsuback.ReasonCodes, 0x8f)
+				continue
+			}
+			_, ok := c.subs[f]
+			if !ok && strings.HasPrefix(f, "$share/") && bh.SharedSubscriptions != "" {
+				c.mu.Unlock()
+				ok = b.leaveShare(c, f)
+				c.mu.Lock()
+			}
+			if !ok && !bh.UnsubackSuccess {
+				// No subscription existed
+				code = 0x11
+			}
+			if !bh.KeepUnsubscribed {
+				delete(c.subs, f)
+			}
+			unsuback.ReasonCodes = append(unsuback.ReasonCodes, code)
+		}
+		c.mu.Unlock()
+		c.write(unsuback.Encode(c.version))
+
+	case packet.DISCONNECT:
+		dis, err := packet.ParseDisconnect(p, c.version)
+		if err == nil && dis.ReasonCode != 0x04 {
+			// Not "disconnect with will message"
+			c.will = nil
+		}
+		return false
+
+	default:
+		// A packet clients must not send
+		return false
+	}
+
+	return true
+}
+
+// publishWill publishes a will message after delay
+func (b *Broker) publishWill(will *packet.Will, delay time.Duration) {
+	pub := &packet.Publish{QoS: will.QoS, Retain: will.Retain, Topic: will.Topic, Payload: will.Payload}
+	if delay == 0 {
+		b.route(pub, nil)
+		return
+	}
+	go func() {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-b.done:
+		case <-timer.C:
+			b.route(pub, nil)
+		}
+	}()
+}
+
+// route delivers a message from a client, nil for the broker itself, to
+// the matching subscribers, retains it if needed, and returns the number
+// of deliveries
+func (b *Broker) route(pub *packet.Publish, from *client) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	m := b.newMessage(pub)
+	if pub.Retain && !b.Behavior.NoRetain {
+		if len(pub.Payload) == 0 {
+			delete(b.retained, pub.Topic)
+		} else {
+			b.retained[pub.Topic] = m
+		}
+	}
+
+	delivered := b.routeShared(m)
+	for _, sess := range b.sessions {
+		if sess.client != nil || sess.expired() {
+			continue
+		}
+		// Offline session, QoS 0 messages are dropped
+		subs := matching(sess.subs, pub.Topic, false)
+		options, ids := combined(subs)
+		qos := options & 0x03
+		if pub.QoS < qos {
+			qos = pub.QoS
+		}
+		if len(subs) > 0 && qos > 0 {
+			sess.queue = append(sess.queue, m.queued(qos, ids))
+			delivered++
+		}
+	}
+	for c := range b.clients {
+		local := c == from && !b.Behavior.IgnoreNoLocal
+		c.mu.Lock()
+		subs := matching(c.subs, pub.Topic, local)
+		c.mu.Unlock()
+		if len(subs) == 0 {
+			continue
+		}
+		copies := [][]subscription{subs}
+		if b.Behavior.DuplicateOverlaps {
+			copies = nil
+			for _, s := range subs {
+				copies = append(copies, []subscription{s})
+			}
+		}
+		for _, subs := range copies {
+			options, ids := combined(subs)
+			qos := options & 0x03
+			if pub.QoS < qos || b.Behavior.IgnoreGrantedQoS {
+				qos = pub.QoS
+			}
+			c.deliver(m, qos, pub.Retain && options&packet.RetainAsPublished != 0, ids)
+			delivered++
+		}
+	}
+
+	return delivered
+}
+
+// sendRetained delivers the retained messages matching new subscriptions,
+// with their identifier if not 0
+func (b *Broker) sendRetained(c *client, subs []packet.Subscription, id uint32) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var ids []uint32
+	if id > 0 {
+		ids = []uint32{id}
+	}
+	for _, s := range subs {
+		for topic, m := range b.retained {
+			if !match(s.Filter, topic) {
+				continue
+			}
+			qos := s.Options & 0x03
+			if m.pub.QoS < qos {
+				qos = m.pub.QoS
+			}
+			c.deliver(m, qos, true, ids)
+		}
+	}
+}
+
+// subscription is a granted subscription
+type subscription struct {
+	options byte
+
+	// id is the v5.0 Subscription Identifier, 0 if none
+	id uint32
+}
+
+// matching returns the subscriptions matching topic, leaving out the No
+// Local ones if the message comes from their client
+func matching(subs map[string]subscription, topic string, local bool) []subscription {
+	var found []subscription
+	for filter, s := range subs {
+		if match(filter, topic) && !(local && s.options&packet.NoLocal != 0) {
+			found = append(found, s)
+		}
+	}
+	return found
+}
+
+// combined returns the options of a single delivery for overlapping
+// subscriptions: the highest QoS, along with the retain as published flag
+// if any of them has it, and their identifiers
+func combined(subs []subscription) (byte, []uint32) {
+	var qos, rap byte
+	var ids []uint32
+	for _, s := range subs {
+		if s.options&0x03 > qos {
+			qos = s.options & 0x03
+		}
+		rap |= s.options & packet.RetainAsPublished
+		if s.id > 0 {
+			ids = append(ids, s.id)
+		}
+	}
+	return qos | rap, ids
+}
+
+func (c *client) write(b []byte) {
+	c.conn.Write(b)
+}
+
+// deliver sends a message to c with the identifiers of the subscriptions
+// it matches, unless it has expired
+func (c *client) deliver(m *message, qos byte, retain bool, ids []uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	props, ok := m.expiryProperty()
+	if !ok {
+		return
+	}
+	props = append(props, m.props...)
+	for _, id := range ids {
+		props = append(props, packet.IntProperty(packet.PropSubscriptionID, id))
+	}
+	out := &packet.Publish{Topic: m.pub.Topic, QoS: qos, Retain: retain, Payload: m.pub.Payload, Properties: props}
+	if alias, known := c.outboundAlias(out.Topic); alias > 0 {
+		out.Properties = append(out.Properties, packet.IntProperty(packet.PropTopicAlias, alias))
+		if known {
+			out.Topic = ""
+		}
+	}
+	c.send(out)
+}
+
+// validTopic checks a topic name, or a topic filter if filter is true
+func validTopic(topic string, filter bool) bool {
+	if topic == "" || !utf8.ValidString(topic) {
+		return false
+	}
+	levels := strings.Split(topic, "/")
+	for i, level := range levels {
+		if !strings.ContainsAny(level, "+#") {
+			continue
+		}
+		if !filter {
+			return false
+		}
+		if level == "+" || (level == "#" && i == len(levels)-1) {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// withinLimits returns whether a topic name or filter respects the
+// topic limits of a behavior
+func withinLimits(bh *Behavior, topic string) bool {
+	if bh.MaxTopicLength > 0 && len(topic) > bh.MaxTopicLength {
+		return false
+	}
+	levels := strings.Split(topic, "/")
+	if bh.MaxTopicLevels > 0 && len(levels) > bh.MaxTopicLevels {
+		return false
+	}
+	wildcards := 0
+	for _, level := range levels {
+		if level == "+" || level == "#" {
+			wildcards++
+		}
+	}
+	return bh.MaxFilterWildcards == 0 || wildcards <= bh.MaxFilterWildcards
+}
+
+// match returns whether a topic filter matches a topic name
+func match(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	fs := strings.Split(filter, "/")
+	ts := strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ts) {
+			return false
+		}
+		if f != "+" && f != ts[i] {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
@@ -0,0 +1,78 @@
+package fakebroker
+
+import "github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+
+// sendMaximum returns how many QoS 1 and 2 messages may await an
+// acknowledgement from c: the lowest of MaxInflight and the v5.0 Receive
+// Maximum of c, 0 for no limit
+func (b *Broker) sendMaximum(c *client, connect *packet.Connect) int {
+	max := b.Behavior.MaxInflight
+	if c.version != packet.V5 || b.Behavior.IgnoreReceiveMaximum {
+		return max
+	}
+	if rm, ok := connect.Properties.Int(packet.PropReceiveMaximum); ok && rm > 0 && (max == 0 || int(rm) < max) {
+		max = int(rm)
+	}
+	return max
+}
+
+// send writes a message to c, or queues it while sendMax messages await
+// an acknowledgement. c.mu must be held.
+func (c *client) send(out *packet.Publish) {
+	if out.QoS > 0 {
+		if c.sendMax > 0 && len(c.inflight) >= c.sendMax {
+			c.waiting = append(c.waiting, out)
+			return
+		}
+		c.packetID++
+		if c.packetID == 0 {
+			c.packetID = 1
+		}
+		out.PacketID = c.packetID
+		c.inflight[out.PacketID] = true
+	}
+	c.conn.Write(out.Encode(c.version))
+}
+
+// acknowledged ends the flow of a message sent to c, and sends the
+// messages waiting for room
+func (c *client) acknowledged(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.inflight, id)
+	for len(c.waiting) > 0 && (c.sendMax == 0 || len(c.inflight) < c.sendMax) {
+		out := c.waiting[0]
+		c.waiting = c.waiting[1:]
+		c.send(out)
+	}
+}
+
+// receiving holds a QoS 2 message from c until its PUBREL. It returns
+// whether the packet ID is new, and false for ok if as many messages as
+// the Receive Maximum advertised already are held.
+func (b *Broker) receiving(c *client, id uint16) (fresh, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if c.received[id] {
+		return false, true
+	}
+	max, _ := b.Behavior.ConnackProperties.Int(packet.PropReceiveMaximum)
+	if max > 0 && !b.Behavior.LaxReceiveMaximum && len(c.received) >= int(max) {
+		return true, false
+	}
+	c.received[id] = true
+	return true, true
+}
+
+// released ends the flow of a QoS 2 message from c, and returns false if
+// none was held with that packet ID
+func (b *Broker) released(c *client, id uint16) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	held := c.received[id]
+	delete(c.received, id)
+	return held
+}
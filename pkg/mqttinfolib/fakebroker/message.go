@@ -0,0 +1,89 @@
+package fakebroker
+
+import (
+	"time"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+// message is a publication routed by the broker, and possibly retained
+// or queued for a session
+type message struct {
+	pub *packet.Publish
+
+	// props are the properties forwarded to subscribers, besides the
+	// Message Expiry Interval
+	props packet.Properties
+
+	// expiry is zero if the message never expires, second is the length
+	// of the seconds of its interval, see Behavior.Second
+	expiry time.Time
+	second time.Duration
+
+	// ids are the Subscription Identifiers of a message queued for a
+	// session
+	ids []uint32
+}
+
+// forwardedProperties are the PUBLISH properties the spec requires
+// brokers to forward unaltered
+var forwardedProperties = []byte{
+	packet.PropPayloadFormat,
+	packet.PropContentType,
+	packet.PropResponseTopic,
+	packet.PropCorrelationData,
+	packet.PropUserProperty,
+}
+
+// newMessage holds pub, expiring after its v5.0 Message Expiry Interval
+func (b *Broker) newMessage(pub *packet.Publish) *message {
+	m := &message{pub: pub}
+	for _, p := range pub.Properties {
+		if hasID(forwardedProperties, p.ID) && !hasID(b.Behavior.StripProperties, p.ID) {
+			m.props = append(m.props, p)
+		}
+	}
+	seconds, ok := pub.Properties.Int(packet.PropMessageExpiry)
+	if ok && !b.Behavior.IgnoreMessageExpiry {
+		m.second = b.Behavior.seconds(1)
+		m.expiry = time.Now().Add(time.Duration(seconds) * m.second)
+	}
+	return m
+}
+
+// queued returns a copy of m queued for a session, to be delivered with
+// qos and the given Subscription Identifiers
+func (m *message) queued(qos byte, ids []uint32) *message {
+	pub := *m.pub
+	pub.QoS = qos
+	return &message{pub: &pub, props: m.props, expiry: m.expiry, second: m.second, ids: ids}
+}
+
+func hasID(ids []byte, id byte) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// expiryProperty returns the Message Expiry Interval to send with m,
+// decremented by the time it was held, and false once m has expired.
+// Messages ignoring expiry keep the interval they were published with.
+func (m *message) expiryProperty() (packet.Properties, bool) {
+	if m.expiry.IsZero() {
+		seconds, ok := m.pub.Properties.Int(packet.PropMessageExpiry)
+		if !ok {
+			return nil, true
+		}
+		return packet.Properties{packet.IntProperty(packet.PropMessageExpiry, seconds)}, true
+	}
+	left := time.Until(m.expiry)
+	if left <= 0 {
+		return nil, false
+	}
+	// Rounded up, a message just received keeps its interval
+	seconds := uint32((left + m.second - 1) / m.second)
+	return packet.Properties{packet.IntProperty(packet.PropMessageExpiry, seconds)}, true
+}
@@ -0,0 +1,141 @@
+package fakebroker
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// stream is one direction of a connection. Unlike net.Pipe, writes don't
+// wait for reads, and reads return everything buffered, as with TCP.
+type stream struct {
+	mu     sync.Mutex
+	buf    []byte
+	closed bool
+	signal chan struct{}
+}
+
+func newStream() *stream {
+	return &stream{signal: make(chan struct{}, 1)}
+}
+
+func (s *stream) notify() {
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (s *stream) write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, io.ErrClosedPipe
+	}
+	s.buf = append(s.buf, b...)
+	s.notify()
+	return len(b), nil
+}
+
+func (s *stream) read(b []byte, deadline func() time.Time) (int, error) {
+	for {
+		s.mu.Lock()
+		if len(s.buf) > 0 {
+			n := copy(b, s.buf)
+			s.buf = s.buf[n:]
+			if len(s.buf) > 0 {
+				s.notify()
+			}
+			s.mu.Unlock()
+			return n, nil
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return 0, io.EOF
+		}
+		s.mu.Unlock()
+
+		d := deadline()
+		if d.IsZero() {
+			<-s.signal
+			continue
+		}
+		wait := time.Until(d)
+		if wait <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.signal:
+			timer.Stop()
+		case <-timer.C:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (s *stream) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.notify()
+	s.mu.Unlock()
+}
+
+// pipeConn is one end of an in-memory connection
+type pipeConn struct {
+	in, out       *stream
+	local, remote net.Addr
+
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+// pipe returns the two ends of an in-memory connection
+func pipe(client, server net.Addr) (*pipeConn, *pipeConn) {
+	a, b := newStream(), newStream()
+	return &pipeConn{in: a, out: b, local: client, remote: server},
+		&pipeConn{in: b, out: a, local: server, remote: client}
+}
+
+func (c *pipeConn) readDeadline() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.deadline
+}
+
+func (c *pipeConn) Read(b []byte) (int, error) {
+	return c.in.read(b, c.readDeadline)
+}
+
+func (c *pipeConn) Write(b []byte) (int, error) {
+	return c.out.write(b)
+}
+
+// Close closes both directions, the peer reads what's left then EOF
+func (c *pipeConn) Close() error {
+	c.in.close()
+	c.out.close()
+	return nil
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return c.local }
+func (c *pipeConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	c.in.notify()
+	return nil
+}
+
+// SetWriteDeadline does nothing, writes never block
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
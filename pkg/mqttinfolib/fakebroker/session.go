@@ -0,0 +1,82 @@
+package fakebroker
+
+import (
+	"time"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+// session is the state kept for a client ID between connections
+type session struct {
+	subs  map[string]subscription
+	queue []*message
+
+	// received are the QoS 2 messages from the client awaiting PUBREL
+	received map[uint16]bool
+
+	// client is connected to the session, nil if offline. Offline
+	// sessions end after expiry, or never if forever is true.
+	client  *client
+	forever bool
+	expiry  time.Duration
+	ended   time.Time
+}
+
+func (s *session) expired() bool {
+	return s.client == nil && !s.forever && time.Since(s.ended) >= s.expiry
+}
+
+// startSession attaches c to its session, resumed or new, and returns
+// whether it was resumed and the messages queued meanwhile
+func (b *Broker) startSession(c *client, connect *packet.Connect) (bool, []*message) {
+	bh := &b.Behavior
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sess := b.sessions[connect.ClientID]
+	if sess != nil && (connect.CleanStart || sess.expired() || bh.NoSessions) {
+		delete(b.sessions, connect.ClientID)
+		sess = nil
+	}
+	present := sess != nil
+	if sess == nil {
+		sess = &session{subs: make(map[string]subscription), received: c.received}
+	}
+	c.received = sess.received
+
+	// v3.1.1 sessions without clean session last forever
+	persistent := !connect.CleanStart
+	sess.forever = true
+	if c.version == packet.V5 {
+		expiry, _ := connect.Properties.Int(packet.PropSessionExpiry)
+		persistent = expiry > 0
+		sess.forever = expiry == 0xffffffff || bh.IgnoreSessionExpiry
+		sess.expiry = bh.seconds(expiry)
+	}
+	if persistent && !bh.NoSessions {
+		b.sessions[connect.ClientID] = sess
+	}
+
+	sess.client = c
+	queue := sess.queue
+	sess.queue = nil
+
+	c.mu.Lock()
+	c.session = sess
+	c.subs = sess.subs
+	c.mu.Unlock()
+
+	return present, queue
+}
+
+// endSession detaches c from its session, b.mu must be held
+func (b *Broker) endSession(c *client) {
+	c.mu.Lock()
+	sess := c.session
+	c.mu.Unlock()
+
+	if sess != nil && sess.client == c {
+		sess.client = nil
+		sess.ended = time.Now()
+	}
+}
@@ -0,0 +1,109 @@
+package fakebroker
+
+import (
+	"math/rand"
+	"strings"
+)
+
+// Strategies distributing the messages of a shared subscription
+const (
+	RoundRobin = "round-robin"
+	Random     = "random"
+	Sticky     = "sticky"
+)
+
+// shareGroup is a shared subscription, whose members each get a share of
+// the messages
+type shareGroup struct {
+	filter  string
+	members []*client
+	qos     map[*client]byte
+	next    int
+}
+
+// parseShare splits a $share/{group}/{filter} topic filter, and returns
+// false if it isn't a valid one
+func parseShare(filter string) (string, string, bool) {
+	parts := strings.SplitN(filter, "/", 3)
+	if len(parts) != 3 || parts[0] != "$share" || parts[1] == "" ||
+		strings.ContainsAny(parts[1], "+#") || !validTopic(parts[2], true) {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+// joinShare adds c to a shared subscription
+func (b *Broker) joinShare(c *client, share, filter string, qos byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	g := b.shared[share]
+	if g == nil {
+		g = &shareGroup{filter: filter, qos: make(map[*client]byte)}
+		b.shared[share] = g
+	}
+	if _, ok := g.qos[c]; !ok {
+		g.members = append(g.members, c)
+	}
+	g.qos[c] = qos
+}
+
+// leaveShare removes c from a shared subscription, or from all of them
+// if share is empty, and returns whether it was a member
+func (b *Broker) leaveShare(c *client, share string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.leaveShareLocked(c, share)
+}
+
+func (b *Broker) leaveShareLocked(c *client, share string) bool {
+	found := false
+	for name, g := range b.shared {
+		if share != "" && name != share {
+			continue
+		}
+		if _, ok := g.qos[c]; !ok {
+			continue
+		}
+		found = true
+		delete(g.qos, c)
+		for i, m := range g.members {
+			if m == c {
+				g.members = append(g.members[:i], g.members[i+1:]...)
+				break
+			}
+		}
+		if len(g.members) == 0 {
+			delete(b.shared, name)
+		}
+	}
+	return found
+}
+
+// routeShared delivers a message to one member of each matching shared
+// subscription, b.mu must be held
+func (b *Broker) routeShared(m *message) int {
+	delivered := 0
+	for _, g := range b.shared {
+		if !match(g.filter, m.pub.Topic) {
+			continue
+		}
+		var c *client
+		switch b.Behavior.SharedSubscriptions {
+		case RoundRobin:
+			c = g.members[g.next%len(g.members)]
+			g.next++
+		case Random:
+			c = g.members[rand.Intn(len(g.members))]
+		default:
+			c = g.members[0]
+		}
+		qos := g.qos[c]
+		if m.pub.QoS < qos {
+			qos = m.pub.QoS
+		}
+		c.deliver(m, qos, false, nil)
+		delivered++
+	}
+	return delivered
+}
@@ -0,0 +1,326 @@
+package mqttinfo
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+// FlowControlInfo holds the results of the flow control checks
+type FlowControlInfo struct {
+	// Receive Maximum we sent in v5.0, and the QoS 1 and QoS 2 messages
+	// sent to us while we withheld their acknowledgements. Honored if no
+	// more than the Receive Maximum, v5.0 only, and Resumed if the others
+	// came once acknowledged.
+	ReceiveMaximum uint16
+	InflightQoS1   int
+	InflightQoS2   int
+	Honored        bool
+	Resumed        bool
+
+	// QoS 2 granted, the QoS 2 results are zero otherwise
+	QoS2 bool
+
+	// Receive Maximum of the broker, 65535 if absent, v5.0 only
+	BrokerReceiveMaximum uint16
+
+	// QoS 1 messages published back to back before reading any PUBACK:
+	// those acknowledged, Capped if all those tried, how the broker
+	// stopped acknowledging them, and the reason code of the PUBACK or
+	// DISCONNECT, if any
+	Accepted       int
+	AcceptedCapped bool
+	Refusal        string
+	RefusalReason  byte
+
+	// QoS 2 messages accepted while we withheld PUBREL, if QoS 2 was
+	// granted, Capped if all those tried, how the next one was refused,
+	// and the reason code of the PUBREC or DISCONNECT, if any.
+	// AdvertisedMatches if exactly the v5.0 Receive Maximum of the broker
+	// was accepted.
+	Unreleased        int
+	UnreleasedCapped  bool
+	UnreleasedRefusal string
+	UnreleasedReason  byte
+	AdvertisedMatches bool
+}
+
+// probeReceiveMaximum is the Receive Maximum of the subscribers of the
+// checks
+const probeReceiveMaximum = 5
+
+// flowMessages are published to a subscriber withholding acknowledgements,
+// well above the inflight limits of brokers
+const flowMessages = 50
+
+// flowPublishCap is the most messages published without completing
+// their flow
+const flowPublishCap = 100
+
+// unacknowledged reads the messages sent to c without acknowledging them,
+// until none arrives for wait
+func (c *Client) unacknowledged(wait time.Duration) ([]*packet.Publish, error) {
+	var pubs []*packet.Publish
+	for {
+		p, err := c.read(wait)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return pubs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch p.Type {
+		case packet.PUBLISH:
+			pub, err := packet.ParsePublish(p, c.version)
+			if err != nil {
+				return nil, err
+			}
+			c.resolveAlias(pub)
+			if pub.QoS > 0 {
+				pubs = append(pubs, pub)
+			}
+		case packet.DISCONNECT:
+			return nil, c.disconnected(p)
+		}
+	}
+}
+
+// acknowledge sends the PUBACK or PUBREC of messages
+func (c *Client) acknowledge(pubs []*packet.Publish) error {
+	for _, pub := range pubs {
+		ack := &packet.Ack{Type: packet.PUBACK, PacketID: pub.PacketID}
+		if pub.QoS == 2 {
+			ack.Type = packet.PUBREC
+		}
+		if err := c.write(ack.Encode(c.version)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckFlowControlV3 checks the inflight limits of v3.1
+func (b *BrokerInfo) CheckFlowControlV3() error {
+	return b.checkFlowControl(packet.V31, &b.V3FlowControl)
+}
+
+// CheckFlowControlV4 checks the inflight limits of v3.1.1
+func (b *BrokerInfo) CheckFlowControlV4() error {
+	return b.checkFlowControl(packet.V311, &b.V4FlowControl)
+}
+
+// CheckFlowControlV5 checks that the broker honors our Receive Maximum,
+// and enforces its own
+func (b *BrokerInfo) CheckFlowControlV5() error {
+	return b.checkFlowControl(packet.V5, &b.V5FlowControl)
+}
+
+// checkFlowControl counts the messages sent to us while we withhold
+// acknowledgements, and those we can publish before the broker
+// acknowledges them, or, with QoS 2, before we release them
+func (b *BrokerInfo) checkFlowControl(version byte, f *FlowControlInfo) error {
+
+	name := versionName(version)
+	*f = FlowControlInfo{}
+	if version == packet.V5 {
+		f.ReceiveMaximum = probeReceiveMaximum
+	}
+
+	f.Resumed = true
+	for _, qos := range []byte{1, 2} {
+		b.beginCheck(fmt.Sprintf("%v inflight QoS %v", name, qos))
+		if err := b.inflight(version, qos, f); err != nil {
+			return err
+		}
+	}
+	f.Honored = version == packet.V5 &&
+		f.InflightQoS1 <= int(f.ReceiveMaximum) && f.InflightQoS2 <= int(f.ReceiveMaximum)
+
+	b.beginCheck(name + " back-to-back QoS 1 messages")
+	if err := b.backToBack(version, f); err != nil {
+		return err
+	}
+
+	// Publishing QoS 2 would get us disconnected
+	if !f.QoS2 {
+		return nil
+	}
+	b.beginCheck(name + " unreleased QoS 2 messages")
+	return b.unreleased(version, f)
+}
+
+// inflight publishes flowMessages to a subscriber with our Receive
+// Maximum, if any, and counts those sent before it acknowledged any.
+// QoS 2 is skipped if not granted.
+func (b *BrokerInfo) inflight(version, qos byte, f *FlowControlInfo) error {
+	topic := b.probeTopic(fmt.Sprintf("inflight%v", qos))
+
+	connect := b.connectPacket(version)
+	if f.ReceiveMaximum > 0 {
+		connect.Properties = append(connect.Properties,
+			packet.IntProperty(packet.PropReceiveMaximum, uint32(f.ReceiveMaximum)))
+	}
+	sub, err := b.newClient(connect)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+	suback, err := sub.subscribe(nil, packet.Subscription{Filter: topic, Options: qos})
+	if err != nil {
+		return err
+	}
+	if len(suback.ReasonCodes) != 1 || suback.ReasonCodes[0] >= 0x80 {
+		return fmt.Errorf("subscription to %v refused (codes % x)", topic, suback.ReasonCodes)
+	}
+	if suback.ReasonCodes[0] < qos {
+		b.logf(LevelDebug, "QoS %v not granted", qos)
+		return nil
+	}
+
+	pub, err := b.NewClient(version)
+	if err != nil {
+		return err
+	}
+	defer pub.Close()
+	for i := 0; i < flowMessages; i++ {
+		payload := []byte(fmt.Sprintf("mqttinfo inflight %v", i))
+		if _, err = pub.publish(&packet.Publish{Topic: topic, QoS: qos, Payload: payload}); err != nil {
+			return err
+		}
+	}
+
+	first, err := sub.unacknowledged(b.quiet())
+	if err != nil {
+		return err
+	}
+	b.logf(LevelDebug, "%v QoS %v messages sent unacknowledged", len(first), qos)
+	if err = sub.acknowledge(first); err != nil {
+		return err
+	}
+	received := len(first)
+	for {
+		m, err := sub.receive(b.quiet())
+		if err != nil {
+			return err
+		}
+		if m == nil {
+			break
+		}
+		received++
+	}
+	b.logf(LevelDebug, "%v QoS %v messages received in all", received, qos)
+
+	if qos == 1 {
+		f.InflightQoS1 = len(first)
+	} else {
+		f.QoS2 = true
+		f.InflightQoS2 = len(first)
+	}
+	f.Resumed = f.Resumed && received >= flowMessages
+	return nil
+}
+
+// publishLimit returns how many messages the flow checks publish through
+// c, one past the v5.0 Receive Maximum of the broker, which it records
+func publishLimit(c *Client, f *FlowControlInfo) int {
+	if c.version != packet.V5 {
+		return flowPublishCap
+	}
+	f.BrokerReceiveMaximum = 65535
+	if rm, ok := c.Connack.Properties.Int(packet.PropReceiveMaximum); ok {
+		f.BrokerReceiveMaximum = uint16(rm)
+	}
+	return min(flowPublishCap, int(f.BrokerReceiveMaximum)+1)
+}
+
+// backToBack publishes QoS 1 messages without waiting for their PUBACK,
+// then counts the PUBACKs until the broker disconnects us, refuses one,
+// or stops sending them
+func (b *BrokerInfo) backToBack(version byte, f *FlowControlInfo) error {
+	c, err := b.NewClient(version)
+	if err != nil {
+		return err
+	}
+	defer c.abort()
+
+	limit := publishLimit(c, f)
+	topic := b.probeTopic("backtoback")
+	sent := 0
+	for ; sent < limit; sent++ {
+		pub := &packet.Publish{Topic: topic, QoS: 1, PacketID: c.nextPacketID(), Payload: []byte("mqttinfo back to back")}
+		if err = c.write(pub.Encode(version)); err != nil {
+			f.Refusal = RefusalClose
+			break
+		}
+	}
+
+	for f.Accepted < sent && f.Refusal == "" {
+		p, err := c.read(c.timeout)
+		switch {
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			f.Refusal = RefusalDrop
+		case err != nil:
+			f.Refusal = RefusalClose
+		case p.Type == packet.DISCONNECT:
+			if err = c.disconnected(p); c.Disconnect == nil {
+				return err
+			}
+			f.Refusal, f.RefusalReason = RefusalDisconnect, c.Disconnect.ReasonCode
+		case p.Type == packet.PUBACK:
+			ack, err := packet.ParseAck(p, version)
+			if err != nil {
+				return err
+			}
+			if ack.ReasonCode >= 0x80 {
+				f.Refusal, f.RefusalReason = RefusalAck, ack.ReasonCode
+			} else {
+				f.Accepted++
+			}
+		}
+	}
+	f.AcceptedCapped = f.Accepted == limit
+	b.logf(LevelDebug, "%v of %v back-to-back QoS 1 messages acknowledged, then %q", f.Accepted, sent, f.Refusal)
+
+	return nil
+}
+
+// unreleased publishes QoS 2 messages without sending their PUBREL, until
+// the broker refuses one, or past its Receive Maximum
+func (b *BrokerInfo) unreleased(version byte, f *FlowControlInfo) error {
+	c, err := b.NewClient(version)
+	if err != nil {
+		return err
+	}
+	defer c.abort()
+
+	limit := publishLimit(c, f)
+	topic := b.probeTopic("unreleased")
+	for f.Unreleased < limit && f.UnreleasedRefusal == "" {
+		pub := &packet.Publish{Topic: topic, QoS: 2, PacketID: c.nextPacketID(), Payload: []byte("mqttinfo unreleased")}
+		if err = c.write(pub.Encode(version)); err != nil {
+			f.UnreleasedRefusal = RefusalClose
+			break
+		}
+		ack, err := c.awaitAck(packet.PUBREC, pub.PacketID)
+		switch {
+		case c.Disconnect != nil:
+			f.UnreleasedRefusal, f.UnreleasedReason = RefusalDisconnect, c.Disconnect.ReasonCode
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			f.UnreleasedRefusal = RefusalDrop
+		case err != nil:
+			f.UnreleasedRefusal = RefusalClose
+		case ack.ReasonCode >= 0x80:
+			f.UnreleasedRefusal, f.UnreleasedReason = RefusalAck, ack.ReasonCode
+		default:
+			f.Unreleased++
+		}
+	}
+	f.UnreleasedCapped = f.Unreleased == limit
+	f.AdvertisedMatches = version == packet.V5 && f.Unreleased == min(int(f.BrokerReceiveMaximum), flowPublishCap)
+	b.logf(LevelDebug, "%v QoS 2 messages accepted without PUBREL, then %q", f.Unreleased, f.UnreleasedRefusal)
+
+	return nil
+}
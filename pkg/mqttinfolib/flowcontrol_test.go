@@ -0,0 +1,99 @@
+package mqttinfo
+
+import (
+	"testing"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/fakebroker"
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+func TestCheckFlowControl(t *testing.T) {
+	limited := fakebroker.Mosquitto()
+	limited.MaxInflight = 3
+	limited.ConnackProperties = append(limited.ConnackProperties,
+		packet.IntProperty(packet.PropReceiveMaximum, 10))
+
+	ignored := fakebroker.Mosquitto()
+	ignored.IgnoreReceiveMaximum = true
+
+	lax := limited
+	lax.LaxReceiveMaximum = true
+
+	qos1 := fakebroker.Mosquitto()
+	qos1.MaxQoS = 1
+
+	qos0 := fakebroker.Mosquitto()
+	qos0.MaxQoS = 0
+
+	dropped := qos0
+	dropped.DropAboveMaxQoS = true
+
+	tests := []struct {
+		name     string
+		behavior fakebroker.Behavior
+		version  byte
+		want     FlowControlInfo
+	}{
+		{"mosquitto", fakebroker.Mosquitto(), packet.V5, FlowControlInfo{
+			ReceiveMaximum: 5, InflightQoS1: 5, InflightQoS2: 5, Honored: true, Resumed: true, QoS2: true,
+			BrokerReceiveMaximum: 65535, Accepted: 100, AcceptedCapped: true,
+			Unreleased: 100, UnreleasedCapped: true, AdvertisedMatches: true,
+		}},
+		{"v3.1.1", fakebroker.Mosquitto(), packet.V311, FlowControlInfo{
+			InflightQoS1: 50, InflightQoS2: 50, Resumed: true, QoS2: true,
+			Accepted: 100, AcceptedCapped: true, Unreleased: 100, UnreleasedCapped: true,
+		}},
+		// QoS 1 messages are acknowledged at once, and never pile up
+		{"limited", limited, packet.V5, FlowControlInfo{
+			ReceiveMaximum: 5, InflightQoS1: 3, InflightQoS2: 3, Honored: true, Resumed: true, QoS2: true,
+			BrokerReceiveMaximum: 10, Accepted: 11, AcceptedCapped: true,
+			Unreleased: 10, UnreleasedRefusal: RefusalDisconnect, UnreleasedReason: 0x93, AdvertisedMatches: true,
+		}},
+		{"limited v3.1.1", limited, packet.V311, FlowControlInfo{
+			InflightQoS1: 3, InflightQoS2: 3, Resumed: true, QoS2: true,
+			Accepted: 100, AcceptedCapped: true, Unreleased: 10, UnreleasedRefusal: RefusalClose,
+		}},
+		{"ignored", ignored, packet.V5, FlowControlInfo{
+			ReceiveMaximum: 5, InflightQoS1: 50, InflightQoS2: 50, Resumed: true, QoS2: true,
+			BrokerReceiveMaximum: 65535, Accepted: 100, AcceptedCapped: true,
+			Unreleased: 100, UnreleasedCapped: true, AdvertisedMatches: true,
+		}},
+		{"lax", lax, packet.V5, FlowControlInfo{
+			ReceiveMaximum: 5, InflightQoS1: 3, InflightQoS2: 3, Honored: true, Resumed: true, QoS2: true,
+			BrokerReceiveMaximum: 10, Accepted: 11, AcceptedCapped: true, Unreleased: 11, UnreleasedCapped: true,
+		}},
+		{"QoS 1 only", qos1, packet.V5, FlowControlInfo{
+			ReceiveMaximum: 5, InflightQoS1: 5, Honored: true, Resumed: true,
+			BrokerReceiveMaximum: 65535, Accepted: 100, AcceptedCapped: true,
+		}},
+		{"QoS 0 only", qos0, packet.V5, FlowControlInfo{
+			ReceiveMaximum: 5, Honored: true, Resumed: true,
+			BrokerReceiveMaximum: 65535, Refusal: RefusalDisconnect, RefusalReason: 0x9b,
+		}},
+		{"QoS 0 only v3.1.1", qos0, packet.V311, FlowControlInfo{
+			Resumed: true, Refusal: RefusalClose,
+		}},
+		{"QoS 1 dropped", dropped, packet.V311, FlowControlInfo{
+			Resumed: true, Refusal: RefusalDrop,
+		}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			b := newTestBrokerInfo(t, tt.behavior)
+
+			f := &b.V5FlowControl
+			if tt.version == packet.V311 {
+				f = &b.V4FlowControl
+			}
+			if err := b.checkFlowControl(tt.version, f); err != nil {
+				t.Fatalf("checkFlowControl() error = %v", err)
+			}
+			if *f != tt.want {
+				t.Errorf("FlowControlInfo = %+v, want %+v", *f, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package mqttinfo
+
+import (
+	"bytes"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+// ForwardingInfo holds the results of the v5.0 property forwarding check
+type ForwardingInfo struct {
+	// Message with the properties delivered
+	Delivered bool
+
+	// Names of the properties missing, or not forwarded byte-for-byte,
+	// in the message delivered
+	Dropped []string
+	Altered []string
+}
+
+// forwardingProperties returns the PUBLISH properties brokers must
+// forward unaltered. The payload sent with them must be UTF-8.
+func forwardingProperties(topic string) packet.Properties {
+	return packet.Properties{
+		packet.IntProperty(packet.PropPayloadFormat, 1),
+		packet.StringProperty(packet.PropContentType, "text/plain; charset=utf-8"),
+		packet.StringProperty(packet.PropResponseTopic, topic+"/response"),
+		packet.StringProperty(packet.PropCorrelationData, "\x00\x01\xfe\xffmqttinfo"),
+		// Order must be kept, including for repeated keys
+		packet.UserProperty("mqttinfo", "1"),
+		packet.UserProperty("mqttinfo", "2"),
+		packet.UserProperty("clé", "välue ✓"),
+	}
+}
+
+// CheckForwardingV5 checks that the request/response, content and user
+// properties of a message reach subscribers unaltered
+func (b *BrokerInfo) CheckForwardingV5() error {
+
+	f := &b.V5Forwarding
+	topic := b.probeTopic("forwarding")
+	payload := []byte("mqttinfo forwarding ✓")
+	wait := b.quiet()
+
+	sub, err := b.probeClient(packet.V5)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+	if _, err = sub.subscribeWait(packet.Subscription{Filter: topic, Options: 1}, wait); err != nil {
+		return err
+	}
+
+	pub, err := b.probeClient(packet.V5)
+	if err != nil {
+		return err
+	}
+	defer pub.Close()
+
+	b.beginCheck("v5.0 property forwarding")
+	props := forwardingProperties(topic)
+	ack, err := pub.publish(&packet.Publish{Topic: topic, QoS: 1, Properties: props, Payload: payload})
+	if err != nil {
+		return err
+	}
+	if ack.ReasonCode >= 0x80 {
+		b.logf(LevelDebug, "publication with properties refused (code 0x%02x)", ack.ReasonCode)
+		return nil
+	}
+	got, err := sub.receivePayload(payload, wait)
+	if err != nil || got == nil {
+		return err
+	}
+	f.Delivered = true
+	f.Dropped, f.Altered = compareProperties(props, got.Properties)
+
+	return nil
+}
+
+// compareProperties returns the names of the sent properties missing from
+// those received, and of those received with other values or in another
+// order
+func compareProperties(sent, received packet.Properties) (dropped, altered []string) {
+	var ids []byte
+	for _, p := range sent {
+		if len(ids) == 0 || ids[len(ids)-1] != p.ID {
+			ids = append(ids, p.ID)
+		}
+	}
+	for _, id := range ids {
+		want, got := withID(sent, id), withID(received, id)
+		switch {
+		case len(got) == 0:
+			dropped = append(dropped, packet.PropertyName(id))
+		case !equalProperties(want, got):
+			altered = append(altered, packet.PropertyName(id))
+		}
+	}
+	return dropped, altered
+}
+
+// withID returns the properties with identifier id, in order
+func withID(props packet.Properties, id byte) packet.Properties {
+	var found packet.Properties
+	for _, p := range props {
+		if p.ID == id {
+			found = append(found, p)
+		}
+	}
+	return found
+}
+
+func equalProperties(a, b packet.Properties) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].ID != b[i].ID || a[i].Value != b[i].Value || a[i].Key != b[i].Key ||
+			!bytes.Equal(a[i].Data, b[i].Data) {
+			return false
+		}
+	}
+	return true
+}
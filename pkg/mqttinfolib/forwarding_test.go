@@ -0,0 +1,70 @@
+package mqttinfo
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/fakebroker"
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+func TestCheckForwarding(t *testing.T) {
+	stripping := fakebroker.Mosquitto()
+	stripping.StripProperties = []byte{packet.PropUserProperty, packet.PropCorrelationData}
+
+	tests := []struct {
+		name     string
+		behavior fakebroker.Behavior
+		want     ForwardingInfo
+	}{
+		{"mosquitto", fakebroker.Mosquitto(), ForwardingInfo{Delivered: true}},
+		{"properties stripped", stripping, ForwardingInfo{
+			Delivered: true,
+			Dropped:   []string{"Correlation Data", "User Property"},
+		}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			b := newTestBrokerInfo(t, tt.behavior)
+
+			if err := b.CheckForwardingV5(); err != nil {
+				t.Fatalf("CheckForwardingV5() error = %v", err)
+			}
+			if !reflect.DeepEqual(b.V5Forwarding, tt.want) {
+				t.Errorf("V5Forwarding = %+v, want %+v", b.V5Forwarding, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompareProperties(t *testing.T) {
+	sent := forwardingProperties("t")
+	reordered := append(packet.Properties(nil), sent[:4]...)
+	reordered = append(reordered, sent[5], sent[4], sent[6])
+	changed := append(packet.Properties(nil), sent...)
+	changed[1] = packet.StringProperty(packet.PropContentType, "text/plain")
+
+	tests := []struct {
+		name             string
+		received         packet.Properties
+		dropped, altered []string
+	}{
+		{"unaltered", sent, nil, nil},
+		{"none", nil, []string{
+			"Payload Format Indicator", "Content Type", "Response Topic", "Correlation Data", "User Property",
+		}, nil},
+		{"user properties reordered", reordered, nil, []string{"User Property"}},
+		{"content type changed", changed, nil, []string{"Content Type"}},
+		{"user properties dropped", sent[:4], []string{"User Property"}, nil},
+	}
+
+	for _, tt := range tests {
+		dropped, altered := compareProperties(sent, tt.received)
+		if !reflect.DeepEqual(dropped, tt.dropped) || !reflect.DeepEqual(altered, tt.altered) {
+			t.Errorf("%v: compareProperties() = %q, %q, want %q, %q", tt.name, dropped, altered, tt.dropped, tt.altered)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package mqttinfo
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+// KeepAliveInfo holds the results of the keep-alive checks
+type KeepAliveInfo struct {
+	// Keep-alive requested, and the v5.0 Server Keep Alive replacing it,
+	// 0 if none, in seconds, and whether the Server Keep Alive was 0,
+	// disabling the keep-alive
+	KeepAlive       uint16
+	ServerKeepAlive uint16
+	ServerDisabled  bool
+
+	// Silent connection closed, how long after CONNACK, the reason code
+	// of the DISCONNECT if any, and whether between one and one and a
+	// half keep-alive, as MQTT requires, or left open if ServerDisabled
+	Enforced    bool
+	ClosedAfter time.Duration
+	Reason      byte
+	WithinSpec  bool
+
+	// Keep-alive 0, which disables it, accepted, the v5.0 Server Keep
+	// Alive replacing it, and silent connection left open
+	ZeroAccepted        bool
+	ZeroServerKeepAlive uint16
+	ZeroKeptOpen        bool
+}
+
+// defaultProbeKeepAlive is the keep-alive of the checks if ProbeKeepAlive
+// is zero, in seconds
+const defaultProbeKeepAlive = 5
+
+// keepAliveSlack is the delay accepted past one and a half keep-alive,
+// for brokers checking keep-alives periodically, in seconds
+const keepAliveSlack = 1
+
+// maxKeepAliveWait bounds the silence of the checks, whatever the Server
+// Keep Alive
+const maxKeepAliveWait = 2 * time.Minute
+
+// keepAliveWait returns how long to stay silent for a keep-alive, long
+// enough to see lax brokers close the connection
+func (b *BrokerInfo) keepAliveWait(keepAlive time.Duration) time.Duration {
+	return min(3*keepAlive+b.seconds(keepAliveSlack), maxKeepAliveWait)
+}
+
+func (b *BrokerInfo) probeKeepAlive() uint16 {
+	if b.ProbeKeepAlive > 0 {
+		return b.ProbeKeepAlive
+	}
+	return defaultProbeKeepAlive
+}
+
+// silence waits without sending anything until the broker closes the
+// connection or the wait is over. It returns whether the connection was
+// closed, when, and the reason code of the DISCONNECT, if any.
+func (c *Client) silence(wait time.Duration) (bool, time.Duration, byte, error) {
+	start := time.Now()
+	for {
+		left := wait - time.Since(start)
+		if left <= 0 {
+			return false, 0, 0, nil
+		}
+		p, err := c.read(left)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return false, 0, 0, nil
+		}
+		if err != nil {
+			return true, time.Since(start), 0, nil
+		}
+		if p.Type == packet.DISCONNECT {
+			dis, err := packet.ParseDisconnect(p, c.version)
+			if err != nil {
+				return false, 0, 0, err
+			}
+			return true, time.Since(start), dis.ReasonCode, nil
+		}
+	}
+}
+
+// CheckKeepAliveV3 checks the keep-alive enforcement of v3.1
+func (b *BrokerInfo) CheckKeepAliveV3() error {
+	return b.checkKeepAlive(packet.V31, &b.V3KeepAlive)
+}
+
+// CheckKeepAliveV4 checks the keep-alive enforcement of v3.1.1
+func (b *BrokerInfo) CheckKeepAliveV4() error {
+	return b.checkKeepAlive(packet.V311, &b.V4KeepAlive)
+}
+
+// CheckKeepAliveV5 checks the keep-alive enforcement of v5.0, and the
+// Server Keep Alive
+func (b *BrokerInfo) CheckKeepAliveV5() error {
+	return b.checkKeepAlive(packet.V5, &b.V5KeepAlive)
+}
+
+// checkKeepAlive goes silent on a connection with a short keep-alive, and
+// on one without keep-alive, and waits for the broker to close them
+func (b *BrokerInfo) checkKeepAlive(version byte, k *KeepAliveInfo) error {
+
+	name := versionName(version)
+	*k = KeepAliveInfo{KeepAlive: b.probeKeepAlive()}
+
+	b.beginCheck(name + " keep-alive 0")
+	connect := b.connectPacket(version)
+	connect.KeepAlive = 0
+	zero, _, err := b.tryConnect(connect)
+	if err != nil {
+		return err
+	}
+	if zero != nil {
+		defer zero.abort()
+		k.ZeroAccepted = true
+		if server, ok := zero.Connack.Properties.Int(packet.PropServerKeepAlive); ok {
+			k.ZeroServerKeepAlive = uint16(server)
+		}
+	}
+
+	b.beginCheck(name + " keep-alive")
+	connect = b.connectPacket(version)
+	connect.KeepAlive = k.KeepAlive
+	c, err := b.newClient(connect)
+	if err != nil {
+		return err
+	}
+	defer c.abort()
+
+	// The wait follows the keep-alive in effect, replaced by the Server
+	// Keep Alive if any. A Server Keep Alive of 0 disables it, so the
+	// connection is then checked like the keep-alive 0 one, over the wait
+	// of the keep-alive requested.
+	keepAlive := b.seconds(uint32(k.KeepAlive))
+	if server, ok := c.Connack.Properties.Int(packet.PropServerKeepAlive); ok {
+		k.ServerKeepAlive = uint16(server)
+		k.ServerDisabled = server == 0
+		if !k.ServerDisabled {
+			keepAlive = b.seconds(server)
+		}
+	}
+	wait := b.keepAliveWait(keepAlive)
+
+	// Both connections are silent at the same time, halving the wait
+	zeroClosed := make(chan bool, 1)
+	if zero != nil {
+		zeroWait := wait
+		if k.ZeroServerKeepAlive > 0 {
+			zeroWait = b.keepAliveWait(b.seconds(uint32(k.ZeroServerKeepAlive)))
+		}
+		go func() {
+			closed, _, _, _ := zero.silence(zeroWait)
+			zeroClosed <- closed
+		}()
+	}
+	b.logf(LevelDebug, "silent for up to %v", wait)
+	k.Enforced, k.ClosedAfter, k.Reason, err = c.silence(wait)
+	if err != nil {
+		return err
+	}
+	if k.ServerDisabled {
+		k.WithinSpec = !k.Enforced
+	} else {
+		k.WithinSpec = k.Enforced && k.ClosedAfter >= keepAlive && k.ClosedAfter <= keepAlive*3/2+b.seconds(keepAliveSlack)
+	}
+	b.logf(LevelDebug, "closed %v after %v", k.Enforced, k.ClosedAfter)
+
+	if zero != nil {
+		k.ZeroKeptOpen = !<-zeroClosed
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package mqttinfo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/fakebroker"
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+func TestCheckKeepAlive(t *testing.T) {
+	ignored := fakebroker.Mosquitto()
+	ignored.IgnoreKeepAlive = true
+
+	lax := fakebroker.Mosquitto()
+	lax.KeepAliveFactor = 3
+
+	early := fakebroker.Mosquitto()
+	early.KeepAliveFactor = 0.5
+
+	server := fakebroker.Mosquitto()
+	server.ServerKeepAlive = 2
+
+	longer := fakebroker.Mosquitto()
+	longer.ServerKeepAlive = 4
+
+	disabled := fakebroker.Mosquitto()
+	disabled.ConnackProperties = packet.Properties{packet.IntProperty(packet.PropServerKeepAlive, 0)}
+	disabled.IgnoreKeepAlive = true
+
+	disabledEnforced := fakebroker.Mosquitto()
+	disabledEnforced.ConnackProperties = disabled.ConnackProperties
+
+	tests := []struct {
+		name     string
+		behavior fakebroker.Behavior
+		version  byte
+		want     KeepAliveInfo
+		closed   time.Duration
+	}{
+		{"mosquitto", fakebroker.Mosquitto(), packet.V5, KeepAliveInfo{
+			KeepAlive: 1, Enforced: true, Reason: 0x8d, WithinSpec: true,
+			ZeroAccepted: true, ZeroKeptOpen: true,
+		}, 15 * testSecond / 10},
+		{"v3.1.1", fakebroker.Mosquitto(), packet.V311, KeepAliveInfo{
+			KeepAlive: 1, Enforced: true, WithinSpec: true,
+			ZeroAccepted: true, ZeroKeptOpen: true,
+		}, 15 * testSecond / 10},
+		{"ignored", ignored, packet.V5, KeepAliveInfo{
+			KeepAlive: 1, ZeroAccepted: true, ZeroKeptOpen: true,
+		}, 0},
+		{"lax", lax, packet.V5, KeepAliveInfo{
+			KeepAlive: 1, Enforced: true, Reason: 0x8d,
+			ZeroAccepted: true, ZeroKeptOpen: true,
+		}, 3 * testSecond},
+		{"early", early, packet.V311, KeepAliveInfo{
+			KeepAlive: 1, Enforced: true,
+			ZeroAccepted: true, ZeroKeptOpen: true,
+		}, 5 * testSecond / 10},
+		{"server keep alive", server, packet.V5, KeepAliveInfo{
+			KeepAlive: 1, ServerKeepAlive: 2, Enforced: true, Reason: 0x8d, WithinSpec: true,
+			ZeroAccepted: true, ZeroServerKeepAlive: 2,
+		}, 3 * testSecond},
+		{"longer server keep alive", longer, packet.V5, KeepAliveInfo{
+			KeepAlive: 1, ServerKeepAlive: 4, Enforced: true, Reason: 0x8d, WithinSpec: true,
+			ZeroAccepted: true, ZeroServerKeepAlive: 4,
+		}, 6 * testSecond},
+		{"server keep alive 0", disabled, packet.V5, KeepAliveInfo{
+			KeepAlive: 1, ServerDisabled: true, WithinSpec: true,
+			ZeroAccepted: true, ZeroKeptOpen: true,
+		}, 0},
+		{"server keep alive 0 enforced", disabledEnforced, packet.V5, KeepAliveInfo{
+			KeepAlive: 1, ServerDisabled: true, Enforced: true, Reason: 0x8d,
+			ZeroAccepted: true, ZeroKeptOpen: true,
+		}, 15 * testSecond / 10},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			b := newTestBrokerInfo(t, tt.behavior)
+
+			k := &b.V5KeepAlive
+			if tt.version == packet.V311 {
+				k = &b.V4KeepAlive
+			}
+			if err := b.checkKeepAlive(tt.version, k); err != nil {
+				t.Fatalf("checkKeepAlive() error = %v", err)
+			}
+			if k.ClosedAfter < tt.closed || k.ClosedAfter > tt.closed+testSecond/2 {
+				t.Errorf("ClosedAfter = %v, want %v", k.ClosedAfter, tt.closed)
+			}
+			got := *k
+			got.ClosedAfter = 0
+			if got != tt.want {
+				t.Errorf("KeepAliveInfo = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
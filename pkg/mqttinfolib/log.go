@@ -0,0 +1,201 @@
+package mqttinfo
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+// Level is the severity of a log message
+type Level int
+
+// Log levels, from the least to the most verbose. LevelTrace logs every
+// packet exchanged with the broker, with CONNECT passwords masked.
+const (
+	LevelError Level = iota
+	LevelWarn
+	LevelInfo
+	LevelDebug
+	LevelTrace
+)
+
+var levelNames = []string{"error", "warn", "info", "debug", "trace"}
+
+func (l Level) String() string {
+	if l >= 0 && int(l) < len(levelNames) {
+		return levelNames[l]
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// ParseLevel returns the level with the given name
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+// Logger receives the log messages of a BrokerInfo
+type Logger interface {
+	// Enabled returns whether messages of the given level are logged
+	Enabled(level Level) bool
+	Log(level Level, msg string)
+}
+
+// NewLogger returns a Logger writing the messages up to the given level
+// to w, one timestamped line per message
+func NewLogger(w io.Writer, max Level) Logger {
+	return &writerLogger{w: w, max: max}
+}
+
+type writerLogger struct {
+	mu  sync.Mutex
+	w   io.Writer
+	max Level
+}
+
+func (l *writerLogger) Enabled(level Level) bool {
+	return level <= l.max
+}
+
+func (l *writerLogger) Log(level Level, msg string) {
+	if !l.Enabled(level) {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(l.w, "%v %-5v %v\n", time.Now().Format("15:04:05.000"), level, msg)
+}
+
+func (b *BrokerInfo) logEnabled(level Level) bool {
+	return b.Logger != nil && b.Logger.Enabled(level)
+}
+
+func (b *BrokerInfo) logf(level Level, format string, args ...interface{}) {
+	if !b.logEnabled(level) {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	b.mu.Lock()
+	check := b.check
+	b.mu.Unlock()
+	if check != "" {
+		msg = "[" + check + "] " + msg
+	}
+	b.Logger.Log(level, msg)
+}
+
+// beginCheck names the check that the next packets belong to
+func (b *BrokerInfo) beginCheck(name string) {
+	b.mu.Lock()
+	b.check = name
+	b.mu.Unlock()
+	b.logf(LevelInfo, "check started")
+}
+
+// traceConn logs the packets exchanged on a connection
+type traceConn struct {
+	net.Conn
+	b       *BrokerInfo
+	id      int
+	version byte
+
+	mu             sync.Mutex
+	sent, received []byte
+}
+
+func (b *BrokerInfo) traceConn(conn net.Conn) net.Conn {
+	b.mu.Lock()
+	b.conns++
+	id := b.conns
+	b.mu.Unlock()
+	b.logf(LevelDebug, "conn %v: connected to %v", id, conn.RemoteAddr())
+	if !b.logEnabled(LevelTrace) {
+		return conn
+	}
+	return &traceConn{Conn: conn, b: b, id: id, version: packet.V311}
+}
+
+// trace logs the packets completed by data
+func (c *traceConn) trace(buf *[]byte, data []byte, dir string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	*buf = append(*buf, data...)
+	for {
+		p, n := packet.Parse(*buf)
+		if n == 0 {
+			return
+		}
+		if p.Type == packet.CONNECT {
+			if connect, err := packet.ParseConnect(p); err == nil {
+				c.version = connect.Level
+			}
+		}
+		c.b.logf(LevelTrace, "conn %v %v %v\n%v", c.id, dir, packet.Describe(p, c.version), dump(p, (*buf)[:n]))
+		*buf = (*buf)[n:]
+	}
+}
+
+// dump returns the hex dump of a packet, with the password of a CONNECT
+// masked. AUTH packets carry authentication exchanges, and aren't dumped.
+func dump(p *packet.Packet, raw []byte) string {
+	if p.Type == packet.AUTH {
+		return "(authentication data not dumped)"
+	}
+	return strings.TrimRight(hex.Dump(masked(p, raw)), "\n")
+}
+
+// masked returns the bytes of a packet with the password of a CONNECT
+// replaced by asterisks
+func masked(p *packet.Packet, raw []byte) []byte {
+	if p.Type != packet.CONNECT {
+		return raw
+	}
+	connect, err := packet.ParseConnect(p)
+	if err != nil || !connect.HasPassword {
+		return raw
+	}
+	// The password is the last field of CONNECT
+	out := append([]byte(nil), raw...)
+	for i := len(out) - len(connect.Password); i < len(out); i++ {
+		out[i] = '*'
+	}
+	return out
+}
+
+func (c *traceConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.trace(&c.received, b[:n], "<")
+	}
+	if err != nil {
+		c.b.logf(LevelTrace, "conn %v: read failed: %v", c.id, err)
+	}
+	return n, err
+}
+
+func (c *traceConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.trace(&c.sent, b[:n], ">")
+	}
+	if err != nil {
+		c.b.logf(LevelTrace, "conn %v: write failed: %v", c.id, err)
+	}
+	return n, err
+}
+
+func (c *traceConn) Close() error {
+	c.b.logf(LevelTrace, "conn %v: closed", c.id)
+	return c.Conn.Close()
+}
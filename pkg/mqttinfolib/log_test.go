@@ -0,0 +1,117 @@
+package mqttinfo
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	b := &BrokerInfo{Logger: NewLogger(&buf, LevelInfo)}
+
+	b.beginCheck("v3.1.1 test")
+	b.logf(LevelDebug, "hidden")
+	b.logf(LevelWarn, "shown %v", 1)
+
+	out := buf.String()
+	if strings.Contains(out, "hidden") {
+		t.Errorf("debug message logged at info level:\n%v", out)
+	}
+	for _, want := range []string{"info  [v3.1.1 test] check started", "warn  [v3.1.1 test] shown 1"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log missing %q:\n%v", want, out)
+		}
+	}
+	if b.logEnabled(LevelDebug) {
+		t.Error("logEnabled(LevelDebug) = true at info level")
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for i, name := range levelNames {
+		level, err := ParseLevel(strings.ToUpper(name))
+		if err != nil || level != Level(i) {
+			t.Errorf("ParseLevel(%q) = %v, %v", name, level, err)
+		}
+		if level.String() != name {
+			t.Errorf("Level(%d).String() = %q, want %q", i, level.String(), name)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("ParseLevel(verbose) succeeded")
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	connect := &packet.Connect{
+		ProtocolName: "MQTT", Level: packet.V311, CleanStart: true, KeepAlive: 60, ClientID: "id",
+		HasUsername: true, Username: "user", HasPassword: true, Password: []byte("s3cr3t"),
+	}
+	pub := &packet.Publish{Topic: "a/b", QoS: 1, PacketID: 7, Payload: []byte("hi")}
+
+	tests := []struct {
+		name string
+		raw  []byte
+		want string
+	}{
+		{"connect", connect.Encode(),
+			`CONNECT protocol="MQTT" level=4 flags=0xc2 keepalive=60 client="id" user="user" password=<hidden>`},
+		{"publish", pub.Encode(packet.V311),
+			`PUBLISH dup=false qos=1 retain=false topic="a/b" id=7 payload="hi"`},
+	}
+
+	for _, tt := range tests {
+		p, n := packet.Parse(tt.raw)
+		if n != len(tt.raw) {
+			t.Fatalf("%v: Parse() = %v bytes, want %v", tt.name, n, len(tt.raw))
+		}
+		if got := packet.Describe(p, packet.V311); got != tt.want {
+			t.Errorf("%v: Describe() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTraceMasksPassword(t *testing.T) {
+	password := []byte("s3cr3t")
+	connect := &packet.Connect{
+		ProtocolName: "MQTT", Level: packet.V311, CleanStart: true, ClientID: "id",
+		HasUsername: true, Username: "user", HasPassword: true, Password: password,
+	}
+	raw := connect.Encode()
+
+	var buf bytes.Buffer
+	b := &BrokerInfo{Logger: NewLogger(&buf, LevelTrace)}
+	c := &traceConn{b: b, id: 1, version: packet.V311}
+	c.trace(&c.sent, raw, ">")
+
+	p, _ := packet.Parse(raw)
+	m := masked(p, raw)
+	if bytes.Contains(m, password) {
+		t.Errorf("masked CONNECT holds the password: % x", m)
+	}
+	if !bytes.Equal(m[:len(m)-len(password)], raw[:len(raw)-len(password)]) {
+		t.Errorf("masked CONNECT = % x, want only the password changed in % x", m, raw)
+	}
+	if bytes.Contains(raw, []byte("******")) {
+		t.Error("masked() changed the packet in place")
+	}
+
+	out := buf.String()
+	if !strings.Contains(out, dump(p, raw)) {
+		t.Errorf("trace doesn't hold the masked dump:\n%v", out)
+	}
+	if strings.Contains(out, string(password)) {
+		t.Errorf("trace holds the password:\n%v", out)
+	}
+
+	auth := &packet.Disconnect{Type: packet.AUTH, ReasonCode: 0x18, Properties: packet.Properties{
+		packet.StringProperty(packet.PropAuthMethod, "SCRAM-SHA-256"),
+	}}
+	p, _ = packet.Parse(auth.Encode(packet.V5))
+	if got := dump(p, auth.Encode(packet.V5)); strings.Contains(got, "SCRAM") {
+		t.Errorf("AUTH dumped: %v", got)
+	}
+}
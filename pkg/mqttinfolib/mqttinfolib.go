@@ -1,26 +1,46 @@
 package mqttinfo
 
 import (
+	"crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"net"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
 )
 
 // Broker ...
 type Broker string
 
+// Dialer opens a connection, net.DialTimeout is a Dialer
+type Dialer func(network, address string, timeout time.Duration) (net.Conn, error)
+
 // BrokerInfo includes the information collected
 type BrokerInfo struct {
 	Host     string
 	Port     int
 	Username string
-	Password string
+	Password string `json:"-"`
 
+	V3 bool
 	V4 bool
 	V5 bool
 
+	V3Anonymous        bool
+	V3PublishSYS       bool
+	V3FilterSYS        bool
+	V3SubscribeAll     bool
+	V3InvalidTopics    bool
+	V3InvalidUTF8Topic bool
+	V3QoS1             bool
+	V3QoS2             bool
+	V3QoS3Response     bool
+
 	V4Anonymous        bool
 	V4PublishSYS       bool
 	V4FilterSYS        bool
@@ -41,16 +61,131 @@ type BrokerInfo struct {
 	V5QoS2             bool
 	V5QoS3Response     bool
 
+	V3Retain RetainInfo
+	V4Retain RetainInfo
+	V5Retain RetainInfo
+
+	V3Will WillInfo
+	V4Will WillInfo
+	V5Will WillInfo
+
+	V3Session SessionInfo
+	V4Session SessionInfo
+	V5Session SessionInfo
+
+	V3Shared SharedInfo
+	V4Shared SharedInfo
+	V5Shared SharedInfo
+
+	V5TopicAlias TopicAliasInfo
+
+	V5Expiry ExpiryInfo
+
+	V5Forwarding ForwardingInfo
+
+	V5SubOptions SubOptionsInfo
+
+	V5Auth AuthInfo
+
+	V3PacketSize PacketSizeInfo
+	V4PacketSize PacketSizeInfo
+	V5PacketSize PacketSizeInfo
+
+	V3TopicLimits TopicLimitsInfo
+	V4TopicLimits TopicLimitsInfo
+	V5TopicLimits TopicLimitsInfo
+
+	V3ClientID ClientIDInfo
+	V4ClientID ClientIDInfo
+	V5ClientID ClientIDInfo
+
+	V3KeepAlive KeepAliveInfo
+	V4KeepAlive KeepAliveInfo
+	V5KeepAlive KeepAliveInfo
+
+	V3FlowControl FlowControlInfo
+	V4FlowControl FlowControlInfo
+	V5FlowControl FlowControlInfo
+
+	V3QoSDelivery QoSDeliveryInfo
+	V4QoSDelivery QoSDeliveryInfo
+	V5QoSDelivery QoSDeliveryInfo
+
+	V3QoS2Flows QoS2Info
+	V4QoS2Flows QoS2Info
+	V5QoS2Flows QoS2Info
+
+	V3Unsubscribe UnsubscribeInfo
+	V4Unsubscribe UnsubscribeInfo
+	V5Unsubscribe UnsubscribeInfo
+
 	TypeGuessed Broker
 
 	// So that JSON line reports errors
 	Failed bool
 	Error  string
+
+	// StepErrors are the errors of the Scan steps that failed, by
+	// protocol version and step name, such as "v5.0 retained messages"
+	StepErrors map[string]string
+
+	// Retained messages that Cleanup couldn't clear
+	CleanupFailed []string
+
+	// Dialer opens the connections to the broker, net.DialTimeout
+	// if nil. Tests use it to connect to an in-process broker.
+	Dialer Dialer `json:"-"`
+
+	// Timeout bounds the wait for the broker's responses on each
+	// connection, 20 seconds if zero
+	Timeout time.Duration `json:"-"`
+
+	// Logger receives the progress of the checks and, at LevelTrace,
+	// the packets exchanged
+	Logger Logger `json:"-"`
+
+	// BeforeStep and AfterStep, if set, are called around each step of
+	// Scan, AfterStep with the error of the step
+	BeforeStep func(s ScanStep)            `json:"-"`
+	AfterStep  func(s ScanStep, err error) `json:"-"`
+
+	// Authenticators are enhanced authentication methods tried by
+	// CheckAuthV5, besides SCRAM with Username and Password
+	Authenticators []Authenticator `json:"-"`
+
+	// PacketSizeCap is the largest PUBLISH tried by the packet size
+	// checks, in bytes, 1 MiB if zero
+	PacketSizeCap int `json:"-"`
+
+	// ProbeKeepAlive is the keep-alive of the keep-alive checks, in
+	// seconds, 5 if zero
+	ProbeKeepAlive uint16 `json:"-"`
+
+	// second is how long the seconds of keep-alives, expiry intervals
+	// and will delays last, time.Second if zero. Tests shorten it along
+	// with the fake broker's.
+	second time.Duration
+
+	// RunID is the random part of the probe topics and client IDs,
+	// drawn when first needed if empty. Replays must use the RunID of
+	// the recording.
+	RunID string `json:"-"`
+
+	// SCRAMNonces are the client nonces of the SCRAM methods, random if
+	// missing. Replays must use the nonces of the recording.
+	SCRAMNonces map[string]string `json:"-"`
+
+	// current check and number of connections, for logs, number of
+	// clients created, and retained messages to clear with the protocol
+	// level used. Cleanup may run on another goroutine.
+	mu       sync.Mutex
+	check    string
+	conns    int
+	clients  int
+	retained map[retainedMessage]bool
 }
 
 const (
-	connectV4          = "\x10\x14\x00\x04\x4d\x51\x54\x54\x04\x02\x00\x3c\x00\x08\x6d\x71\x74\x74\x69\x6e\x66\x6f"
-	connectV5          = "\x10\x15\x00\x04\x4d\x51\x54\x54\x05\x02\x00\x3c\x00\x00\x08\x6d\x71\x74\x74\x69\x6e\x66\x6f"
 	pingreq            = "\xc0\x00"
 	pingresp           = "\xd0\x00"
 	publishV4Q0        = "\x32\x04\x00\x01\x41\x42"
@@ -92,6 +227,10 @@ const (
 	subSysMosqV5Q0     = "\x82\x21\x00\x01\x00\x00\x1b\x24\x53\x59\x53\x2f\x2b\x2f\x6c\x6f\x61\x64\x2f\x6d\x65\x73\x73\x61\x67\x65\x73\x2f\x73\x65\x6e\x74\x2f\x2b\x00"
 )
 
+// sysProbeTopic is the $SYS topic published by the pubSys packets, and
+// retained on brokers that accept them
+const sysProbeTopic = "$SYS/mqttinfo"
+
 // NewBrokerInfo creates a BrokerInfo with default values
 func NewBrokerInfo(hostname string, port int, username, password string) (*BrokerInfo, error) {
 	b := BrokerInfo{}
@@ -100,9 +239,11 @@ func NewBrokerInfo(hostname string, port int, username, password string) (*Broke
 	b.Username = username
 	b.Password = password
 
+	b.V3 = false
 	b.V4 = false
 	b.V5 = false
 
+	b.V3FilterSYS = true
 	b.V4FilterSYS = true
 	b.V5FilterSYS = true
 	b.TypeGuessed = "unknown"
@@ -114,108 +255,157 @@ func NewBrokerInfo(hostname string, port int, username, password string) (*Broke
 	return &b, nil
 }
 
-// varint encoding, this function copied from https://github.com/eclipse/paho.mqtt.golang
-func encodeLength(length int) []byte {
-	var encLength []byte
-	for {
-		digit := byte(length % 128)
-		length /= 128
-		if length > 0 {
-			digit |= 0x80
-		}
-		encLength = append(encLength, digit)
-		if length == 0 {
-			break
-		}
+// newConnect returns a clean session CONNECT with our credentials
+func (b *BrokerInfo) newConnect(version byte, clientID string) *packet.Connect {
+	c := &packet.Connect{
+		ProtocolName: packet.ProtocolName(version),
+		Level:        version,
+		CleanStart:   true,
+		KeepAlive:    clientKeepAlive,
+		ClientID:     clientID,
 	}
-	return encLength
+	if b.Username != "" {
+		c.HasUsername = true
+		c.Username = b.Username
+		c.HasPassword = true
+		c.Password = []byte(b.Password)
+	}
+	return c
 }
 
-func (b *BrokerInfo) getConnectV4() []byte {
+// clientID returns the client ID of the analysis connections, random so
+// that concurrent scans of a broker don't disconnect each other. It
+// stays within the 23 alphanumeric bytes that all brokers must accept,
+// with a short suffix.
+func (b *BrokerInfo) clientID() string {
+	return clientIDPrefix + b.run()
+}
 
-	if b.Username == "" {
-		return []byte(connectV4)
+// clientIDPrefix starts the client IDs, before the run ID
+const clientIDPrefix = "mqttinfo"
+
+// versionName returns the name of a protocol level, for logs
+func versionName(version byte) string {
+	switch version {
+	case packet.V5:
+		return "v5.0"
+	case packet.V311:
+		return "v3.1.1"
+	case packet.V31:
+		return "v3.1"
 	}
+	return fmt.Sprintf("level %v", version)
+}
 
-	// Length were checked in main()
-	usernameLen := uint16(len(b.Username))
-	pwdLen := uint16(len(b.Password))
-
-	remainingLen := 24 + int(usernameLen+pwdLen)
-
-	remainingLenBytes := encodeLength(remainingLen)
-
-	packet := make([]byte, 1)
-	packet[0] = 0x10
+// probeTopic returns a topic specific to this run, so that concurrent
+// runs don't see each other's messages
+func (b *BrokerInfo) probeTopic(name string) string {
+	return "mqttinfo/" + b.run() + "/" + name
+}
 
-	usernameLenBytes := make([]byte, 2)
-	pwdLenBytes := make([]byte, 2)
+// runIDLength is the length of the run IDs drawn
+const runIDLength = 8
+
+// run returns RunID, drawn at the first call if empty
+func (b *BrokerInfo) run() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.RunID == "" {
+		id := make([]byte, runIDLength/2)
+		if _, err := rand.Read(id); err != nil {
+			binary.BigEndian.PutUint32(id, uint32(time.Now().UnixNano()))
+		}
+		b.RunID = hex.EncodeToString(id)
+	}
+	return b.RunID
+}
 
-	binary.BigEndian.PutUint16(usernameLenBytes, usernameLen)
-	binary.BigEndian.PutUint16(pwdLenBytes, pwdLen)
+// quiet is how long we wait for a message before concluding that it
+// won't come
+func (b *BrokerInfo) quiet() time.Duration {
+	return b.timeout() / 10
+}
 
-	packet = append(packet, remainingLenBytes...)
-	packet = append(packet, []byte("\x00\x04MQTT\x04\xc2\x00\x3c\x00\x08mqttinfo")...)
-	packet = append(packet, usernameLenBytes...)
-	packet = append(packet, []byte(b.Username)...)
-	packet = append(packet, pwdLenBytes...)
-	packet = append(packet, []byte(b.Password)...)
+// anonymousConnect returns a CONNECT without credentials, which the
+// connection checks send to learn if they are needed
+func (b *BrokerInfo) anonymousConnect(version byte) []byte {
+	c := b.newConnect(version, b.clientID())
+	c.HasUsername, c.Username = false, ""
+	c.HasPassword, c.Password = false, nil
+	return c.Encode()
+}
 
-	return packet
+// getConnect returns the CONNECT of the analysis connections, with a
+// will message if will isn't nil
+func (b *BrokerInfo) getConnect(version byte, will *packet.Will) []byte {
+	c := b.newConnect(version, b.clientID())
+	c.Will = will
+	return c.Encode()
 }
 
-// getConnectV5 ... TODO
 func (b *BrokerInfo) getConnectV5() []byte {
+	return b.getConnect(packet.V5, nil)
+}
 
-	if b.Username == "" {
-		return []byte(connectV5)
-	}
-
-	// Length were checked in main()
-	usernameLen := uint16(len(b.Username))
-	pwdLen := uint16(len(b.Password))
+func (b *BrokerInfo) getServer() string {
+	return fmt.Sprintf("%v:%v", b.Host, b.Port)
+}
 
-	remainingLen := 25 + int(usernameLen+pwdLen)
+func (b *BrokerInfo) timeout() time.Duration {
+	if b.Timeout > 0 {
+		return b.Timeout
+	}
+	return 20 * time.Second
+}
 
-	remainingLenBytes := encodeLength(remainingLen)
+// seconds returns the duration of n seconds of the protocol
+func (b *BrokerInfo) seconds(n uint32) time.Duration {
+	if b.second == 0 {
+		return time.Duration(n) * time.Second
+	}
+	return time.Duration(n) * b.second
+}
 
-	packet := make([]byte, 1)
-	packet[0] = 0x10
+// opens a TCP connection to the broker, with the read deadline set
+func (b *BrokerInfo) dial() (net.Conn, error) {
 
-	usernameLenBytes := make([]byte, 2)
-	pwdLenBytes := make([]byte, 2)
+	dial := b.Dialer
+	if dial == nil {
+		dial = net.DialTimeout
+	}
 
-	binary.BigEndian.PutUint16(usernameLenBytes, usernameLen)
-	binary.BigEndian.PutUint16(pwdLenBytes, pwdLen)
+	conn, err := dial("tcp", b.getServer(), 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
 
-	packet = append(packet, remainingLenBytes...)
-	packet = append(packet, []byte("\x00\x04MQTT\x05\xc2\x00\x3c\x00\x08mqttinfo")...)
-	packet = append(packet, usernameLenBytes...)
-	packet = append(packet, []byte(b.Username)...)
-	packet = append(packet, pwdLenBytes...)
-	packet = append(packet, []byte(b.Password)...)
+	err = conn.SetReadDeadline(time.Now().Add(b.timeout()))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
 
-	return packet
-}
+	if b.Logger != nil {
+		conn = b.traceConn(conn)
+	}
 
-func (b *BrokerInfo) getServer() string {
-	return fmt.Sprintf("%v:%v", b.Host, b.Port)
+	return conn, nil
 }
 
 // connects to the broker, either anonymously or with creds
 func (b *BrokerInfo) connectV4() (net.Conn, error) {
+	return b.connectV3x(packet.V311)
+}
 
-	conn, err := net.DialTimeout("tcp", b.getServer(), 10*time.Second)
-	if err != nil {
-		return nil, fmt.Errorf("TCP connection failed: %v", err)
-	}
+// connects to the broker with v3.1 or v3.1.1
+func (b *BrokerInfo) connectV3x(version byte) (net.Conn, error) {
 
-	err = conn.SetReadDeadline(time.Now().Add(20 * time.Second))
+	conn, err := b.dial()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("TCP connection failed: %v", err)
 	}
 
-	conn.Write(b.getConnectV4())
+	conn.Write(b.getConnect(version, nil))
 	connack := make([]byte, 100)
 	_, err = conn.Read(connack)
 	if err != nil {
@@ -232,16 +422,11 @@ func (b *BrokerInfo) connectV4() (net.Conn, error) {
 // connects to the broker, either anonymously or with creds
 func (b *BrokerInfo) connectV5() (net.Conn, error) {
 
-	conn, err := net.DialTimeout("tcp", b.getServer(), 10*time.Second)
+	conn, err := b.dial()
 	if err != nil {
 		return nil, fmt.Errorf("TCP connection failed: %v", err)
 	}
 
-	err = conn.SetReadDeadline(time.Now().Add(20 * time.Second))
-	if err != nil {
-		return nil, err
-	}
-
 	_, err = conn.Write(b.getConnectV5())
 	if err != nil {
 		return nil, fmt.Errorf("CONNACK read failed: %v", err)
@@ -273,11 +458,39 @@ func pingsBack(conn net.Conn) bool {
 	return true
 }
 
-// TODO: use HasPrefix
+// analysisResults points to the fields set by the analysis of a protocol
+// level
+type analysisResults struct {
+	qos1, qos2, qos3Response   *bool
+	subscribeAll               *bool
+	invalidTopics, invalidUTF8 *bool
+	publishSYS, filterSYS      *bool
+}
+
 // AnalyzeV4 ...
 func (b *BrokerInfo) AnalyzeV4() error {
+	return b.analyzeV3x(packet.V311, analysisResults{
+		&b.V4QoS1, &b.V4QoS2, &b.V4QoS3Response, &b.V4SubscribeAll,
+		&b.V4InvalidTopics, &b.V4InvalidUTF8Topic, &b.V4PublishSYS, &b.V4FilterSYS,
+	})
+}
 
-	conn, err := b.connectV4()
+// AnalyzeV3 runs the v3.1.1 analysis over v3.1 connections, whose packets
+// only differ in CONNECT
+func (b *BrokerInfo) AnalyzeV3() error {
+	return b.analyzeV3x(packet.V31, analysisResults{
+		&b.V3QoS1, &b.V3QoS2, &b.V3QoS3Response, &b.V3SubscribeAll,
+		&b.V3InvalidTopics, &b.V3InvalidUTF8Topic, &b.V3PublishSYS, &b.V3FilterSYS,
+	})
+}
+
+// analyzeV3x runs the analysis of v3.1 or v3.1.1
+// TODO: use HasPrefix
+func (b *BrokerInfo) analyzeV3x(version byte, r analysisResults) error {
+
+	name := versionName(version)
+	b.beginCheck(name + " ping")
+	conn, err := b.connectV3x(version)
 	if err != nil {
 		return err
 	}
@@ -289,25 +502,27 @@ func (b *BrokerInfo) AnalyzeV4() error {
 	}
 
 	// Check QoS 1 support by checking PUBACK
+	b.beginCheck(name + " QoS 1")
 	conn.Write([]byte(publishV4Q1))
 	puback := make([]byte, 100)
 	_, err = conn.Read(puback)
 	if err == nil {
 		// Check PUBACK's value including message id
 		if strings.HasPrefix(string(puback), pubackV4Q1) {
-			b.V4QoS1 = true
+			*r.qos1 = true
 		}
 	}
 
 	// Attempts to reconnect if needed
 	if !pingsBack(conn) {
-		conn, err = b.connectV4()
+		conn, err = b.connectV3x(version)
 		if err != nil {
 			return err
 		}
 	}
 
 	// Check QoS 2 support by checking PUBREC
+	b.beginCheck(name + " QoS 2")
 	conn.Write([]byte(publishV4Q2))
 	pubrec := make([]byte, 100)
 	_, err = conn.Read(pubrec)
@@ -319,111 +534,122 @@ func (b *BrokerInfo) AnalyzeV4() error {
 			_, err = conn.Read(pubcomp)
 			if err == nil {
 				if strings.HasPrefix(string(pubcomp), pubcompV4Q2) {
-					b.V4QoS2 = true
+					*r.qos2 = true
 				}
 			}
 		}
 	}
 
 	if !pingsBack(conn) {
-		conn, err = b.connectV4()
+		conn, err = b.connectV3x(version)
 		if err != nil {
 			return err
 		}
 	}
 
+	b.beginCheck(name + " QoS 3")
 	conn.Write([]byte(publishV4Q3))
 	_, err = conn.Read(puback)
 	if err == nil {
 		// TODO: check for a puback or pubrel
-		b.V4QoS3Response = true
+		*r.qos3Response = true
 	}
 
 	if !pingsBack(conn) {
-		conn, err = b.connectV4()
+		conn, err = b.connectV3x(version)
 		if err != nil {
 			return err
 		}
 	}
 
 	// Check wildcard subscription
+	b.beginCheck(name + " subscribe to #")
 	conn.Write([]byte(subAllV4Q0))
 	suback := make([]byte, 100)
 	_, err = conn.Read(suback)
 	if err == nil {
 		// Check SUBACK's value
 		if strings.HasPrefix(string(suback), subackV4Q0) {
-			b.V4SubscribeAll = true
+			*r.subscribeAll = true
 		}
 	}
 
 	conn.Close()
 
-	conn, err = b.connectV4()
+	conn, err = b.connectV3x(version)
 	if err != nil {
 		return err
 	}
 
 	// Check invalid topic names support
+	b.beginCheck(name + " invalid topic")
 	conn.Write([]byte(subInvalidV4Q0))
 	suback = make([]byte, 100)
 	_, err = conn.Read(suback)
 	if err == nil {
 		if strings.HasPrefix(string(suback), subackV4Q0) {
-			b.V4InvalidTopics = true
+			*r.invalidTopics = true
 		}
 	}
 
 	if !pingsBack(conn) {
-		conn, err = b.connectV4()
+		conn, err = b.connectV3x(version)
 		if err != nil {
 			return err
 		}
 	}
 
 	// Check invalid UTF8 topic names support
+	b.beginCheck(name + " invalid UTF-8 topic")
 	conn.Write([]byte(subInvalidUTF8V4Q0))
 	suback = make([]byte, 100)
 	_, err = conn.Read(suback)
 	if err == nil {
 		if strings.HasPrefix(string(suback), subackV4Q0) {
-			b.V4InvalidUTF8Topic = true
+			*r.invalidUTF8 = true
 		}
 	}
 
 	if !pingsBack(conn) {
-		conn, err = b.connectV4()
+		conn, err = b.connectV3x(version)
 		if err != nil {
 			return err
 		}
 	}
 
 	// Check $SYS publication
+	b.beginCheck(name + " $SYS publish")
 	conn.Write([]byte(pubSysV4Q1))
+	b.trackRetained(sysProbeTopic, version)
 	_, err = conn.Read(puback)
+	if err == io.EOF {
+		// Refused, nothing was retained
+		b.untrackRetained(sysProbeTopic, version)
+	}
 	if err == nil {
 		if strings.HasPrefix(string(puback), pubackV4Q1) {
-			b.V4PublishSYS = true
+			*r.publishSYS = true
 		}
 	}
 
 	// Need to close and reconnect to receive published message
 	conn.Close()
 
-	conn, err = b.connectV4()
+	conn, err = b.connectV3x(version)
 	if err != nil {
 		return err
 	}
 
 	// Check if $SYS messages are filtered or forwarded,
 	// based on previous message that had the retain flag
-	if b.V4PublishSYS {
+	b.beginCheck(name + " $SYS filter")
+	if *r.publishSYS {
 		conn.Write([]byte(subSysAV4Q0))
-		time.Sleep(1 * time.Second)
+		time.Sleep(b.quiet())
 		_, err = conn.Read(suback)
 		if err == nil {
 			if strings.HasPrefix(string(suback), subackV4Q1+pubSysV4Q1) {
-				b.V4FilterSYS = false
+				*r.filterSYS = false
 			}
 		}
 	}
@@ -434,6 +660,7 @@ func (b *BrokerInfo) AnalyzeV4() error {
 // AnalyzeV5 ...
 func (b *BrokerInfo) AnalyzeV5() error {
 
+	b.beginCheck("v5.0 ping")
 	conn, err := b.connectV5()
 	if err != nil {
 		return err
@@ -448,6 +675,7 @@ func (b *BrokerInfo) AnalyzeV5() error {
 	// TODO: support non-empty properties in puback?
 	// TODO: figure out why mosquitto/hivemq add 8 random bytes
 	// Check QoS 1 support by checking PUBACK
+	b.beginCheck("v5.0 QoS 1")
 	conn.Write([]byte(publishV5Q1))
 	puback := make([]byte, 100)
 	_, err = conn.Read(puback)
@@ -470,6 +698,7 @@ func (b *BrokerInfo) AnalyzeV5() error {
 	}
 
 	// Check QoS 2 support by checking PUBREC
+	b.beginCheck("v5.0 QoS 2")
 	conn.Write([]byte(publishV5Q2))
 	pubrec := make([]byte, 100)
 	_, err = conn.Read(pubrec)
@@ -494,6 +723,7 @@ func (b *BrokerInfo) AnalyzeV5() error {
 	}
 
 	// TODO: broker may respond with an error even if not supported
+	b.beginCheck("v5.0 QoS 3")
 	conn.Write([]byte(publishV5Q3))
 	_, err = conn.Read(puback)
 	if err == nil {
@@ -514,6 +744,7 @@ func (b *BrokerInfo) AnalyzeV5() error {
 	}
 
 	// Check wildcard subscription
+	b.beginCheck("v5.0 subscribe to #")
 	conn.Write([]byte(subAllV5Q0))
 	suback := make([]byte, 100)
 	_, err = conn.Read(suback)
@@ -532,6 +763,7 @@ func (b *BrokerInfo) AnalyzeV5() error {
 	}
 
 	// Check invalid topic names support
+	b.beginCheck("v5.0 invalid topic")
 	conn.Write([]byte(subInvalidV5Q0))
 	suback = make([]byte, 100)
 	_, err = conn.Read(suback)
@@ -549,6 +781,7 @@ func (b *BrokerInfo) AnalyzeV5() error {
 	}
 
 	// Check invalid UTF8 topic names support
+	b.beginCheck("v5.0 invalid UTF-8 topic")
 	conn.Write([]byte(subInvalidUTF8V5Q0))
 	suback = make([]byte, 100)
 	_, err = conn.Read(suback)
@@ -566,8 +799,14 @@ func (b *BrokerInfo) AnalyzeV5() error {
 	}
 
 	// Check $SYS publication
+	b.beginCheck("v5.0 $SYS publish")
 	conn.Write([]byte(pubSysV5Q1))
+	b.trackRetained(sysProbeTopic, packet.V5)
 	_, err = conn.Read(puback)
+	if err == io.EOF {
+		// Refused, nothing was retained
+		b.untrackRetained(sysProbeTopic, packet.V5)
+	}
 	if err == nil {
 		s := string(puback)
 		if strings.HasPrefix(s, pubackV5Q1a) ||
@@ -586,9 +825,10 @@ func (b *BrokerInfo) AnalyzeV5() error {
 
 	// Check if $SYS messages are filtered or forwarded,
 	// based on previous message that had the retain flag
+	b.beginCheck("v5.0 $SYS filter")
 	if b.V5PublishSYS {
 		conn.Write([]byte(subSysAV5Q0))
-		time.Sleep(1 * time.Second)
+		time.Sleep(b.quiet())
 		_, err = conn.Read(suback)
 		if err == nil {
 			if strings.HasPrefix(string(suback), subackV5Q1+pubSysV5Q1) {
@@ -605,6 +845,7 @@ func (b *BrokerInfo) AnalyzeV5() error {
 // Must be run after AnalyzeV4()
 func (b *BrokerInfo) GuessBroker() error {
 
+	b.beginCheck("broker guess")
 	conn, err := b.connectV4()
 	if err != nil {
 		return err
@@ -688,13 +929,13 @@ func (b *BrokerInfo) GuessBroker() error {
 // CheckConnectionV4 determines if v3.1.1 is supported
 func (b *BrokerInfo) CheckConnectionV4() error {
 
-	server := fmt.Sprintf("%v:%v", b.Host, b.Port)
-	conn, err := net.DialTimeout("tcp", server, 10*time.Second)
+	b.beginCheck("v3.1.1 connection")
+	conn, err := b.dial()
 	if err != nil {
-		return fmt.Errorf("Dial to %v failed", server)
+		return fmt.Errorf("Dial to %v failed", b.getServer())
 	}
 	defer conn.Close()
-	conn.Write([]byte(connectV4))
+	conn.Write(b.anonymousConnect(packet.V311))
 	connack := make([]byte, 100)
 	bytes, err := conn.Read(connack)
 	if err != nil {
@@ -742,16 +983,57 @@ func (b *BrokerInfo) CheckConnectionV4() error {
 	}
 }
 
+// CheckConnectionV3 determines if v3.1 is supported, with protocol name
+// MQIsdp, and if it requires authentication
+func (b *BrokerInfo) CheckConnectionV3() error {
+
+	b.beginCheck("v3.1 connection")
+	conn, err := b.dial()
+	if err != nil {
+		return fmt.Errorf("Dial to %v failed", b.getServer())
+	}
+	defer conn.Close()
+	conn.Write(b.anonymousConnect(packet.V31))
+	connack := make([]byte, 100)
+	bytes, err := conn.Read(connack)
+
+	b.V3 = false
+	b.V3Anonymous = false
+
+	// Brokers without v3.1 may close the connection instead of
+	// answering "Unacceptable protocol version"
+	if err != nil || bytes < 4 || connack[0] != 0x20 {
+		b.logf(LevelDebug, "no v3.1 CONNACK (%v bytes, error %v)", bytes, err)
+		return nil
+	}
+
+	switch connack[3] {
+	case 0x00:
+		b.V3 = true
+		b.V3Anonymous = true
+	case 0x01:
+		// Unacceptable protocol version
+	case 0x02:
+		return fmt.Errorf("CONNACK: Identifier rejected")
+	case 0x03:
+		return fmt.Errorf("CONNACK: Server unavailable")
+	case 0x04, 0x05:
+		// Bad username or password, not authorized
+		b.V3 = true
+	}
+	return nil
+}
+
 // CheckConnectionV5 determines if v5.0 is supported
 func (b *BrokerInfo) CheckConnectionV5() error {
 
-	server := fmt.Sprintf("%v:%v", b.Host, b.Port)
-	conn, err := net.DialTimeout("tcp", server, 10*time.Second)
+	b.beginCheck("v5.0 connection")
+	conn, err := b.dial()
 	if err != nil {
-		return fmt.Errorf("Dial to %v failed", server)
+		return fmt.Errorf("Dial to %v failed", b.getServer())
 	}
 	defer conn.Close()
-	conn.Write([]byte(connectV5))
+	conn.Write(b.anonymousConnect(packet.V5))
 	connack := make([]byte, 100)
 	bytes, err := conn.Read(connack)
 	if err != nil {
@@ -815,7 +1097,8 @@ func (b *BrokerInfo) CheckConnectionV5() error {
 	case 0x8a:
 		return fmt.Errorf("CONNACK: Banned")
 	case 0x8c:
-		// Bad authentication method
+		// Bad authentication method, although we send none. Methods
+		// are tried by CheckAuthV5.
 		return nil
 	case 0x90:
 		return fmt.Errorf("CONNACK: Topic name invalid")
@@ -840,3 +1123,163 @@ func (b *BrokerInfo) CheckConnectionV5() error {
 
 	}
 }
+
+// Scan runs the connection checks, the steps of each supported version,
+// and broker detection. BeforeStep and AfterStep follow its progress.
+// A failed step doesn't stop the scan, as brokers often refuse only
+// some of the checks: it is listed in StepErrors, and Scan returns the
+// first error.
+func (b *BrokerInfo) Scan() error {
+
+	err := b.scan()
+
+	// Failures are listed in CleanupFailed
+	b.Cleanup()
+
+	if err != nil {
+		b.Failed = true
+		b.Error = err.Error()
+	}
+	return err
+}
+
+func (b *BrokerInfo) scan() error {
+
+	var first error
+	run := func(s ScanStep) {
+		err := b.runStep(s)
+		if err == nil {
+			return
+		}
+		if b.StepErrors == nil {
+			b.StepErrors = make(map[string]string)
+		}
+		b.StepErrors[versionName(s.Version)+" "+s.Name] = err.Error()
+		if first == nil {
+			first = err
+		}
+	}
+
+	for _, s := range b.connectionSteps() {
+		run(s)
+	}
+
+	for _, s := range b.analysisSteps() {
+		if b.supports(s.Version) {
+			run(s)
+		}
+	}
+
+	// A failed guess leaves the broker type unknown
+	b.runStep(ScanStep{Name: StepGuess, Run: b.GuessBroker})
+
+	return first
+}
+
+// Names of the scan steps without a Result
+const (
+	StepConnection = "broker interface"
+	StepAnalysis   = "broker analysis"
+	StepGuess      = "broker software"
+)
+
+// ScanStep is a step of Scan
+type ScanStep struct {
+	// Name is what the step checks, such as "retained messages"
+	Name string
+
+	// Version is the protocol level checked, 0 for the broker guess
+	Version byte
+
+	// Run runs the step
+	Run func() error
+
+	// Result points to the results of the step in the BrokerInfo, such
+	// as a *RetainInfo, or is nil if they are plain fields
+	Result interface{}
+}
+
+// runStep runs s between the BeforeStep and AfterStep hooks
+func (b *BrokerInfo) runStep(s ScanStep) error {
+	if b.BeforeStep != nil {
+		b.BeforeStep(s)
+	}
+	err := s.Run()
+	if b.AfterStep != nil {
+		b.AfterStep(s, err)
+	}
+	return err
+}
+
+// supports tells if the connection checks found the protocol level
+func (b *BrokerInfo) supports(version byte) bool {
+	switch version {
+	case packet.V31:
+		return b.V3
+	case packet.V311:
+		return b.V4
+	case packet.V5:
+		return b.V5
+	}
+	return false
+}
+
+// connectionSteps return the steps finding the protocol levels supported
+func (b *BrokerInfo) connectionSteps() []ScanStep {
+	return []ScanStep{
+		{StepConnection, packet.V31, b.CheckConnectionV3, nil},
+		{StepConnection, packet.V311, b.CheckConnectionV4, nil},
+		{StepConnection, packet.V5, b.CheckConnectionV5, nil},
+	}
+}
+
+// analysisSteps return the steps run for the protocol levels supported,
+// in order
+func (b *BrokerInfo) analysisSteps() []ScanStep {
+	return []ScanStep{
+		{StepAnalysis, packet.V31, b.AnalyzeV3, nil},
+		{StepAnalysis, packet.V311, b.AnalyzeV4, nil},
+		{StepAnalysis, packet.V5, b.AnalyzeV5, nil},
+		{"retained messages", packet.V31, b.CheckRetainV3, &b.V3Retain},
+		{"retained messages", packet.V311, b.CheckRetainV4, &b.V4Retain},
+		{"retained messages", packet.V5, b.CheckRetainV5, &b.V5Retain},
+		{"will messages", packet.V31, b.CheckWillV3, &b.V3Will},
+		{"will messages", packet.V311, b.CheckWillV4, &b.V4Will},
+		{"will messages", packet.V5, b.CheckWillV5, &b.V5Will},
+		{"persistent sessions", packet.V31, b.CheckSessionV3, &b.V3Session},
+		{"persistent sessions", packet.V311, b.CheckSessionV4, &b.V4Session},
+		{"persistent sessions", packet.V5, b.CheckSessionV5, &b.V5Session},
+		{"shared subscriptions", packet.V31, b.CheckSharedV3, &b.V3Shared},
+		{"shared subscriptions", packet.V311, b.CheckSharedV4, &b.V4Shared},
+		{"shared subscriptions", packet.V5, b.CheckSharedV5, &b.V5Shared},
+		{"topic aliases", packet.V5, b.CheckTopicAliasV5, &b.V5TopicAlias},
+		{"message expiry", packet.V5, b.CheckExpiryV5, &b.V5Expiry},
+		{"property forwarding", packet.V5, b.CheckForwardingV5, &b.V5Forwarding},
+		{"subscription options", packet.V5, b.CheckSubOptionsV5, &b.V5SubOptions},
+		{"enhanced authentication", packet.V5, b.CheckAuthV5, &b.V5Auth},
+		{"maximum packet size", packet.V31, b.CheckPacketSizeV3, &b.V3PacketSize},
+		{"maximum packet size", packet.V311, b.CheckPacketSizeV4, &b.V4PacketSize},
+		{"maximum packet size", packet.V5, b.CheckPacketSizeV5, &b.V5PacketSize},
+		{"topic limits", packet.V31, b.CheckTopicLimitsV3, &b.V3TopicLimits},
+		{"topic limits", packet.V311, b.CheckTopicLimitsV4, &b.V4TopicLimits},
+		{"topic limits", packet.V5, b.CheckTopicLimitsV5, &b.V5TopicLimits},
+		{"client identifiers", packet.V31, b.CheckClientIDV3, &b.V3ClientID},
+		{"client identifiers", packet.V311, b.CheckClientIDV4, &b.V4ClientID},
+		{"client identifiers", packet.V5, b.CheckClientIDV5, &b.V5ClientID},
+		{"keep-alive", packet.V31, b.CheckKeepAliveV3, &b.V3KeepAlive},
+		{"keep-alive", packet.V311, b.CheckKeepAliveV4, &b.V4KeepAlive},
+		{"keep-alive", packet.V5, b.CheckKeepAliveV5, &b.V5KeepAlive},
+		{"flow control", packet.V31, b.CheckFlowControlV3, &b.V3FlowControl},
+		{"flow control", packet.V311, b.CheckFlowControlV4, &b.V4FlowControl},
+		{"flow control", packet.V5, b.CheckFlowControlV5, &b.V5FlowControl},
+		{"QoS delivery", packet.V31, b.CheckQoSDeliveryV3, &b.V3QoSDelivery},
+		{"QoS delivery", packet.V311, b.CheckQoSDeliveryV4, &b.V4QoSDelivery},
+		{"QoS delivery", packet.V5, b.CheckQoSDeliveryV5, &b.V5QoSDelivery},
+		{"QoS 2 flows", packet.V31, b.CheckQoS2V3, &b.V3QoS2Flows},
+		{"QoS 2 flows", packet.V311, b.CheckQoS2V4, &b.V4QoS2Flows},
+		{"QoS 2 flows", packet.V5, b.CheckQoS2V5, &b.V5QoS2Flows},
+		{"unsubscribe", packet.V31, b.CheckUnsubscribeV3, &b.V3Unsubscribe},
+		{"unsubscribe", packet.V311, b.CheckUnsubscribeV4, &b.V4Unsubscribe},
+		{"unsubscribe", packet.V5, b.CheckUnsubscribeV5, &b.V5Unsubscribe},
+	}
+}
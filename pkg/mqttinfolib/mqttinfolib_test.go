@@ -0,0 +1,332 @@
+package mqttinfo
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/fakebroker"
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+// testSecond is how long the seconds of keep-alives, expiry intervals
+// and will delays last in tests, on both sides
+const testSecond = 100 * time.Millisecond
+
+// newTestBrokerInfo returns a BrokerInfo connected to a fake broker
+func newTestBrokerInfo(t *testing.T, behavior fakebroker.Behavior) *BrokerInfo {
+	behavior.Second = testSecond
+	broker := fakebroker.New(behavior)
+	t.Cleanup(broker.Close)
+	return brokerInfoFor(t, broker)
+}
+
+// brokerInfoFor returns a BrokerInfo connected to broker
+func brokerInfoFor(t *testing.T, broker *fakebroker.Broker) *BrokerInfo {
+	b, err := NewBrokerInfo("fakebroker", 1883, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Dialer = broker.Dial
+	b.Timeout = 500 * time.Millisecond
+	b.ProbeKeepAlive = 1
+	b.second = testSecond
+
+	return b
+}
+
+// lenient accepts everything but QoS 2, and forwards $SYS publications
+func lenient() fakebroker.Behavior {
+	return fakebroker.Behavior{
+		Name:       "lenient",
+		V3:         true,
+		V4:         true,
+		V5:         true,
+		Anonymous:  true,
+		MaxQoS:     1,
+		PublishSYS: true,
+		ForwardSYS: true,
+		Second:     testSecond,
+	}
+}
+
+func TestCheckConnection(t *testing.T) {
+	v4Only := fakebroker.Mosquitto()
+	v4Only.V5 = false
+
+	auth := fakebroker.Mosquitto()
+	auth.Anonymous = false
+	auth.Username = "user"
+	auth.Password = "secret"
+
+	unavailable := fakebroker.Mosquitto()
+	unavailable.ConnackCode = func(c *packet.Connect) byte {
+		if c.Level == packet.V5 {
+			return 0x88
+		}
+		return 0x03
+	}
+
+	tests := []struct {
+		name                     string
+		behavior                 fakebroker.Behavior
+		v4, v4Anonymous, v4Error bool
+		v5, v5Anonymous, v5Error bool
+	}{
+		{"mosquitto", fakebroker.Mosquitto(), true, true, false, true, true, false},
+		{"v3.1.1 only", v4Only, true, true, false, false, false, false},
+		{"authentication", auth, true, false, false, true, false, false},
+		{"unavailable", unavailable, true, false, true, true, false, true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			b := newTestBrokerInfo(t, tt.behavior)
+
+			err := b.CheckConnectionV4()
+			if (err != nil) != tt.v4Error {
+				t.Errorf("CheckConnectionV4() error = %v, want error %v", err, tt.v4Error)
+			}
+			if b.V4 != tt.v4 || b.V4Anonymous != tt.v4Anonymous {
+				t.Errorf("V4 = %v, V4Anonymous = %v, want %v, %v", b.V4, b.V4Anonymous, tt.v4, tt.v4Anonymous)
+			}
+
+			err = b.CheckConnectionV5()
+			if (err != nil) != tt.v5Error {
+				t.Errorf("CheckConnectionV5() error = %v, want error %v", err, tt.v5Error)
+			}
+			if b.V5 != tt.v5 || b.V5Anonymous != tt.v5Anonymous {
+				t.Errorf("V5 = %v, V5Anonymous = %v, want %v, %v", b.V5, b.V5Anonymous, tt.v5, tt.v5Anonymous)
+			}
+		})
+	}
+}
+
+func TestCheckConnectionV3(t *testing.T) {
+	noV3 := fakebroker.Mosquitto()
+	noV3.V3 = false
+
+	auth := fakebroker.Mosquitto()
+	auth.Anonymous = false
+
+	unavailable := fakebroker.Mosquitto()
+	unavailable.ConnackCode = func(c *packet.Connect) byte { return 0x03 }
+
+	tests := []struct {
+		name               string
+		behavior           fakebroker.Behavior
+		v3, v3Anonymous, e bool
+	}{
+		{"mosquitto", fakebroker.Mosquitto(), true, true, false},
+		{"no v3.1", noV3, false, false, false},
+		{"authentication", auth, true, false, false},
+		{"unavailable", unavailable, false, false, true},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			b := newTestBrokerInfo(t, tt.behavior)
+
+			err := b.CheckConnectionV3()
+			if (err != nil) != tt.e {
+				t.Errorf("CheckConnectionV3() error = %v, want error %v", err, tt.e)
+			}
+			if b.V3 != tt.v3 || b.V3Anonymous != tt.v3Anonymous {
+				t.Errorf("V3 = %v, V3Anonymous = %v, want %v, %v", b.V3, b.V3Anonymous, tt.v3, tt.v3Anonymous)
+			}
+		})
+	}
+}
+
+// analysis holds the fields set by AnalyzeV3, AnalyzeV4 and AnalyzeV5
+type analysis struct {
+	QoS1, QoS2, QoS3Response   bool
+	SubscribeAll               bool
+	InvalidTopics, InvalidUTF8 bool
+	PublishSYS, FilterSYS      bool
+}
+
+var analyzeTests = []struct {
+	name     string
+	behavior fakebroker.Behavior
+	want     analysis
+}{
+	{"mosquitto", fakebroker.Mosquitto(), analysis{
+		QoS1: true, QoS2: true, SubscribeAll: true, PublishSYS: true, FilterSYS: true,
+	}},
+	{"HiveMQ", fakebroker.HiveMQ(), analysis{
+		QoS1: true, QoS2: true, SubscribeAll: true, FilterSYS: true,
+	}},
+	{"lenient", lenient(), analysis{
+		QoS1: true, InvalidTopics: true, InvalidUTF8: true, PublishSYS: true,
+	}},
+}
+
+func TestAnalyzeV3(t *testing.T) {
+	for _, tt := range analyzeTests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			b := newTestBrokerInfo(t, tt.behavior)
+
+			if err := b.AnalyzeV3(); err != nil {
+				t.Fatalf("AnalyzeV3() error = %v", err)
+			}
+
+			got := analysis{
+				b.V3QoS1, b.V3QoS2, b.V3QoS3Response, b.V3SubscribeAll,
+				b.V3InvalidTopics, b.V3InvalidUTF8Topic, b.V3PublishSYS, b.V3FilterSYS,
+			}
+			if got != tt.want {
+				t.Errorf("AnalyzeV3() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestChecksV3 runs the checks of v3.1.1 over v3.1, whose packets only
+// differ in CONNECT, and expects the same results
+func TestChecksV3(t *testing.T) {
+	b := newTestBrokerInfo(t, fakebroker.Mosquitto())
+	for _, s := range b.analysisSteps() {
+		if s.Version != packet.V31 || s.Result == nil {
+			continue
+		}
+		name := s.Name
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			v3 := scanStep(newTestBrokerInfo(t, fakebroker.Mosquitto()), name, packet.V31)
+			v4 := scanStep(newTestBrokerInfo(t, fakebroker.Mosquitto()), name, packet.V311)
+			if err := v3.Run(); err != nil {
+				t.Fatalf("v3.1 error = %v", err)
+			}
+			if err := v4.Run(); err != nil {
+				t.Fatalf("v3.1.1 error = %v", err)
+			}
+
+			// Only close to each other
+			if k, ok := v3.Result.(*KeepAliveInfo); ok {
+				k.ClosedAfter = v4.Result.(*KeepAliveInfo).ClosedAfter
+			}
+			if !reflect.DeepEqual(v3.Result, v4.Result) {
+				t.Errorf("v3.1 = %+v, v3.1.1 = %+v", v3.Result, v4.Result)
+			}
+		})
+	}
+}
+
+// scanStep returns the step of b with the given name and version
+func scanStep(b *BrokerInfo, name string, version byte) ScanStep {
+	for _, s := range b.analysisSteps() {
+		if s.Name == name && s.Version == version {
+			return s
+		}
+	}
+	panic("no step " + name)
+}
+
+func TestAnalyzeV4(t *testing.T) {
+	for _, tt := range analyzeTests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			b := newTestBrokerInfo(t, tt.behavior)
+
+			if err := b.AnalyzeV4(); err != nil {
+				t.Fatalf("AnalyzeV4() error = %v", err)
+			}
+
+			got := analysis{
+				b.V4QoS1, b.V4QoS2, b.V4QoS3Response, b.V4SubscribeAll,
+				b.V4InvalidTopics, b.V4InvalidUTF8Topic, b.V4PublishSYS, b.V4FilterSYS,
+			}
+			if got != tt.want {
+				t.Errorf("AnalyzeV4() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnalyzeV5(t *testing.T) {
+	for _, tt := range analyzeTests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			b := newTestBrokerInfo(t, tt.behavior)
+
+			if err := b.AnalyzeV5(); err != nil {
+				t.Fatalf("AnalyzeV5() error = %v", err)
+			}
+
+			got := analysis{
+				b.V5QoS1, b.V5QoS2, b.V5QoS3Response, b.V5SubscribeAll,
+				b.V5InvalidTopics, b.V5InvalidUTF8Topic, b.V5PublishSYS, b.V5FilterSYS,
+			}
+			if got != tt.want {
+				t.Errorf("AnalyzeV5() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGuessBroker(t *testing.T) {
+	tests := []struct {
+		behavior fakebroker.Behavior
+		want     Broker
+	}{
+		{fakebroker.Mosquitto(), "mosquitto"},
+		{fakebroker.HiveMQ(), "HiveMQ"},
+		{fakebroker.VerneMQ(), "VerneMQ"},
+		// EMQX isn't identified yet
+		{fakebroker.EMQX(), "unknown"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.behavior.Name, func(t *testing.T) {
+			t.Parallel()
+			b := newTestBrokerInfo(t, tt.behavior)
+
+			// GuessBroker relies on AnalyzeV4's results
+			if err := b.AnalyzeV4(); err != nil {
+				t.Fatalf("AnalyzeV4() error = %v", err)
+			}
+			if err := b.GuessBroker(); err != nil {
+				t.Fatalf("GuessBroker() error = %v", err)
+			}
+			if b.TypeGuessed != tt.want {
+				t.Errorf("TypeGuessed = %v, want %v", b.TypeGuessed, tt.want)
+			}
+		})
+	}
+}
+
+func TestScanContinues(t *testing.T) {
+	if testing.Short() {
+		t.Skip("full scan skipped in short mode")
+	}
+	t.Parallel()
+
+	// Refuses the probe topics, as an ACL would
+	behavior := fakebroker.Mosquitto()
+	behavior.MaxTopicLevels = 2
+	b := newTestBrokerInfo(t, behavior)
+
+	if err := b.Scan(); err == nil {
+		t.Fatal("Scan() error = nil, want the refused subscriptions")
+	}
+	if !b.Failed {
+		t.Error("Failed = false")
+	}
+	if _, ok := b.StepErrors["v3.1.1 retained messages"]; !ok {
+		t.Errorf("StepErrors = %v, want v3.1.1 retained messages", b.StepErrors)
+	}
+	// Checks after the failed ones still ran
+	if !b.V4KeepAlive.Enforced || !b.V5KeepAlive.Enforced {
+		t.Errorf("keep-alive not checked after failures: %+v, %+v", b.V4KeepAlive, b.V5KeepAlive)
+	}
+}
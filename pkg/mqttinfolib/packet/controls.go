@@ -0,0 +1,396 @@
+package packet
+
+// Subscription options, in addition to the maximum QoS
+const (
+	NoLocal           byte = 0x04
+	RetainAsPublished byte = 0x08
+)
+
+// RetainHandling returns the subscription option bits for the given
+// retain handling value (0, 1 or 2)
+func RetainHandling(n byte) byte {
+	return n << 4
+}
+
+// Connect is a CONNECT packet
+type Connect struct {
+	ProtocolName string
+	Level        byte
+	CleanStart   bool
+	KeepAlive    uint16
+	Properties   Properties
+	ClientID     string
+	Will         *Will
+	HasUsername  bool
+	Username     string
+	HasPassword  bool
+	Password     []byte
+}
+
+// Will is the will message of a CONNECT packet
+type Will struct {
+	QoS        byte
+	Retain     bool
+	Properties Properties
+	Topic      string
+	Payload    []byte
+}
+
+// Flags returns the connect flags byte
+func (c *Connect) Flags() byte {
+	var flags byte
+	if c.CleanStart {
+		flags |= 0x02
+	}
+	if c.Will != nil {
+		flags |= 0x04 | (c.Will.QoS&0x03)<<3
+		if c.Will.Retain {
+			flags |= 0x20
+		}
+	}
+	if c.HasPassword {
+		flags |= 0x40
+	}
+	if c.HasUsername {
+		flags |= 0x80
+	}
+	return flags
+}
+
+// Encode returns the CONNECT packet bytes
+func (c *Connect) Encode() []byte {
+	var e encoder
+	e.string(c.ProtocolName)
+	e.byte(c.Level)
+	e.byte(c.Flags())
+	e.uint16(c.KeepAlive)
+	if c.Level >= V5 {
+		c.Properties.encode(&e)
+	}
+	e.string(c.ClientID)
+	if c.Will != nil {
+		if c.Level >= V5 {
+			c.Will.Properties.encode(&e)
+		}
+		e.string(c.Will.Topic)
+		e.binary(c.Will.Payload)
+	}
+	if c.HasUsername {
+		e.string(c.Username)
+	}
+	if c.HasPassword {
+		e.binary(c.Password)
+	}
+	return (&Packet{Type: CONNECT, Body: e}).Bytes()
+}
+
+// ParseConnect decodes a CONNECT packet
+func ParseConnect(p *Packet) (*Connect, error) {
+	d := &decoder{b: p.Body}
+	c := &Connect{}
+	c.ProtocolName = d.string()
+	c.Level = d.byte()
+	flags := d.byte()
+	c.KeepAlive = d.uint16()
+	c.CleanStart = flags&0x02 != 0
+	if c.Level >= V5 {
+		c.Properties = decodeProperties(d)
+	}
+	c.ClientID = d.string()
+	if flags&0x04 != 0 {
+		c.Will = &Will{QoS: (flags >> 3) & 0x03, Retain: flags&0x20 != 0}
+		if c.Level >= V5 {
+			c.Will.Properties = decodeProperties(d)
+		}
+		c.Will.Topic = d.string()
+		c.Will.Payload = d.binary()
+	}
+	if flags&0x80 != 0 {
+		c.HasUsername = true
+		c.Username = d.string()
+	}
+	if flags&0x40 != 0 {
+		c.HasPassword = true
+		c.Password = d.binary()
+	}
+	return c, d.err
+}
+
+// Connack is a CONNACK packet
+type Connack struct {
+	SessionPresent bool
+	ReasonCode     byte
+	Properties     Properties
+}
+
+// Encode returns the CONNACK packet bytes
+func (c *Connack) Encode(version byte) []byte {
+	var e encoder
+	if c.SessionPresent {
+		e.byte(0x01)
+	} else {
+		e.byte(0x00)
+	}
+	e.byte(c.ReasonCode)
+	if version >= V5 {
+		c.Properties.encode(&e)
+	}
+	return (&Packet{Type: CONNACK, Body: e}).Bytes()
+}
+
+// ParseConnack decodes a CONNACK packet
+func ParseConnack(p *Packet, version byte) (*Connack, error) {
+	d := &decoder{b: p.Body}
+	c := &Connack{}
+	c.SessionPresent = d.byte()&0x01 != 0
+	c.ReasonCode = d.byte()
+	if version >= V5 && !d.empty() {
+		c.Properties = decodeProperties(d)
+	}
+	return c, d.err
+}
+
+// Publish is a PUBLISH packet
+type Publish struct {
+	Dup        bool
+	QoS        byte
+	Retain     bool
+	Topic      string
+	PacketID   uint16
+	Properties Properties
+	Payload    []byte
+}
+
+// Encode returns the PUBLISH packet bytes
+func (p *Publish) Encode(version byte) []byte {
+	var flags byte
+	if p.Dup {
+		flags |= 0x08
+	}
+	flags |= (p.QoS & 0x03) << 1
+	if p.Retain {
+		flags |= 0x01
+	}
+	var e encoder
+	e.string(p.Topic)
+	if p.QoS > 0 {
+		e.uint16(p.PacketID)
+	}
+	if version >= V5 {
+		p.Properties.encode(&e)
+	}
+	e.raw(p.Payload)
+	return (&Packet{Type: PUBLISH, Flags: flags, Body: e}).Bytes()
+}
+
+// ParsePublish decodes a PUBLISH packet
+func ParsePublish(p *Packet, version byte) (*Publish, error) {
+	d := &decoder{b: p.Body}
+	pub := &Publish{
+		Dup:    p.Flags&0x08 != 0,
+		QoS:    (p.Flags >> 1) & 0x03,
+		Retain: p.Flags&0x01 != 0,
+	}
+	pub.Topic = d.string()
+	if pub.QoS > 0 {
+		pub.PacketID = d.uint16()
+	}
+	if version >= V5 {
+		pub.Properties = decodeProperties(d)
+	}
+	pub.Payload = d.rest()
+	return pub, d.err
+}
+
+// Ack is a PUBACK, PUBREC, PUBREL or PUBCOMP packet
+type Ack struct {
+	Type       byte
+	PacketID   uint16
+	ReasonCode byte
+	Properties Properties
+}
+
+// Encode returns the acknowledgement packet bytes
+func (a *Ack) Encode(version byte) []byte {
+	var e encoder
+	e.uint16(a.PacketID)
+	if version >= V5 && (a.ReasonCode != 0 || len(a.Properties) > 0) {
+		e.byte(a.ReasonCode)
+		if len(a.Properties) > 0 {
+			a.Properties.encode(&e)
+		}
+	}
+	var flags byte
+	if a.Type == PUBREL {
+		flags = 0x02
+	}
+	return (&Packet{Type: a.Type, Flags: flags, Body: e}).Bytes()
+}
+
+// ParseAck decodes a PUBACK, PUBREC, PUBREL or PUBCOMP packet
+func ParseAck(p *Packet, version byte) (*Ack, error) {
+	d := &decoder{b: p.Body}
+	a := &Ack{Type: p.Type}
+	a.PacketID = d.uint16()
+	if version >= V5 && !d.empty() {
+		a.ReasonCode = d.byte()
+		if !d.empty() {
+			a.Properties = decodeProperties(d)
+		}
+	}
+	return a, d.err
+}
+
+// Subscription is a topic filter and its options in a SUBSCRIBE packet
+type Subscription struct {
+	Filter  string
+	Options byte
+}
+
+// Subscribe is a SUBSCRIBE packet
+type Subscribe struct {
+	PacketID      uint16
+	Properties    Properties
+	Subscriptions []Subscription
+}
+
+// Encode returns the SUBSCRIBE packet bytes
+func (s *Subscribe) Encode(version byte) []byte {
+	var e encoder
+	e.uint16(s.PacketID)
+	if version >= V5 {
+		s.Properties.encode(&e)
+	}
+	for _, sub := range s.Subscriptions {
+		e.string(sub.Filter)
+		e.byte(sub.Options)
+	}
+	return (&Packet{Type: SUBSCRIBE, Flags: 0x02, Body: e}).Bytes()
+}
+
+// ParseSubscribe decodes a SUBSCRIBE packet
+func ParseSubscribe(p *Packet, version byte) (*Subscribe, error) {
+	d := &decoder{b: p.Body}
+	s := &Subscribe{}
+	s.PacketID = d.uint16()
+	if version >= V5 {
+		s.Properties = decodeProperties(d)
+	}
+	for !d.empty() && d.err == nil {
+		sub := Subscription{}
+		sub.Filter = d.string()
+		sub.Options = d.byte()
+		s.Subscriptions = append(s.Subscriptions, sub)
+	}
+	return s, d.err
+}
+
+// Unsubscribe is an UNSUBSCRIBE packet
+type Unsubscribe struct {
+	PacketID   uint16
+	Properties Properties
+	Filters    []string
+}
+
+// Encode returns the UNSUBSCRIBE packet bytes
+func (u *Unsubscribe) Encode(version byte) []byte {
+	var e encoder
+	e.uint16(u.PacketID)
+	if version >= V5 {
+		u.Properties.encode(&e)
+	}
+	for _, f := range u.Filters {
+		e.string(f)
+	}
+	return (&Packet{Type: UNSUBSCRIBE, Flags: 0x02, Body: e}).Bytes()
+}
+
+// ParseUnsubscribe decodes an UNSUBSCRIBE packet
+func ParseUnsubscribe(p *Packet, version byte) (*Unsubscribe, error) {
+	d := &decoder{b: p.Body}
+	u := &Unsubscribe{}
+	u.PacketID = d.uint16()
+	if version >= V5 {
+		u.Properties = decodeProperties(d)
+	}
+	for !d.empty() && d.err == nil {
+		u.Filters = append(u.Filters, d.string())
+	}
+	return u, d.err
+}
+
+// SubAck is a SUBACK or UNSUBACK packet. v3.1.1 UNSUBACKs have no
+// reason codes.
+type SubAck struct {
+	Type        byte
+	PacketID    uint16
+	Properties  Properties
+	ReasonCodes []byte
+}
+
+// Encode returns the SUBACK or UNSUBACK packet bytes
+func (s *SubAck) Encode(version byte) []byte {
+	var e encoder
+	e.uint16(s.PacketID)
+	if version >= V5 {
+		s.Properties.encode(&e)
+	}
+	if version >= V5 || s.Type == SUBACK {
+		e.raw(s.ReasonCodes)
+	}
+	return (&Packet{Type: s.Type, Body: e}).Bytes()
+}
+
+// ParseSubAck decodes a SUBACK or UNSUBACK packet
+func ParseSubAck(p *Packet, version byte) (*SubAck, error) {
+	d := &decoder{b: p.Body}
+	s := &SubAck{Type: p.Type}
+	s.PacketID = d.uint16()
+	if version >= V5 {
+		s.Properties = decodeProperties(d)
+	}
+	s.ReasonCodes = d.rest()
+	return s, d.err
+}
+
+// Disconnect is a DISCONNECT packet, or an AUTH packet when Type is AUTH
+type Disconnect struct {
+	Type       byte
+	ReasonCode byte
+	Properties Properties
+}
+
+// Encode returns the DISCONNECT or AUTH packet bytes
+func (d *Disconnect) Encode(version byte) []byte {
+	var e encoder
+	if version >= V5 && (d.ReasonCode != 0 || len(d.Properties) > 0) {
+		e.byte(d.ReasonCode)
+		if len(d.Properties) > 0 {
+			d.Properties.encode(&e)
+		}
+	}
+	t := d.Type
+	if t == 0 {
+		t = DISCONNECT
+	}
+	return (&Packet{Type: t, Body: e}).Bytes()
+}
+
+// ParseDisconnect decodes a DISCONNECT or AUTH packet
+func ParseDisconnect(p *Packet, version byte) (*Disconnect, error) {
+	d := &decoder{b: p.Body}
+	dis := &Disconnect{Type: p.Type}
+	if version >= V5 && !d.empty() {
+		dis.ReasonCode = d.byte()
+		if !d.empty() {
+			dis.Properties = decodeProperties(d)
+		}
+	}
+	return dis, d.err
+}
+
+// Simple returns the bytes of a packet without variable header,
+// such as PINGREQ and PINGRESP
+func Simple(t byte) []byte {
+	return (&Packet{Type: t}).Bytes()
+}
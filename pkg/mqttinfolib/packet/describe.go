@@ -0,0 +1,117 @@
+package packet
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Describe returns a one-line decoded form of a packet, for traces
+func Describe(p *Packet, version byte) string {
+	s, err := describe(p, version)
+	if err != nil {
+		return fmt.Sprintf("%v flags=0x%x (%v)", TypeName(p.Type), p.Flags, err)
+	}
+	return s
+}
+
+func describe(p *Packet, version byte) (string, error) {
+	name := TypeName(p.Type)
+
+	switch p.Type {
+	case CONNECT:
+		c, err := ParseConnect(p)
+		if err != nil {
+			return "", err
+		}
+		s := fmt.Sprintf("%v protocol=%q level=%v flags=0x%02x keepalive=%v client=%q%v",
+			name, c.ProtocolName, c.Level, c.Flags(), c.KeepAlive, c.ClientID, props(c.Properties))
+		if c.Will != nil {
+			s += fmt.Sprintf(" will={qos=%v retain=%v topic=%q payload=%v bytes%v}",
+				c.Will.QoS, c.Will.Retain, c.Will.Topic, len(c.Will.Payload), props(c.Will.Properties))
+		}
+		if c.HasUsername {
+			s += fmt.Sprintf(" user=%q", c.Username)
+		}
+		if c.HasPassword {
+			s += " password=<hidden>"
+		}
+		return s, nil
+
+	case CONNACK:
+		c, err := ParseConnack(p, version)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%v session=%v code=0x%02x%v",
+			name, c.SessionPresent, c.ReasonCode, props(c.Properties)), nil
+
+	case PUBLISH:
+		pub, err := ParsePublish(p, version)
+		if err != nil {
+			return "", err
+		}
+		s := fmt.Sprintf("%v dup=%v qos=%v retain=%v topic=%q", name, pub.Dup, pub.QoS, pub.Retain, pub.Topic)
+		if pub.QoS > 0 {
+			s += fmt.Sprintf(" id=%v", pub.PacketID)
+		}
+		return s + fmt.Sprintf("%v payload=%q", props(pub.Properties), pub.Payload), nil
+
+	case PUBACK, PUBREC, PUBREL, PUBCOMP:
+		a, err := ParseAck(p, version)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%v id=%v code=0x%02x%v", name, a.PacketID, a.ReasonCode, props(a.Properties)), nil
+
+	case SUBSCRIBE:
+		sub, err := ParseSubscribe(p, version)
+		if err != nil {
+			return "", err
+		}
+		filters := make([]string, len(sub.Subscriptions))
+		for i, s := range sub.Subscriptions {
+			filters[i] = fmt.Sprintf("%q:0x%02x", s.Filter, s.Options)
+		}
+		return fmt.Sprintf("%v id=%v%v filters=[%v]",
+			name, sub.PacketID, props(sub.Properties), strings.Join(filters, " ")), nil
+
+	case UNSUBSCRIBE:
+		u, err := ParseUnsubscribe(p, version)
+		if err != nil {
+			return "", err
+		}
+		filters := make([]string, len(u.Filters))
+		for i, f := range u.Filters {
+			filters[i] = fmt.Sprintf("%q", f)
+		}
+		return fmt.Sprintf("%v id=%v%v filters=[%v]",
+			name, u.PacketID, props(u.Properties), strings.Join(filters, " ")), nil
+
+	case SUBACK, UNSUBACK:
+		s, err := ParseSubAck(p, version)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%v id=%v%v codes=[% x]", name, s.PacketID, props(s.Properties), s.ReasonCodes), nil
+
+	case DISCONNECT, AUTH:
+		d, err := ParseDisconnect(p, version)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%v code=0x%02x%v", name, d.ReasonCode, props(d.Properties)), nil
+	}
+
+	return name, nil
+}
+
+func props(ps Properties) string {
+	if len(ps) == 0 {
+		return ""
+	}
+	s := make([]string, len(ps))
+	for i, p := range ps {
+		s[i] = p.String()
+	}
+	return " props=[" + strings.Join(s, ", ") + "]"
+}
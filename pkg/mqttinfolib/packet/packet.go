@@ -0,0 +1,274 @@
+// Package packet encodes and decodes MQTT control packets, for the
+// protocol versions probed by mqttinfo
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Control packet types
+const (
+	CONNECT     byte = 1
+	CONNACK     byte = 2
+	PUBLISH     byte = 3
+	PUBACK      byte = 4
+	PUBREC      byte = 5
+	PUBREL      byte = 6
+	PUBCOMP     byte = 7
+	SUBSCRIBE   byte = 8
+	SUBACK      byte = 9
+	UNSUBSCRIBE byte = 10
+	UNSUBACK    byte = 11
+	PINGREQ     byte = 12
+	PINGRESP    byte = 13
+	DISCONNECT  byte = 14
+	AUTH        byte = 15
+)
+
+// Protocol levels, as sent in CONNECT
+const (
+	V31  byte = 3
+	V311 byte = 4
+	V5   byte = 5
+)
+
+// ProtocolName returns the protocol name sent in CONNECT with a protocol
+// level, MQIsdp for v3.1
+func ProtocolName(level byte) string {
+	if level == V31 {
+		return "MQIsdp"
+	}
+	return "MQTT"
+}
+
+// MaxRemainingLength is the largest remaining length a packet can have
+const MaxRemainingLength = 268435455
+
+var typeNames = []string{
+	"RESERVED", "CONNECT", "CONNACK", "PUBLISH", "PUBACK", "PUBREC",
+	"PUBREL", "PUBCOMP", "SUBSCRIBE", "SUBACK", "UNSUBSCRIBE", "UNSUBACK",
+	"PINGREQ", "PINGRESP", "DISCONNECT", "AUTH",
+}
+
+// TypeName returns the name of a control packet type
+func TypeName(t byte) string {
+	if int(t) < len(typeNames) {
+		return typeNames[t]
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", t)
+}
+
+// ErrMalformed is returned when a packet cannot be decoded
+var ErrMalformed = errors.New("malformed packet")
+
+// Packet is a raw control packet: fixed header and remaining bytes
+type Packet struct {
+	Type  byte
+	Flags byte
+	Body  []byte
+}
+
+// Bytes returns the packet as sent on the wire
+func (p *Packet) Bytes() []byte {
+	out := []byte{p.Type<<4 | p.Flags&0x0f}
+	out = append(out, EncodeLength(len(p.Body))...)
+	return append(out, p.Body...)
+}
+
+// Read reads a single control packet from r
+func Read(r io.Reader) (*Packet, error) {
+	header := make([]byte, 1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	length := 0
+	multiplier := 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, ErrMalformed
+		}
+		digit := make([]byte, 1)
+		if _, err := io.ReadFull(r, digit); err != nil {
+			return nil, err
+		}
+		length += int(digit[0]&0x7f) * multiplier
+		multiplier *= 128
+		if digit[0]&0x80 == 0 {
+			break
+		}
+	}
+
+	// The body grows as it arrives, a peer announcing 256 MB doesn't
+	// get them allocated
+	body := bytes.NewBuffer(make([]byte, 0, min(length, readChunk)))
+	if _, err := io.CopyN(body, r, int64(length)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return &Packet{Type: header[0] >> 4, Flags: header[0] & 0x0f, Body: body.Bytes()}, nil
+}
+
+// readChunk is the most Read allocates for a body before it arrives
+const readChunk = 64 << 10
+
+// Parse decodes the first control packet of buf, and returns the number
+// of bytes it used, or 0 if buf doesn't hold a complete packet
+func Parse(buf []byte) (*Packet, int) {
+	if len(buf) < 2 {
+		return nil, 0
+	}
+	length, n, ok := decodeLength(buf[1:])
+	if !ok || len(buf) < 1+n+length {
+		return nil, 0
+	}
+	end := 1 + n + length
+	return &Packet{Type: buf[0] >> 4, Flags: buf[0] & 0x0f, Body: buf[1+n : end]}, end
+}
+
+// EncodeLength encodes a remaining length as a variable byte integer
+func EncodeLength(length int) []byte {
+	var encLength []byte
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		encLength = append(encLength, digit)
+		if length == 0 {
+			break
+		}
+	}
+	return encLength
+}
+
+func decodeLength(b []byte) (int, int, bool) {
+	length := 0
+	multiplier := 1
+	for i := 0; i < 4 && i < len(b); i++ {
+		length += int(b[i]&0x7f) * multiplier
+		multiplier *= 128
+		if b[i]&0x80 == 0 {
+			return length, i + 1, true
+		}
+	}
+	return 0, 0, false
+}
+
+// decoder consumes fields of a packet body, and remembers the first error
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = ErrMalformed
+	}
+	d.b = nil
+}
+
+func (d *decoder) byte() byte {
+	if len(d.b) < 1 {
+		d.fail()
+		return 0
+	}
+	v := d.b[0]
+	d.b = d.b[1:]
+	return v
+}
+
+func (d *decoder) uint16() uint16 {
+	if len(d.b) < 2 {
+		d.fail()
+		return 0
+	}
+	v := binary.BigEndian.Uint16(d.b)
+	d.b = d.b[2:]
+	return v
+}
+
+func (d *decoder) uint32() uint32 {
+	if len(d.b) < 4 {
+		d.fail()
+		return 0
+	}
+	v := binary.BigEndian.Uint32(d.b)
+	d.b = d.b[4:]
+	return v
+}
+
+func (d *decoder) varint() uint32 {
+	v, n, ok := decodeLength(d.b)
+	if !ok {
+		d.fail()
+		return 0
+	}
+	d.b = d.b[n:]
+	return uint32(v)
+}
+
+func (d *decoder) binary() []byte {
+	n := int(d.uint16())
+	if len(d.b) < n {
+		d.fail()
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	return string(d.binary())
+}
+
+func (d *decoder) rest() []byte {
+	v := d.b
+	d.b = nil
+	return v
+}
+
+func (d *decoder) empty() bool {
+	return len(d.b) == 0
+}
+
+// encoder builds a packet body
+type encoder []byte
+
+func (e *encoder) byte(v byte) {
+	*e = append(*e, v)
+}
+
+func (e *encoder) uint16(v uint16) {
+	*e = append(*e, byte(v>>8), byte(v))
+}
+
+func (e *encoder) uint32(v uint32) {
+	*e = append(*e, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (e *encoder) varint(v uint32) {
+	*e = append(*e, EncodeLength(int(v))...)
+}
+
+func (e *encoder) binary(v []byte) {
+	e.uint16(uint16(len(v)))
+	*e = append(*e, v...)
+}
+
+func (e *encoder) string(v string) {
+	e.binary([]byte(v))
+}
+
+func (e *encoder) raw(v []byte) {
+	*e = append(*e, v...)
+}
@@ -0,0 +1,356 @@
+package packet
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+// allKinds holds a property of each value kind
+var allKinds = Properties{
+	IntProperty(PropPayloadFormat, 1),
+	IntProperty(PropTopicAlias, 0xbeef),
+	IntProperty(PropMessageExpiry, 0xdeadbeef),
+	IntProperty(PropSubscriptionID, MaxRemainingLength),
+	StringProperty(PropContentType, "text/plain"),
+	StringProperty(PropCorrelationData, "\x00\xff"),
+	UserProperty("key", "value"),
+}
+
+func TestRoundTrip(t *testing.T) {
+	will := &Will{QoS: 1, Retain: true, Topic: "will", Payload: []byte("gone")}
+	willV5 := &Will{QoS: 2, Properties: Properties{IntProperty(PropWillDelay, 5)}, Topic: "will", Payload: []byte("gone")}
+
+	tests := []struct {
+		name  string
+		raw   []byte
+		parse func(p *Packet) (interface{}, error)
+		want  interface{}
+	}{
+		{
+			"connect v3.1",
+			(&Connect{ProtocolName: "MQIsdp", Level: V31, CleanStart: true, KeepAlive: 60, ClientID: "id"}).Encode(),
+			func(p *Packet) (interface{}, error) { return ParseConnect(p) },
+			&Connect{ProtocolName: "MQIsdp", Level: V31, CleanStart: true, KeepAlive: 60, ClientID: "id"},
+		},
+		{
+			"connect v3.1.1 with will and credentials",
+			(&Connect{ProtocolName: "MQTT", Level: V311, KeepAlive: 10, ClientID: "id", Will: will,
+				HasUsername: true, Username: "user", HasPassword: true, Password: []byte("pwd")}).Encode(),
+			func(p *Packet) (interface{}, error) { return ParseConnect(p) },
+			&Connect{ProtocolName: "MQTT", Level: V311, KeepAlive: 10, ClientID: "id", Will: will,
+				HasUsername: true, Username: "user", HasPassword: true, Password: []byte("pwd")},
+		},
+		{
+			"connect v5.0",
+			(&Connect{ProtocolName: "MQTT", Level: V5, CleanStart: true, Properties: allKinds, ClientID: "id", Will: willV5}).Encode(),
+			func(p *Packet) (interface{}, error) { return ParseConnect(p) },
+			&Connect{ProtocolName: "MQTT", Level: V5, CleanStart: true, Properties: allKinds, ClientID: "id", Will: willV5},
+		},
+		{
+			"connack v3.1.1",
+			(&Connack{SessionPresent: true, ReasonCode: 5}).Encode(V311),
+			func(p *Packet) (interface{}, error) { return ParseConnack(p, V311) },
+			&Connack{SessionPresent: true, ReasonCode: 5},
+		},
+		{
+			"connack v5.0",
+			(&Connack{ReasonCode: 0x87, Properties: allKinds}).Encode(V5),
+			func(p *Packet) (interface{}, error) { return ParseConnack(p, V5) },
+			&Connack{ReasonCode: 0x87, Properties: allKinds},
+		},
+		{
+			"publish v3.1.1 QoS 0",
+			(&Publish{Retain: true, Topic: "a/b", Payload: []byte("x")}).Encode(V311),
+			func(p *Packet) (interface{}, error) { return ParsePublish(p, V311) },
+			&Publish{Retain: true, Topic: "a/b", Payload: []byte("x")},
+		},
+		{
+			"publish v3.1.1 QoS 2 dup",
+			(&Publish{Dup: true, QoS: 2, Topic: "a/b", PacketID: 7, Payload: []byte("x")}).Encode(V311),
+			func(p *Packet) (interface{}, error) { return ParsePublish(p, V311) },
+			&Publish{Dup: true, QoS: 2, Topic: "a/b", PacketID: 7, Payload: []byte("x")},
+		},
+		{
+			"publish v5.0",
+			(&Publish{QoS: 1, Topic: "a/b", PacketID: 7, Properties: allKinds, Payload: []byte("x")}).Encode(V5),
+			func(p *Packet) (interface{}, error) { return ParsePublish(p, V5) },
+			&Publish{QoS: 1, Topic: "a/b", PacketID: 7, Properties: allKinds, Payload: []byte("x")},
+		},
+		{
+			"puback v3.1.1",
+			(&Ack{Type: PUBACK, PacketID: 7}).Encode(V311),
+			func(p *Packet) (interface{}, error) { return ParseAck(p, V311) },
+			&Ack{Type: PUBACK, PacketID: 7},
+		},
+		{
+			"pubrec v5.0 with reason",
+			(&Ack{Type: PUBREC, PacketID: 7, ReasonCode: 0x10}).Encode(V5),
+			func(p *Packet) (interface{}, error) { return ParseAck(p, V5) },
+			&Ack{Type: PUBREC, PacketID: 7, ReasonCode: 0x10},
+		},
+		{
+			"pubrel v5.0 with properties",
+			(&Ack{Type: PUBREL, PacketID: 7, ReasonCode: 0x92, Properties: allKinds}).Encode(V5),
+			func(p *Packet) (interface{}, error) { return ParseAck(p, V5) },
+			&Ack{Type: PUBREL, PacketID: 7, ReasonCode: 0x92, Properties: allKinds},
+		},
+		{
+			"pubcomp v5.0",
+			(&Ack{Type: PUBCOMP, PacketID: 7}).Encode(V5),
+			func(p *Packet) (interface{}, error) { return ParseAck(p, V5) },
+			&Ack{Type: PUBCOMP, PacketID: 7},
+		},
+		{
+			"subscribe v3.1.1",
+			(&Subscribe{PacketID: 1, Subscriptions: []Subscription{{"a/#", 1}, {"b/+", 2}}}).Encode(V311),
+			func(p *Packet) (interface{}, error) { return ParseSubscribe(p, V311) },
+			&Subscribe{PacketID: 1, Subscriptions: []Subscription{{"a/#", 1}, {"b/+", 2}}},
+		},
+		{
+			"subscribe v5.0",
+			(&Subscribe{PacketID: 1, Properties: allKinds,
+				Subscriptions: []Subscription{{"a", 1 | NoLocal | RetainAsPublished | RetainHandling(2)}}}).Encode(V5),
+			func(p *Packet) (interface{}, error) { return ParseSubscribe(p, V5) },
+			&Subscribe{PacketID: 1, Properties: allKinds,
+				Subscriptions: []Subscription{{"a", 1 | NoLocal | RetainAsPublished | RetainHandling(2)}}},
+		},
+		{
+			"suback v3.1.1",
+			(&SubAck{Type: SUBACK, PacketID: 1, ReasonCodes: []byte{0, 0x80}}).Encode(V311),
+			func(p *Packet) (interface{}, error) { return ParseSubAck(p, V311) },
+			&SubAck{Type: SUBACK, PacketID: 1, ReasonCodes: []byte{0, 0x80}},
+		},
+		{
+			"unsubscribe v5.0",
+			(&Unsubscribe{PacketID: 2, Properties: allKinds, Filters: []string{"a", "b/#"}}).Encode(V5),
+			func(p *Packet) (interface{}, error) { return ParseUnsubscribe(p, V5) },
+			&Unsubscribe{PacketID: 2, Properties: allKinds, Filters: []string{"a", "b/#"}},
+		},
+		{
+			"unsuback v3.1.1",
+			(&SubAck{Type: UNSUBACK, PacketID: 2}).Encode(V311),
+			func(p *Packet) (interface{}, error) { return ParseSubAck(p, V311) },
+			&SubAck{Type: UNSUBACK, PacketID: 2, ReasonCodes: []byte{}},
+		},
+		{
+			"unsuback v5.0",
+			(&SubAck{Type: UNSUBACK, PacketID: 2, Properties: allKinds, ReasonCodes: []byte{0x11}}).Encode(V5),
+			func(p *Packet) (interface{}, error) { return ParseSubAck(p, V5) },
+			&SubAck{Type: UNSUBACK, PacketID: 2, Properties: allKinds, ReasonCodes: []byte{0x11}},
+		},
+		{
+			"disconnect v3.1.1",
+			(&Disconnect{}).Encode(V311),
+			func(p *Packet) (interface{}, error) { return ParseDisconnect(p, V311) },
+			&Disconnect{Type: DISCONNECT},
+		},
+		{
+			"disconnect v5.0",
+			(&Disconnect{ReasonCode: 0x8d, Properties: allKinds}).Encode(V5),
+			func(p *Packet) (interface{}, error) { return ParseDisconnect(p, V5) },
+			&Disconnect{Type: DISCONNECT, ReasonCode: 0x8d, Properties: allKinds},
+		},
+		{
+			"auth",
+			(&Disconnect{Type: AUTH, ReasonCode: 0x18, Properties: Properties{StringProperty(PropAuthMethod, "SCRAM-SHA-1")}}).Encode(V5),
+			func(p *Packet) (interface{}, error) { return ParseDisconnect(p, V5) },
+			&Disconnect{Type: AUTH, ReasonCode: 0x18, Properties: Properties{StringProperty(PropAuthMethod, "SCRAM-SHA-1")}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := Read(bytes.NewReader(tt.raw))
+			if err != nil {
+				t.Fatalf("Read() error = %v", err)
+			}
+			if !bytes.Equal(p.Bytes(), tt.raw) {
+				t.Errorf("Bytes() = %x, want %x", p.Bytes(), tt.raw)
+			}
+			parsed, n := Parse(tt.raw)
+			if n != len(tt.raw) || !reflect.DeepEqual(parsed, p) {
+				t.Errorf("Parse() = %+v, %v, want %+v, %v", parsed, n, p, len(tt.raw))
+			}
+
+			got, err := tt.parse(p)
+			if err != nil {
+				t.Fatalf("parse error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsed %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSimple(t *testing.T) {
+	for _, typ := range []byte{PINGREQ, PINGRESP} {
+		p, err := Read(bytes.NewReader(Simple(typ)))
+		if err != nil || p.Type != typ || len(p.Body) != 0 {
+			t.Errorf("Read(Simple(%v)) = %+v, %v", TypeName(typ), p, err)
+		}
+	}
+}
+
+func TestLength(t *testing.T) {
+	tests := []struct {
+		length int
+		want   []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+		{MaxRemainingLength, []byte{0xff, 0xff, 0xff, 0x7f}},
+	}
+
+	for _, tt := range tests {
+		got := EncodeLength(tt.length)
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("EncodeLength(%v) = %x, want %x", tt.length, got, tt.want)
+		}
+		if length, n, ok := decodeLength(got); !ok || length != tt.length || n != len(got) {
+			t.Errorf("decodeLength(%x) = %v, %v, %v", got, length, n, ok)
+		}
+	}
+}
+
+func TestReadMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []byte
+		want error
+	}{
+		{"empty", nil, io.EOF},
+		{"no length", []byte{0x30}, io.EOF},
+		{"length over 4 bytes", []byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01}, ErrMalformed},
+		{"truncated length", []byte{0x30, 0x80}, io.EOF},
+		{"truncated body", []byte{0x30, 0x05, 0x00, 0x01}, io.ErrUnexpectedEOF},
+		// Announces 256 MB
+		{"huge length", []byte{0x30, 0xff, 0xff, 0xff, 0x7f, 0x00}, io.ErrUnexpectedEOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := Read(bytes.NewReader(tt.raw))
+			if err != tt.want {
+				t.Errorf("Read() = %+v, %v, want error %v", p, err, tt.want)
+			}
+			if p, n := Parse(tt.raw); p != nil || n != 0 {
+				t.Errorf("Parse() = %+v, %v, want nil, 0", p, n)
+			}
+		})
+	}
+}
+
+func TestReadAllocation(t *testing.T) {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	Read(bytes.NewReader([]byte{0x30, 0xff, 0xff, 0xff, 0x7f, 0x00}))
+	runtime.ReadMemStats(&after)
+
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1<<20 {
+		t.Errorf("Read() of a 256 MB announce allocated %v bytes", alloc)
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		raw   []byte
+		parse func(p *Packet) (interface{}, error)
+	}{
+		{
+			"connect string past the end",
+			[]byte{0x10, 0x04, 0x00, 0x04, 'M', 'Q'},
+			func(p *Packet) (interface{}, error) { return ParseConnect(p) },
+		},
+		{
+			"connect without client ID",
+			[]byte{0x10, 0x0a, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x02, 0x00, 0x3c},
+			func(p *Packet) (interface{}, error) { return ParseConnect(p) },
+		},
+		{
+			"connect will without payload",
+			[]byte{0x10, 0x0f, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x06, 0x00, 0x3c, 0x00, 0x00, 0x00, 0x01, 'w'},
+			func(p *Packet) (interface{}, error) { return ParseConnect(p) },
+		},
+		{
+			"connack too short",
+			[]byte{0x20, 0x01, 0x00},
+			func(p *Packet) (interface{}, error) { return ParseConnack(p, V311) },
+		},
+		{
+			"properties past the end",
+			[]byte{0x20, 0x03, 0x00, 0x00, 0x05},
+			func(p *Packet) (interface{}, error) { return ParseConnack(p, V5) },
+		},
+		{
+			"unknown property",
+			[]byte{0x20, 0x05, 0x00, 0x00, 0x02, 0x7f, 0x00},
+			func(p *Packet) (interface{}, error) { return ParseConnack(p, V5) },
+		},
+		{
+			"truncated property value",
+			[]byte{0x20, 0x05, 0x00, 0x00, 0x02, PropReceiveMaximum, 0x00},
+			func(p *Packet) (interface{}, error) { return ParseConnack(p, V5) },
+		},
+		{
+			"variable byte integer over 4 bytes",
+			[]byte{0x20, 0x08, 0x00, 0x00, 0x05, PropSubscriptionID, 0xff, 0xff, 0xff, 0xff},
+			func(p *Packet) (interface{}, error) { return ParseConnack(p, V5) },
+		},
+		{
+			"publish without packet ID",
+			[]byte{0x32, 0x03, 0x00, 0x01, 'a'},
+			func(p *Packet) (interface{}, error) { return ParsePublish(p, V311) },
+		},
+		{
+			"publish without properties",
+			[]byte{0x30, 0x03, 0x00, 0x01, 'a'},
+			func(p *Packet) (interface{}, error) { return ParsePublish(p, V5) },
+		},
+		{
+			"puback too short",
+			[]byte{0x40, 0x01, 0x00},
+			func(p *Packet) (interface{}, error) { return ParseAck(p, V311) },
+		},
+		{
+			"subscribe without options",
+			[]byte{0x82, 0x05, 0x00, 0x01, 0x00, 0x01, 'a'},
+			func(p *Packet) (interface{}, error) { return ParseSubscribe(p, V311) },
+		},
+		{
+			"unsubscribe filter past the end",
+			[]byte{0xa2, 0x04, 0x00, 0x01, 0x00, 0x05},
+			func(p *Packet) (interface{}, error) { return ParseUnsubscribe(p, V311) },
+		},
+		{
+			"suback without properties",
+			[]byte{0x90, 0x02, 0x00, 0x01},
+			func(p *Packet) (interface{}, error) { return ParseSubAck(p, V5) },
+		},
+		{
+			"disconnect properties past the end",
+			[]byte{0xe0, 0x02, 0x8d, 0x03},
+			func(p *Packet) (interface{}, error) { return ParseDisconnect(p, V5) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := Read(bytes.NewReader(tt.raw))
+			if err != nil {
+				t.Fatalf("Read() error = %v", err)
+			}
+			if got, err := tt.parse(p); err != ErrMalformed {
+				t.Errorf("parse = %+v, %v, want %v", got, err, ErrMalformed)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package packet
+
+import "fmt"
+
+// Property identifiers (v5.0 only)
+const (
+	PropPayloadFormat           byte = 0x01
+	PropMessageExpiry           byte = 0x02
+	PropContentType             byte = 0x03
+	PropResponseTopic           byte = 0x08
+	PropCorrelationData         byte = 0x09
+	PropSubscriptionID          byte = 0x0b
+	PropSessionExpiry           byte = 0x11
+	PropAssignedClientID        byte = 0x12
+	PropServerKeepAlive         byte = 0x13
+	PropAuthMethod              byte = 0x15
+	PropAuthData                byte = 0x16
+	PropRequestProblemInfo      byte = 0x17
+	PropWillDelay               byte = 0x18
+	PropRequestResponseInfo     byte = 0x19
+	PropResponseInfo            byte = 0x1a
+	PropServerReference         byte = 0x1c
+	PropReasonString            byte = 0x1f
+	PropReceiveMaximum          byte = 0x21
+	PropTopicAliasMaximum       byte = 0x22
+	PropTopicAlias              byte = 0x23
+	PropMaximumQoS              byte = 0x24
+	PropRetainAvailable         byte = 0x25
+	PropUserProperty            byte = 0x26
+	PropMaximumPacketSize       byte = 0x27
+	PropWildcardSubAvailable    byte = 0x28
+	PropSubscriptionIDAvailable byte = 0x29
+	PropSharedSubAvailable      byte = 0x2a
+)
+
+// value kinds of the properties
+const (
+	kindByte = iota
+	kindUint16
+	kindUint32
+	kindVarint
+	kindString
+	kindBinary
+	kindPair
+)
+
+type propertyInfo struct {
+	name string
+	kind int
+}
+
+var propertyInfos = map[byte]propertyInfo{
+	PropPayloadFormat:           {"Payload Format Indicator", kindByte},
+	PropMessageExpiry:           {"Message Expiry Interval", kindUint32},
+	PropContentType:             {"Content Type", kindString},
+	PropResponseTopic:           {"Response Topic", kindString},
+	PropCorrelationData:         {"Correlation Data", kindBinary},
+	PropSubscriptionID:          {"Subscription Identifier", kindVarint},
+	PropSessionExpiry:           {"Session Expiry Interval", kindUint32},
+	PropAssignedClientID:        {"Assigned Client Identifier", kindString},
+	PropServerKeepAlive:         {"Server Keep Alive", kindUint16},
+	PropAuthMethod:              {"Authentication Method", kindString},
+	PropAuthData:                {"Authentication Data", kindBinary},
+	PropRequestProblemInfo:      {"Request Problem Information", kindByte},
+	PropWillDelay:               {"Will Delay Interval", kindUint32},
+	PropRequestResponseInfo:     {"Request Response Information", kindByte},
+	PropResponseInfo:            {"Response Information", kindString},
+	PropServerReference:         {"Server Reference", kindString},
+	PropReasonString:            {"Reason String", kindString},
+	PropReceiveMaximum:          {"Receive Maximum", kindUint16},
+	PropTopicAliasMaximum:       {"Topic Alias Maximum", kindUint16},
+	PropTopicAlias:              {"Topic Alias", kindUint16},
+	PropMaximumQoS:              {"Maximum QoS", kindByte},
+	PropRetainAvailable:         {"Retain Available", kindByte},
+	PropUserProperty:            {"User Property", kindPair},
+	PropMaximumPacketSize:       {"Maximum Packet Size", kindUint32},
+	PropWildcardSubAvailable:    {"Wildcard Subscription Available", kindByte},
+	PropSubscriptionIDAvailable: {"Subscription Identifier Available", kindByte},
+	PropSharedSubAvailable:      {"Shared Subscription Available", kindByte},
+}
+
+// PropertyName returns the name of a property identifier
+func PropertyName(id byte) string {
+	if info, ok := propertyInfos[id]; ok {
+		return info.name
+	}
+	return fmt.Sprintf("Unknown(0x%02x)", id)
+}
+
+// Property is a single v5.0 property. Integer properties use Value,
+// string and binary properties use Data, user properties use Key and Data.
+type Property struct {
+	ID    byte
+	Value uint32
+	Key   string
+	Data  []byte
+}
+
+// String returns a readable form of the property
+func (p Property) String() string {
+	info, ok := propertyInfos[p.ID]
+	if !ok {
+		return PropertyName(p.ID)
+	}
+	switch info.kind {
+	case kindString:
+		return fmt.Sprintf("%s=%q", info.name, p.Data)
+	case kindBinary:
+		return fmt.Sprintf("%s=%x", info.name, p.Data)
+	case kindPair:
+		return fmt.Sprintf("%s=%q:%q", info.name, p.Key, p.Data)
+	default:
+		return fmt.Sprintf("%s=%d", info.name, p.Value)
+	}
+}
+
+// Properties is an ordered list of properties
+type Properties []Property
+
+// IntProperty returns an integer property
+func IntProperty(id byte, v uint32) Property {
+	return Property{ID: id, Value: v}
+}
+
+// StringProperty returns a string or binary property
+func StringProperty(id byte, v string) Property {
+	return Property{ID: id, Data: []byte(v)}
+}
+
+// UserProperty returns a user property
+func UserProperty(key, value string) Property {
+	return Property{ID: PropUserProperty, Key: key, Data: []byte(value)}
+}
+
+// Get returns the first property with the given identifier
+func (ps Properties) Get(id byte) (Property, bool) {
+	for _, p := range ps {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return Property{}, false
+}
+
+// Int returns the value of an integer property
+func (ps Properties) Int(id byte) (uint32, bool) {
+	p, ok := ps.Get(id)
+	return p.Value, ok
+}
+
+// Str returns the value of a string or binary property
+func (ps Properties) Str(id byte) (string, bool) {
+	p, ok := ps.Get(id)
+	return string(p.Data), ok
+}
+
+func (ps Properties) encode(e *encoder) {
+	var body encoder
+	for _, p := range ps {
+		body.varint(uint32(p.ID))
+		switch propertyInfos[p.ID].kind {
+		case kindByte:
+			body.byte(byte(p.Value))
+		case kindUint16:
+			body.uint16(uint16(p.Value))
+		case kindUint32:
+			body.uint32(p.Value)
+		case kindVarint:
+			body.varint(p.Value)
+		case kindString, kindBinary:
+			body.binary(p.Data)
+		case kindPair:
+			body.string(p.Key)
+			body.binary(p.Data)
+		}
+	}
+	e.varint(uint32(len(body)))
+	e.raw(body)
+}
+
+func decodeProperties(d *decoder) Properties {
+	n := int(d.varint())
+	if d.err != nil {
+		return nil
+	}
+	if len(d.b) < n {
+		d.fail()
+		return nil
+	}
+	pd := &decoder{b: d.b[:n]}
+	d.b = d.b[n:]
+
+	var ps Properties
+	for !pd.empty() && pd.err == nil {
+		p := Property{ID: byte(pd.varint())}
+		info, ok := propertyInfos[p.ID]
+		if !ok {
+			d.fail()
+			return ps
+		}
+		switch info.kind {
+		case kindByte:
+			p.Value = uint32(pd.byte())
+		case kindUint16:
+			p.Value = uint32(pd.uint16())
+		case kindUint32:
+			p.Value = pd.uint32()
+		case kindVarint:
+			p.Value = pd.varint()
+		case kindString, kindBinary:
+			p.Data = pd.binary()
+		case kindPair:
+			p.Key = pd.string()
+			p.Data = pd.binary()
+		}
+		ps = append(ps, p)
+	}
+	if pd.err != nil {
+		d.fail()
+	}
+	return ps
+}
@@ -0,0 +1,278 @@
+package mqttinfo
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+// Ways a broker refuses a packet, such as a PUBLISH that is too large
+const (
+	// DISCONNECT with a reason code, 0x95 Packet too large in v5.0
+	RefusalDisconnect = "disconnect"
+	// Connection closed without DISCONNECT
+	RefusalClose = "close"
+	// PUBACK, PUBREC or UNSUBACK with an error reason code
+	RefusalAck = "ack"
+	// No acknowledgement, or a PUBACK but no delivery to the subscriber
+	RefusalDrop = "drop"
+)
+
+// PacketSizeInfo holds the results of the maximum packet size check
+type PacketSizeInfo struct {
+	// Largest PUBLISH delivered, in bytes, 0 if even the smallest was
+	// refused. CapReached if the largest tried was delivered.
+	Largest    int
+	CapReached bool
+
+	// Smallest PUBLISH refused, how, and the reason code of the PUBACK
+	// or DISCONNECT, if any
+	Refused       int
+	Refusal       string
+	RefusalReason byte
+
+	// Maximum Packet Size in the v5.0 CONNACK, 0 if absent, and whether
+	// it matches the sizes delivered and refused
+	Advertised        uint32
+	AdvertisedMatches bool
+}
+
+// defaultPacketSizeCap is the largest PUBLISH tried if PacketSizeCap is
+// zero, in bytes
+const defaultPacketSizeCap = 1 << 20
+
+func (b *BrokerInfo) packetSizeCap() int {
+	if b.PacketSizeCap > 0 {
+		return b.PacketSizeCap
+	}
+	return defaultPacketSizeCap
+}
+
+// sizedPublish returns a QoS 1 message encoded in at most size bytes,
+// as close as the remaining length encoding allows, whose payload starts
+// with mark. It returns nil if size is too small for mark.
+func sizedPublish(version byte, topic string, mark []byte, size int) *packet.Publish {
+	pub := &packet.Publish{Topic: topic, QoS: 1, PacketID: 1}
+	// Everything but the payload, after the fixed header
+	body := len(pub.Encode(version)) - 2
+	for n := size - 2 - body; n >= len(mark); n-- {
+		if 1+len(packet.EncodeLength(body+n))+body+n <= size {
+			payload := make([]byte, n)
+			copy(payload, mark)
+			for i := len(mark); i < n; i++ {
+				payload[i] = 'x'
+			}
+			pub.PacketID = 0
+			pub.Payload = payload
+			return pub
+		}
+	}
+	return nil
+}
+
+// publishProbe publishes messages, and watches a subscriber for their
+// delivery
+type publishProbe struct {
+	b        *BrokerInfo
+	version  byte
+	wait     time.Duration
+	sub      *Client
+	pub      *Client
+	attempts int
+}
+
+// newPublishProbe returns a probe whose subscriber is subscribed to filter
+func (b *BrokerInfo) newPublishProbe(version byte, filter string) (*publishProbe, error) {
+	sub, err := b.NewClient(version)
+	if err != nil {
+		return nil, err
+	}
+	if err = sub.subscribeOK(nil, packet.Subscription{Filter: filter, Options: 1}); err != nil {
+		sub.Close()
+		return nil, err
+	}
+	return &publishProbe{b: b, version: version, wait: b.quiet(), sub: sub}, nil
+}
+
+// mark returns a payload distinct from the previous ones, so that a late
+// delivery isn't mistaken for another one
+func (p *publishProbe) mark() []byte {
+	p.attempts++
+	return []byte(fmt.Sprintf("mqttinfo probe %v ", p.attempts))
+}
+
+// publisher returns the publishing client, connected again if the broker
+// closed it
+func (p *publishProbe) publisher() (*Client, error) {
+	if p.pub == nil {
+		c, err := p.b.NewClient(p.version)
+		if err != nil {
+			return nil, err
+		}
+		p.pub = c
+	}
+	return p.pub, nil
+}
+
+// drop closes the publishing client after the broker refused a packet
+func (p *publishProbe) drop() {
+	p.pub.abort()
+	p.pub = nil
+}
+
+// try publishes a message, and returns how it was refused, or "" if it
+// was delivered
+func (p *publishProbe) try(pub *packet.Publish) (string, byte, error) {
+	_, refusal, code, err := p.deliver(pub)
+	return refusal, code, err
+}
+
+// deliver publishes a message, and returns it as the subscriber received
+// it, or how it was refused
+func (p *publishProbe) deliver(pub *packet.Publish) (*packet.Publish, string, byte, error) {
+	c, err := p.publisher()
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	ack, err := c.publish(pub)
+	if err != nil {
+		p.drop()
+		p.b.logf(LevelDebug, "%v", err)
+		switch {
+		case c.Disconnect != nil:
+			return nil, RefusalDisconnect, c.Disconnect.ReasonCode, nil
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			return nil, RefusalDrop, 0, nil
+		}
+		return nil, RefusalClose, 0, nil
+	}
+	if ack != nil && ack.ReasonCode >= 0x80 {
+		return nil, RefusalAck, ack.ReasonCode, nil
+	}
+
+	received, err := p.sub.receivePayload(pub.Payload, p.wait)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	if received == nil {
+		return nil, RefusalDrop, 0, nil
+	}
+	return received, "", 0, nil
+}
+
+func (p *publishProbe) close() {
+	p.sub.Close()
+	if p.pub != nil {
+		p.pub.Close()
+	}
+}
+
+// CheckPacketSizeV3 finds the largest PUBLISH accepted in v3.1
+func (b *BrokerInfo) CheckPacketSizeV3() error {
+	return b.checkPacketSize(packet.V31, &b.V3PacketSize)
+}
+
+// CheckPacketSizeV4 finds the largest PUBLISH accepted in v3.1.1
+func (b *BrokerInfo) CheckPacketSizeV4() error {
+	return b.checkPacketSize(packet.V311, &b.V4PacketSize)
+}
+
+// CheckPacketSizeV5 finds the largest PUBLISH accepted in v5.0, and
+// compares it with the Maximum Packet Size advertised
+func (b *BrokerInfo) CheckPacketSizeV5() error {
+	return b.checkPacketSize(packet.V5, &b.V5PacketSize)
+}
+
+// checkPacketSize binary searches the size of the largest message
+// delivered, between the smallest message and PacketSizeCap
+func (b *BrokerInfo) checkPacketSize(version byte, s *PacketSizeInfo) error {
+
+	name := versionName(version)
+	topic := b.probeTopic("packetsize")
+	*s = PacketSizeInfo{}
+
+	p, err := b.newPublishProbe(version, topic)
+	if err != nil {
+		return err
+	}
+	defer p.close()
+	if version == packet.V5 {
+		s.Advertised, _ = p.sub.Connack.Properties.Int(packet.PropMaximumPacketSize)
+	}
+	defer func() {
+		s.AdvertisedMatches = advertisedMatches(s)
+	}()
+
+	// Room for the payload marks
+	empty := &packet.Publish{Topic: topic, QoS: 1, PacketID: 1}
+	smallest := len(empty.Encode(version)) + 32
+	largest := b.packetSizeCap()
+	if largest < smallest {
+		return fmt.Errorf("packet size cap %v below the smallest PUBLISH tried, %v bytes", largest, smallest)
+	}
+
+	refused := func(size int, refusal string, code byte) {
+		s.Refused, s.Refusal, s.RefusalReason = size, refusal, code
+	}
+	try := func(size int) (string, byte, error) {
+		b.logf(LevelDebug, "publishing %v bytes", size)
+		return p.try(sizedPublish(version, topic, p.mark(), size))
+	}
+
+	b.beginCheck(fmt.Sprintf("%v packet size %v", name, largest))
+	refusal, code, err := try(largest)
+	if err != nil {
+		return err
+	}
+	if refusal == "" {
+		s.Largest, s.CapReached = largest, true
+		return nil
+	}
+	refused(largest, refusal, code)
+
+	b.beginCheck(fmt.Sprintf("%v packet size %v", name, smallest))
+	refusal, code, err = try(smallest)
+	if err != nil {
+		return err
+	}
+	if refusal != "" {
+		refused(smallest, refusal, code)
+		return nil
+	}
+
+	// Delivered at lo, refused at hi
+	b.beginCheck(name + " packet size search")
+	lo, hi := smallest, largest
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		refusal, code, err = try(mid)
+		if err != nil {
+			return err
+		}
+		if refusal == "" {
+			lo = mid
+		} else {
+			hi = mid
+			refused(mid, refusal, code)
+		}
+	}
+	s.Largest = lo
+	b.logf(LevelDebug, "largest PUBLISH %v bytes, refused at %v (%v)", s.Largest, s.Refused, s.Refusal)
+
+	return nil
+}
+
+// advertisedMatches tells whether a Maximum Packet Size lets through the
+// largest size delivered and stops the smallest refused. Without one,
+// there must be no limit below the cap.
+func advertisedMatches(s *PacketSizeInfo) bool {
+	if s.Advertised == 0 {
+		return s.CapReached
+	}
+	a := int(s.Advertised)
+	return a >= s.Largest && (s.CapReached || a < s.Refused)
+}
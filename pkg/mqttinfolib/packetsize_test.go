@@ -0,0 +1,77 @@
+package mqttinfo
+
+import (
+	"testing"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/fakebroker"
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+func TestCheckPacketSize(t *testing.T) {
+	const limit = 1000
+
+	limited := func(refusal string, advertised uint32) fakebroker.Behavior {
+		bh := fakebroker.Mosquitto()
+		bh.MaxPacketSize = limit
+		bh.OversizeRefusal = refusal
+		if advertised > 0 {
+			bh.ConnackProperties = append(packet.Properties{
+				packet.IntProperty(packet.PropMaximumPacketSize, advertised),
+			}, bh.ConnackProperties...)
+		}
+		return bh
+	}
+
+	tests := []struct {
+		name     string
+		behavior fakebroker.Behavior
+		version  byte
+		want     PacketSizeInfo
+	}{
+		{"unlimited", fakebroker.Mosquitto(), packet.V5, PacketSizeInfo{
+			Largest: 4096, CapReached: true, AdvertisedMatches: true,
+		}},
+		{"advertised", limited("", limit), packet.V5, PacketSizeInfo{
+			Largest: limit, Refused: limit + 1, Refusal: RefusalDisconnect, RefusalReason: 0x95,
+			Advertised: limit, AdvertisedMatches: true,
+		}},
+		{"not advertised", limited("", 0), packet.V5, PacketSizeInfo{
+			Largest: limit, Refused: limit + 1, Refusal: RefusalDisconnect, RefusalReason: 0x95,
+		}},
+		{"advertised too large", limited("", 2*limit), packet.V5, PacketSizeInfo{
+			Largest: limit, Refused: limit + 1, Refusal: RefusalDisconnect, RefusalReason: 0x95,
+			Advertised: 2 * limit,
+		}},
+		{"closed", limited(fakebroker.OversizeClose, limit), packet.V5, PacketSizeInfo{
+			Largest: limit, Refused: limit + 1, Refusal: RefusalClose,
+			Advertised: limit, AdvertisedMatches: true,
+		}},
+		{"dropped", limited(fakebroker.OversizeDrop, limit), packet.V5, PacketSizeInfo{
+			Largest: limit, Refused: limit + 1, Refusal: RefusalDrop,
+			Advertised: limit, AdvertisedMatches: true,
+		}},
+		{"v3.1.1", limited("", 0), packet.V311, PacketSizeInfo{
+			Largest: limit, Refused: limit + 1, Refusal: RefusalClose,
+		}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			b := newTestBrokerInfo(t, tt.behavior)
+			b.PacketSizeCap = 4096
+
+			s := &b.V5PacketSize
+			if tt.version == packet.V311 {
+				s = &b.V4PacketSize
+			}
+			if err := b.checkPacketSize(tt.version, s); err != nil {
+				t.Fatalf("checkPacketSize() error = %v", err)
+			}
+			if *s != tt.want {
+				t.Errorf("PacketSizeInfo = %+v, want %+v", *s, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,302 @@
+package mqttinfo
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// pcapng block types and link type
+const (
+	pcapSectionHeader   = 0x0a0d0d0a
+	pcapInterface       = 0x00000001
+	pcapEnhancedPacket  = 0x00000006
+	pcapByteOrderMagic  = 0x1a2b3c4d
+	pcapLinkTypeRaw     = 101
+	pcapMaxSegment      = 65000
+	tcpFIN, tcpSYN      = 0x01, 0x02
+	tcpPSH, tcpACK      = 0x08, 0x10
+	ipProtocolTCP       = 6
+	pcapFirstClientPort = 40000
+)
+
+// PcapWriter writes the connections to the broker to a pcapng file.
+// Since it only sees the bytes exchanged, it synthesizes the IP and TCP
+// headers, including handshakes, so that Wireshark decodes MQTT.
+type PcapWriter struct {
+	mu    sync.Mutex
+	w     io.Writer
+	conns int
+	err   error
+}
+
+// NewPcapWriter writes the pcapng headers to w, and returns a
+// PcapWriter adding packets to it
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	p := &PcapWriter{w: w}
+
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], pcapByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:], 1)
+	binary.LittleEndian.PutUint16(shb[6:], 0)
+	// Section length unknown
+	binary.LittleEndian.PutUint64(shb[8:], 0xffffffffffffffff)
+	p.block(pcapSectionHeader, shb)
+
+	// Timestamps in microseconds, the default resolution
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], pcapLinkTypeRaw)
+	p.block(pcapInterface, idb)
+
+	return p, p.err
+}
+
+// Err returns the first error met while writing the file
+func (p *PcapWriter) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// block writes a pcapng block, p.mu must be held except at creation
+func (p *PcapWriter) block(blockType uint32, body []byte) {
+	if p.err != nil {
+		return
+	}
+	padded := (len(body) + 3) &^ 3
+	total := 12 + padded
+	b := make([]byte, total)
+	binary.LittleEndian.PutUint32(b[0:], blockType)
+	binary.LittleEndian.PutUint32(b[4:], uint32(total))
+	copy(b[8:], body)
+	binary.LittleEndian.PutUint32(b[total-4:], uint32(total))
+	_, p.err = p.w.Write(b)
+}
+
+func (p *PcapWriter) packet(ip []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ts := uint64(time.Now().UnixNano() / 1000)
+	body := make([]byte, 20, 20+len(ip))
+	binary.LittleEndian.PutUint32(body[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(ip)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(ip)))
+	p.block(pcapEnhancedPacket, append(body, ip...))
+}
+
+// Wrap returns a dialer capturing the connections opened by dial,
+// or by net.DialTimeout if dial is nil
+func (p *PcapWriter) Wrap(dial Dialer) Dialer {
+	if dial == nil {
+		dial = net.DialTimeout
+	}
+	return func(network, address string, timeout time.Duration) (net.Conn, error) {
+		conn, err := dial(network, address, timeout)
+		if err != nil {
+			return nil, err
+		}
+
+		p.mu.Lock()
+		p.conns++
+		id := p.conns
+		p.mu.Unlock()
+
+		c := &pcapConn{Conn: conn, p: p}
+		c.client = endpoint(conn.LocalAddr(), net.IPv4(10, 0, 0, 1), pcapFirstClientPort+id)
+		c.server = endpoint(conn.RemoteAddr(), net.IPv4(10, 0, 0, 2), 1883)
+		if (c.client.IP.To4() == nil) != (c.server.IP.To4() == nil) {
+			// Both ends must use the same IP version
+			c.client.IP = c.client.IP.To16()
+			c.server.IP = c.server.IP.To16()
+		}
+		c.clientSeq = uint32(id) << 24
+		c.serverSeq = uint32(id)<<24 | 0x800000
+
+		c.segment(true, tcpSYN, nil)
+		c.clientSeq++
+		c.segment(false, tcpSYN|tcpACK, nil)
+		c.serverSeq++
+		c.segment(true, tcpACK, nil)
+
+		return c, nil
+	}
+}
+
+// endpoint returns the address and port of addr, with defaults for
+// addresses that aren't TCP, such as in tests and replays
+func endpoint(addr net.Addr, ip net.IP, port int) net.TCPAddr {
+	e := net.TCPAddr{IP: ip, Port: port}
+	if a, ok := addr.(*net.TCPAddr); ok {
+		if a.IP != nil && !a.IP.IsUnspecified() {
+			e.IP = a.IP
+		}
+		if a.Port != 0 {
+			e.Port = a.Port
+		}
+	}
+	return e
+}
+
+type pcapConn struct {
+	net.Conn
+	p *PcapWriter
+
+	mu                   sync.Mutex
+	client, server       net.TCPAddr
+	clientSeq, serverSeq uint32
+	clientFin, serverFin bool
+}
+
+// segment writes a TCP segment, from the client if fromClient is true
+func (c *pcapConn) segment(fromClient bool, flags byte, data []byte) {
+	src, dst := c.client, c.server
+	seq, ack := c.clientSeq, c.serverSeq
+	if !fromClient {
+		src, dst = c.server, c.client
+		seq, ack = c.serverSeq, c.clientSeq
+	}
+	if flags&tcpSYN != 0 && flags&tcpACK == 0 {
+		ack = 0
+	}
+
+	tcp := make([]byte, 20+len(data))
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], data)
+
+	var ip []byte
+	if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+		ip = make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		binary.BigEndian.PutUint16(ip[6:], 0x4000)
+		ip[8] = 64
+		ip[9] = ipProtocolTCP
+		copy(ip[12:], src4)
+		copy(ip[16:], dst4)
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+
+		pseudo := make([]byte, 12)
+		copy(pseudo[0:], src4)
+		copy(pseudo[4:], dst4)
+		pseudo[9] = ipProtocolTCP
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+		binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, sum(pseudo)))
+	} else {
+		ip = make([]byte, 40)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+		ip[6] = ipProtocolTCP
+		ip[7] = 64
+		copy(ip[8:], src.IP.To16())
+		copy(ip[24:], dst.IP.To16())
+
+		pseudo := make([]byte, 40)
+		copy(pseudo[0:], src.IP.To16())
+		copy(pseudo[16:], dst.IP.To16())
+		binary.BigEndian.PutUint32(pseudo[32:], uint32(len(tcp)))
+		pseudo[39] = ipProtocolTCP
+		binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, sum(pseudo)))
+	}
+
+	c.p.packet(append(ip, tcp...))
+}
+
+// data writes the segments carrying b
+func (c *pcapConn) data(fromClient bool, b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(b) > 0 {
+		n := len(b)
+		if n > pcapMaxSegment {
+			n = pcapMaxSegment
+		}
+		c.segment(fromClient, tcpPSH|tcpACK, b[:n])
+		if fromClient {
+			c.clientSeq += uint32(n)
+		} else {
+			c.serverSeq += uint32(n)
+		}
+		b = b[n:]
+	}
+}
+
+// fin writes a FIN from one side, and the final ACK once both sides
+// closed
+func (c *pcapConn) fin(fromClient bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if fromClient && !c.clientFin {
+		c.segment(true, tcpFIN|tcpACK, nil)
+		c.clientSeq++
+		c.clientFin = true
+		if c.serverFin {
+			return
+		}
+		c.segment(false, tcpFIN|tcpACK, nil)
+		c.serverSeq++
+		c.serverFin = true
+		c.segment(true, tcpACK, nil)
+	}
+	if !fromClient && !c.serverFin {
+		c.segment(false, tcpFIN|tcpACK, nil)
+		c.serverSeq++
+		c.serverFin = true
+	}
+}
+
+func (c *pcapConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.data(false, b[:n])
+	}
+	if err == io.EOF {
+		c.fin(false)
+	}
+	return n, err
+}
+
+func (c *pcapConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.data(true, b[:n])
+	}
+	return n, err
+}
+
+func (c *pcapConn) Close() error {
+	c.fin(true)
+	return c.Conn.Close()
+}
+
+// sum adds the 16-bit words of b, for the internet checksum
+func sum(b []byte) uint32 {
+	var s uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	return s
+}
+
+// checksum returns the internet checksum of b, with an initial sum
+func checksum(b []byte, initial uint32) uint16 {
+	s := initial + sum(b)
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
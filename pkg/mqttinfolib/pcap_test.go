@@ -0,0 +1,118 @@
+package mqttinfo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPcapWriter(t *testing.T) {
+	t.Parallel()
+
+	var file bytes.Buffer
+	p, err := NewPcapWriter(&file)
+	if err != nil {
+		t.Fatalf("NewPcapWriter() error = %v", err)
+	}
+
+	client, server := net.Pipe()
+	dial := p.Wrap(func(network, address string, timeout time.Duration) (net.Conn, error) {
+		return client, nil
+	})
+	conn, err := dial("tcp", "fakebroker:1883", time.Second)
+	if err != nil {
+		t.Fatalf("dial error = %v", err)
+	}
+	go func() {
+		buf := make([]byte, 5)
+		server.Read(buf)
+		server.Write([]byte("world!"))
+	}()
+	conn.Write([]byte("hello"))
+	conn.Read(make([]byte, 6))
+	conn.Close()
+	server.Close()
+	if err := p.Err(); err != nil {
+		t.Fatalf("Err() = %v", err)
+	}
+
+	type segment struct {
+		fromClient bool
+		flags      byte
+		data       string
+	}
+	want := []segment{
+		{true, tcpSYN, ""},
+		{false, tcpSYN | tcpACK, ""},
+		{true, tcpACK, ""},
+		{true, tcpPSH | tcpACK, "hello"},
+		{false, tcpPSH | tcpACK, "world!"},
+		{true, tcpFIN | tcpACK, ""},
+		{false, tcpFIN | tcpACK, ""},
+		{true, tcpACK, ""},
+	}
+
+	var blocks []uint32
+	var segments []segment
+	rest := file.Bytes()
+	for len(rest) > 0 {
+		if len(rest) < 12 {
+			t.Fatalf("%v trailing bytes", len(rest))
+		}
+		blockType := binary.LittleEndian.Uint32(rest[0:])
+		total := int(binary.LittleEndian.Uint32(rest[4:]))
+		if total%4 != 0 || total < 12 || total > len(rest) {
+			t.Fatalf("block %#x length %v, %v bytes left", blockType, total, len(rest))
+		}
+		if trailer := int(binary.LittleEndian.Uint32(rest[total-4:])); trailer != total {
+			t.Fatalf("block %#x length %v, trailer %v", blockType, total, trailer)
+		}
+		body := rest[8 : total-4]
+		blocks = append(blocks, blockType)
+
+		switch blockType {
+		case pcapSectionHeader:
+			if magic := binary.LittleEndian.Uint32(body[0:]); magic != pcapByteOrderMagic {
+				t.Errorf("byte order magic = %#x", magic)
+			}
+		case pcapInterface:
+			if link := binary.LittleEndian.Uint16(body[0:]); link != pcapLinkTypeRaw {
+				t.Errorf("link type = %v, want %v", link, pcapLinkTypeRaw)
+			}
+		case pcapEnhancedPacket:
+			captured := int(binary.LittleEndian.Uint32(body[12:]))
+			ip := body[20 : 20+captured]
+			if ip[0] != 0x45 {
+				t.Fatalf("IP header %#x, want IPv4", ip[0])
+			}
+			if off := checksum(ip[:20], 0); off != 0 {
+				t.Errorf("IP checksum off by %#x", off)
+			}
+			tcp := ip[20:]
+			pseudo := make([]byte, 12)
+			copy(pseudo[0:], ip[12:20])
+			pseudo[9] = ipProtocolTCP
+			binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+			if off := checksum(tcp, sum(pseudo)); off != 0 {
+				t.Errorf("TCP checksum off by %#x", off)
+			}
+			srcPort := binary.BigEndian.Uint16(tcp[0:])
+			segments = append(segments, segment{srcPort != 1883, tcp[13], string(tcp[20:])})
+		}
+		rest = rest[total:]
+	}
+
+	if len(blocks) < 2 || blocks[0] != pcapSectionHeader || blocks[1] != pcapInterface {
+		t.Fatalf("blocks = %#x, want a section header then an interface", blocks)
+	}
+	if len(segments) != len(want) {
+		t.Fatalf("segments = %+v, want %+v", segments, want)
+	}
+	for i := range want {
+		if segments[i] != want[i] {
+			t.Errorf("segment %v = %+v, want %+v", i, segments[i], want[i])
+		}
+	}
+}
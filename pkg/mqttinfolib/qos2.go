@@ -0,0 +1,190 @@
+package mqttinfo
+
+import (
+	"time"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+// QoS2Info holds the results of the QoS 2 exactly-once checks
+type QoS2Info struct {
+	// QoS 2 granted, the other results are zero otherwise
+	Supported bool
+
+	// Deliveries of a message resent with DUP before PUBREL, exactly one
+	// as MQTT requires
+	DupDeliveries int
+
+	// PUBCOMP received for a PUBREL of a packet ID never published, and
+	// its reason code, 0x92 Packet Identifier not found in v5.0
+	UnknownPubcomp bool
+	UnknownReason  byte
+
+	// Message published with the packet ID of a completed flow delivered
+	IDReused bool
+
+	// Flow completed by a PUBREL after reconnecting to the session between
+	// PUBREC and PUBREL, the reason code of the PUBCOMP, and deliveries
+	// of the message
+	ResumeCompleted  bool
+	ResumeReason     byte
+	ResumeDeliveries int
+}
+
+// countPayload returns how many messages with the given payload are
+// received, until none arrives for wait
+func (c *Client) countPayload(payload []byte, wait time.Duration) (int, error) {
+	n := 0
+	for {
+		pub, err := c.receivePayload(payload, wait)
+		if err != nil || pub == nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// released sends the PUBREL of a packet ID, and returns the PUBCOMP
+func (c *Client) released(id uint16) (*packet.Ack, error) {
+	rel := &packet.Ack{Type: packet.PUBREL, PacketID: id}
+	if err := c.write(rel.Encode(c.version)); err != nil {
+		return nil, err
+	}
+	return c.awaitAck(packet.PUBCOMP, id)
+}
+
+// received sends a QoS 2 message, and waits for its PUBREC
+func (c *Client) received(pub *packet.Publish) error {
+	if err := c.write(pub.Encode(c.version)); err != nil {
+		return err
+	}
+	_, err := c.awaitAck(packet.PUBREC, pub.PacketID)
+	return err
+}
+
+// CheckQoS2V3 checks the QoS 2 edge cases of v3.1
+func (b *BrokerInfo) CheckQoS2V3() error {
+	return b.checkQoS2(packet.V31, &b.V3QoS2Flows)
+}
+
+// CheckQoS2V4 checks the QoS 2 edge cases of v3.1.1
+func (b *BrokerInfo) CheckQoS2V4() error {
+	return b.checkQoS2(packet.V311, &b.V4QoS2Flows)
+}
+
+// CheckQoS2V5 checks the QoS 2 edge cases of v5.0, including the reason
+// codes of PUBCOMP
+func (b *BrokerInfo) CheckQoS2V5() error {
+	return b.checkQoS2(packet.V5, &b.V5QoS2Flows)
+}
+
+// checkQoS2 resends a message before PUBREL, releases an unknown packet
+// ID, reuses a packet ID, and resumes a session between PUBREC and PUBREL
+func (b *BrokerInfo) checkQoS2(version byte, q *QoS2Info) error {
+
+	name := versionName(version)
+	topic := b.probeTopic("qos2")
+	wait := b.quiet()
+	*q = QoS2Info{}
+
+	sub, err := b.NewClient(version)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+	granted, err := sub.Subscribe(topic, 2)
+	if err != nil {
+		return err
+	}
+	if granted != 2 {
+		b.logf(LevelDebug, "QoS 2 not granted (code 0x%02x)", granted)
+		return nil
+	}
+	q.Supported = true
+
+	pub, err := b.NewClient(version)
+	if err != nil {
+		return err
+	}
+	// pub is connected again if the broker closes it
+	defer func() {
+		pub.Close()
+	}()
+
+	b.beginCheck(name + " QoS 2 DUP before PUBREL")
+	dup := &packet.Publish{Topic: topic, QoS: 2, PacketID: pub.nextPacketID(), Payload: []byte("mqttinfo dup")}
+	if err = pub.received(dup); err != nil {
+		return err
+	}
+	dup.Dup = true
+	if err = pub.received(dup); err != nil {
+		return err
+	}
+	if _, err = pub.released(dup.PacketID); err != nil {
+		return err
+	}
+	if q.DupDeliveries, err = sub.countPayload(dup.Payload, wait); err != nil {
+		return err
+	}
+	b.logf(LevelDebug, "message resent with DUP delivered %v times", q.DupDeliveries)
+
+	b.beginCheck(name + " PUBREL of an unknown packet ID")
+	comp, err := pub.released(pub.nextPacketID())
+	if err == nil {
+		q.UnknownPubcomp = true
+		q.UnknownReason = comp.ReasonCode
+	} else {
+		b.logf(LevelDebug, "unknown PUBREL: %v", err)
+		pub.abort()
+		if pub, err = b.NewClient(version); err != nil {
+			return err
+		}
+	}
+
+	b.beginCheck(name + " QoS 2 packet ID reuse")
+	first := &packet.Publish{Topic: topic, QoS: 2, PacketID: pub.nextPacketID(), Payload: []byte("mqttinfo first")}
+	if _, err = pub.publish(first); err != nil {
+		return err
+	}
+	reused := &packet.Publish{Topic: topic, QoS: 2, PacketID: first.PacketID, Payload: []byte("mqttinfo reused")}
+	if _, err = pub.publish(reused); err != nil {
+		return err
+	}
+	got, err := sub.receivePayload(reused.Payload, wait)
+	if err != nil {
+		return err
+	}
+	q.IDReused = got != nil
+
+	b.beginCheck(name + " QoS 2 session resume")
+	connect := b.persistentConnect(version, sessionExpiry)
+	c, err := b.newClient(connect)
+	if err != nil {
+		return err
+	}
+	defer b.discardSession(connect)
+	resumed := &packet.Publish{Topic: topic, QoS: 2, PacketID: c.nextPacketID(), Payload: []byte("mqttinfo resumed")}
+	if err = c.received(resumed); err != nil {
+		c.Close()
+		return err
+	}
+	c.Close()
+	// Give the broker time to process the DISCONNECT first
+	time.Sleep(wait)
+
+	if c, err = b.newClient(connect); err != nil {
+		return err
+	}
+	defer c.Close()
+	if comp, err = c.released(resumed.PacketID); err == nil {
+		q.ResumeCompleted = true
+		q.ResumeReason = comp.ReasonCode
+	} else {
+		b.logf(LevelDebug, "PUBREL after resume: %v", err)
+	}
+	if q.ResumeDeliveries, err = sub.countPayload(resumed.Payload, wait); err != nil {
+		return err
+	}
+
+	return nil
+}
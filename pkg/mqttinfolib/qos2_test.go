@@ -0,0 +1,70 @@
+package mqttinfo
+
+import (
+	"testing"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/fakebroker"
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+func TestCheckQoS2(t *testing.T) {
+	duplicate := fakebroker.Mosquitto()
+	duplicate.DuplicateQoS2 = true
+
+	lax := fakebroker.Mosquitto()
+	lax.CompleteUnknownPubrel = true
+
+	noSessions := fakebroker.Mosquitto()
+	noSessions.NoSessions = true
+
+	qos1 := fakebroker.Mosquitto()
+	qos1.MaxQoS = 1
+
+	tests := []struct {
+		name     string
+		behavior fakebroker.Behavior
+		version  byte
+		want     QoS2Info
+	}{
+		{"mosquitto", fakebroker.Mosquitto(), packet.V5, QoS2Info{
+			Supported: true, DupDeliveries: 1, UnknownPubcomp: true, UnknownReason: 0x92,
+			IDReused: true, ResumeCompleted: true, ResumeDeliveries: 1,
+		}},
+		{"v3.1.1", fakebroker.Mosquitto(), packet.V311, QoS2Info{
+			Supported: true, DupDeliveries: 1, UnknownPubcomp: true,
+			IDReused: true, ResumeCompleted: true, ResumeDeliveries: 1,
+		}},
+		{"duplicate", duplicate, packet.V5, QoS2Info{
+			Supported: true, DupDeliveries: 2, UnknownPubcomp: true, UnknownReason: 0x92,
+			IDReused: true, ResumeCompleted: true, ResumeDeliveries: 1,
+		}},
+		{"unknown PUBREL completed", lax, packet.V5, QoS2Info{
+			Supported: true, DupDeliveries: 1, UnknownPubcomp: true,
+			IDReused: true, ResumeCompleted: true, ResumeDeliveries: 1,
+		}},
+		{"no sessions", noSessions, packet.V5, QoS2Info{
+			Supported: true, DupDeliveries: 1, UnknownPubcomp: true, UnknownReason: 0x92,
+			IDReused: true, ResumeCompleted: true, ResumeReason: 0x92, ResumeDeliveries: 1,
+		}},
+		{"QoS 1 only", qos1, packet.V5, QoS2Info{}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			b := newTestBrokerInfo(t, tt.behavior)
+
+			q := &b.V5QoS2Flows
+			if tt.version == packet.V311 {
+				q = &b.V4QoS2Flows
+			}
+			if err := b.checkQoS2(tt.version, q); err != nil {
+				t.Fatalf("checkQoS2() error = %v", err)
+			}
+			if *q != tt.want {
+				t.Errorf("QoS2Info = %+v, want %+v", *q, tt.want)
+			}
+		})
+	}
+}
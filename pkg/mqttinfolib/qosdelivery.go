@@ -0,0 +1,123 @@
+package mqttinfo
+
+import (
+	"fmt"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+// QoSDeliveryInfo holds the results of the QoS delivery checks
+type QoSDeliveryInfo struct {
+	// Granted[s] is the SUBACK reason code of a subscription requesting
+	// QoS s, the granted QoS unless refused. Delivered[s][p] is the QoS of
+	// a message published with QoS p as delivered to it, -1 if it wasn't.
+	Granted   [3]byte
+	Delivered [3][3]int
+
+	// Every message accepted delivered with the lowest of the granted
+	// and published QoS, as MQTT requires
+	DeliveryMatches bool
+
+	// Lowest QoS of the publications refused, 3 if none, how, and the
+	// reason code of the PUBACK or DISCONNECT, if any
+	RefusedQoS    byte
+	Refusal       string
+	RefusalReason byte
+
+	// Maximum QoS in the v5.0 CONNACK, 2 if absent, and whether no QoS
+	// above it was granted, delivered or accepted from us
+	MaximumQoS     byte
+	MaximumHonored bool
+}
+
+// CheckQoSDeliveryV3 checks the QoS of the messages delivered in v3.1
+func (b *BrokerInfo) CheckQoSDeliveryV3() error {
+	return b.checkQoSDelivery(packet.V31, &b.V3QoSDelivery)
+}
+
+// CheckQoSDeliveryV4 checks the QoS of the messages delivered in v3.1.1
+func (b *BrokerInfo) CheckQoSDeliveryV4() error {
+	return b.checkQoSDelivery(packet.V311, &b.V4QoSDelivery)
+}
+
+// CheckQoSDeliveryV5 checks the QoS of the messages delivered in v5.0,
+// and the Maximum QoS
+func (b *BrokerInfo) CheckQoSDeliveryV5() error {
+	return b.checkQoSDelivery(packet.V5, &b.V5QoSDelivery)
+}
+
+// checkQoSDelivery subscribes with each QoS, and publishes with each QoS
+// to every subscription
+func (b *BrokerInfo) checkQoSDelivery(version byte, q *QoSDeliveryInfo) error {
+
+	name := versionName(version)
+	topic := b.probeTopic("qos")
+	*q = QoSDeliveryInfo{RefusedQoS: 3}
+
+	b.beginCheck(name + " QoS granted")
+	sub, err := b.NewClient(version)
+	if err != nil {
+		return err
+	}
+	var subs []packet.Subscription
+	for s := byte(0); s <= 2; s++ {
+		subs = append(subs, packet.Subscription{Filter: fmt.Sprintf("%v/%v", topic, s), Options: s})
+	}
+	suback, err := sub.subscribe(nil, subs...)
+	if err != nil {
+		sub.Close()
+		return err
+	}
+	if len(suback.ReasonCodes) != len(subs) {
+		sub.Close()
+		return fmt.Errorf("SUBACK has %v reason codes for %v subscriptions", len(suback.ReasonCodes), len(subs))
+	}
+	copy(q.Granted[:], suback.ReasonCodes)
+
+	p := &publishProbe{b: b, version: version, wait: b.quiet(), sub: sub}
+	defer p.close()
+
+	q.MaximumQoS = 2
+	if version == packet.V5 {
+		if maximum, ok := sub.Connack.Properties.Int(packet.PropMaximumQoS); ok {
+			q.MaximumQoS = byte(maximum)
+		}
+	}
+
+	q.DeliveryMatches = true
+	above := false
+	for s := byte(0); s <= 2; s++ {
+		granted := q.Granted[s]
+		for qos := byte(0); qos <= 2; qos++ {
+			q.Delivered[s][qos] = -1
+			if granted >= 0x80 {
+				continue
+			}
+			b.beginCheck(fmt.Sprintf("%v QoS %v to QoS %v", name, qos, s))
+			pub := &packet.Publish{Topic: subs[s].Filter, QoS: qos, Payload: p.mark()}
+			received, refusal, code, err := p.deliver(pub)
+			if err != nil {
+				return err
+			}
+			if refusal != "" && refusal != RefusalDrop && qos < q.RefusedQoS {
+				q.RefusedQoS, q.Refusal, q.RefusalReason = qos, refusal, code
+			}
+			if received == nil {
+				b.logf(LevelDebug, "QoS %v to QoS %v: %v", qos, s, refusal)
+				// QoS 0 may be lost, and QoS above the maximum refused in
+				// any way, but QoS 1 and 2 messages must be delivered
+				lost := refusal == RefusalDrop && qos > 0 && qos <= q.MaximumQoS
+				q.DeliveryMatches = q.DeliveryMatches && !lost
+				continue
+			}
+			q.Delivered[s][qos] = int(received.QoS)
+			q.DeliveryMatches = q.DeliveryMatches && received.QoS == min(granted, qos)
+			above = above || qos > q.MaximumQoS || received.QoS > q.MaximumQoS
+		}
+		above = above || (granted < 0x80 && granted > q.MaximumQoS)
+	}
+	q.MaximumHonored = version == packet.V5 && !above
+	b.logf(LevelDebug, "QoS delivered %v", q.Delivered)
+
+	return nil
+}
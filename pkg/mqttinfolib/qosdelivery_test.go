@@ -0,0 +1,92 @@
+package mqttinfo
+
+import (
+	"testing"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/fakebroker"
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+func TestCheckQoSDelivery(t *testing.T) {
+	qos1 := fakebroker.Mosquitto()
+	qos1.MaxQoS = 1
+	qos1.ConnackProperties = append(qos1.ConnackProperties,
+		packet.IntProperty(packet.PropMaximumQoS, 1))
+
+	unadvertised := fakebroker.Mosquitto()
+	unadvertised.MaxQoS = 1
+
+	overstated := fakebroker.Mosquitto()
+	overstated.ConnackProperties = append(overstated.ConnackProperties,
+		packet.IntProperty(packet.PropMaximumQoS, 1))
+
+	dropped := qos1
+	dropped.DropAboveMaxQoS = true
+
+	ignored := fakebroker.Mosquitto()
+	ignored.IgnoreGrantedQoS = true
+
+	all := [3][3]int{{0, 0, 0}, {0, 1, 1}, {0, 1, 2}}
+	upToQoS1 := [3][3]int{{0, 0, -1}, {0, 1, -1}, {0, 1, -1}}
+
+	tests := []struct {
+		name     string
+		behavior fakebroker.Behavior
+		version  byte
+		want     QoSDeliveryInfo
+	}{
+		{"mosquitto", fakebroker.Mosquitto(), packet.V5, QoSDeliveryInfo{
+			Granted: [3]byte{0, 1, 2}, Delivered: all, DeliveryMatches: true,
+			RefusedQoS: 3, MaximumQoS: 2, MaximumHonored: true,
+		}},
+		{"v3.1.1", fakebroker.Mosquitto(), packet.V311, QoSDeliveryInfo{
+			Granted: [3]byte{0, 1, 2}, Delivered: all, DeliveryMatches: true,
+			RefusedQoS: 3, MaximumQoS: 2,
+		}},
+		{"maximum QoS 1", qos1, packet.V5, QoSDeliveryInfo{
+			Granted: [3]byte{0, 1, 1}, Delivered: upToQoS1, DeliveryMatches: true,
+			RefusedQoS: 2, Refusal: RefusalDisconnect, RefusalReason: 0x9b,
+			MaximumQoS: 1, MaximumHonored: true,
+		}},
+		{"dropped above maximum", dropped, packet.V5, QoSDeliveryInfo{
+			Granted: [3]byte{0, 1, 1}, Delivered: upToQoS1, DeliveryMatches: true,
+			RefusedQoS: 3, MaximumQoS: 1, MaximumHonored: true,
+		}},
+		{"v3.1.1 QoS 1", qos1, packet.V311, QoSDeliveryInfo{
+			Granted: [3]byte{0, 1, 1}, Delivered: upToQoS1, DeliveryMatches: true,
+			RefusedQoS: 2, Refusal: RefusalClose, MaximumQoS: 2,
+		}},
+		{"unadvertised", unadvertised, packet.V5, QoSDeliveryInfo{
+			Granted: [3]byte{0, 1, 1}, Delivered: upToQoS1, DeliveryMatches: true,
+			RefusedQoS: 2, Refusal: RefusalDisconnect, RefusalReason: 0x9b, MaximumQoS: 2,
+			MaximumHonored: true,
+		}},
+		{"overstated", overstated, packet.V5, QoSDeliveryInfo{
+			Granted: [3]byte{0, 1, 2}, Delivered: all, DeliveryMatches: true,
+			RefusedQoS: 3, MaximumQoS: 1,
+		}},
+		{"granted QoS ignored", ignored, packet.V5, QoSDeliveryInfo{
+			Granted: [3]byte{0, 1, 2}, Delivered: [3][3]int{{0, 1, 2}, {0, 1, 2}, {0, 1, 2}},
+			RefusedQoS: 3, MaximumQoS: 2, MaximumHonored: true,
+		}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			b := newTestBrokerInfo(t, tt.behavior)
+
+			q := &b.V5QoSDelivery
+			if tt.version == packet.V311 {
+				q = &b.V4QoSDelivery
+			}
+			if err := b.checkQoSDelivery(tt.version, q); err != nil {
+				t.Fatalf("checkQoSDelivery() error = %v", err)
+			}
+			if *q != tt.want {
+				t.Errorf("QoSDeliveryInfo = %+v, want %+v", *q, tt.want)
+			}
+		})
+	}
+}
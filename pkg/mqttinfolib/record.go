@@ -0,0 +1,350 @@
+package mqttinfo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+// Event directions in a recording
+const (
+	EventDial  = "dial"
+	EventSend  = "send"
+	EventRecv  = "recv"
+	EventError = "error"
+	EventClose = "close"
+)
+
+// Event is an entry of a recording, written as one JSON object per line.
+// Conn numbers the connections in the order they were opened.
+type Event struct {
+	Conn    int       `json:"conn"`
+	Time    time.Time `json:"time"`
+	Dir     string    `json:"dir"`
+	Data    []byte    `json:"data,omitempty"`
+	Err     string    `json:"err,omitempty"`
+	Timeout bool      `json:"timeout,omitempty"`
+	EOF     bool      `json:"eof,omitempty"`
+}
+
+// Recorder writes every byte exchanged with the broker to a recording,
+// including the credentials sent in CONNECT
+type Recorder struct {
+	mu    sync.Mutex
+	enc   *json.Encoder
+	conns int
+	err   error
+}
+
+// NewRecorder returns a Recorder writing to w
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w)}
+}
+
+// Err returns the first error met while writing the recording
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *Recorder) record(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e.Time = time.Now()
+	if err := r.enc.Encode(e); err != nil && r.err == nil {
+		r.err = err
+	}
+}
+
+// Wrap returns a dialer recording the connections opened by dial,
+// or by net.DialTimeout if dial is nil
+func (r *Recorder) Wrap(dial Dialer) Dialer {
+	if dial == nil {
+		dial = net.DialTimeout
+	}
+	return func(network, address string, timeout time.Duration) (net.Conn, error) {
+		r.mu.Lock()
+		r.conns++
+		id := r.conns
+		r.mu.Unlock()
+
+		conn, err := dial(network, address, timeout)
+		if err != nil {
+			r.record(Event{Conn: id, Dir: EventDial, Err: err.Error()})
+			return nil, err
+		}
+		r.record(Event{Conn: id, Dir: EventDial, Data: []byte(address)})
+		return &recordedConn{Conn: conn, r: r, id: id}, nil
+	}
+}
+
+type recordedConn struct {
+	net.Conn
+	r  *Recorder
+	id int
+}
+
+func (c *recordedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.r.record(Event{Conn: c.id, Dir: EventRecv, Data: append([]byte(nil), b[:n]...)})
+	}
+	if err != nil {
+		e := Event{Conn: c.id, Dir: EventError, Err: err.Error(), EOF: err == io.EOF}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			e.Timeout = true
+		}
+		c.r.record(e)
+	}
+	return n, err
+}
+
+func (c *recordedConn) Write(b []byte) (int, error) {
+	c.r.record(Event{Conn: c.id, Dir: EventSend, Data: append([]byte(nil), b...)})
+	return c.Conn.Write(b)
+}
+
+func (c *recordedConn) Close() error {
+	c.r.record(Event{Conn: c.id, Dir: EventClose})
+	return c.Conn.Close()
+}
+
+// ReadRecording reads the events of a recording
+func ReadRecording(r io.Reader) ([]Event, error) {
+	var events []Event
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("line %v: %v", line, err)
+		}
+		events = append(events, e)
+	}
+	return events, scanner.Err()
+}
+
+// Replayer plays a recording back in place of the broker. Connections
+// are replayed in the order they were recorded, reads return the
+// recorded data and errors as long after the connection as they came,
+// or at the read deadline for timeouts, and writes must match the
+// recorded data. The checks timing the broker get the recorded times.
+type Replayer struct {
+	mu    sync.Mutex
+	conns map[int][]Event
+	dials []Event
+	next  int
+	err   error
+}
+
+// NewReplayer returns a Replayer for the given events
+func NewReplayer(events []Event) *Replayer {
+	p := &Replayer{conns: make(map[int][]Event)}
+	for _, e := range events {
+		if e.Dir == EventDial {
+			p.dials = append(p.dials, e)
+			continue
+		}
+		p.conns[e.Conn] = append(p.conns[e.Conn], e)
+	}
+	return p
+}
+
+// RunID returns the BrokerInfo.RunID of the recorded scan, found in the
+// client IDs it sent, or "" if none is
+func (p *Replayer) RunID() string {
+	for _, events := range p.conns {
+		for _, e := range events {
+			if e.Dir != EventSend {
+				continue
+			}
+			raw, _ := packet.Parse(e.Data)
+			if raw == nil || raw.Type != packet.CONNECT {
+				continue
+			}
+			connect, err := packet.ParseConnect(raw)
+			if err == nil && strings.HasPrefix(connect.ClientID, clientIDPrefix) &&
+				len(connect.ClientID) >= len(clientIDPrefix)+runIDLength {
+				return connect.ClientID[len(clientIDPrefix):][:runIDLength]
+			}
+		}
+	}
+	return ""
+}
+
+// SCRAMNonces returns the BrokerInfo.SCRAMNonces of the recorded scan,
+// found in the client-first-messages of its CONNECT packets
+func (p *Replayer) SCRAMNonces() map[string]string {
+	nonces := make(map[string]string)
+	for _, events := range p.conns {
+		for _, e := range events {
+			if e.Dir != EventSend {
+				continue
+			}
+			raw, _ := packet.Parse(e.Data)
+			if raw == nil || raw.Type != packet.CONNECT {
+				continue
+			}
+			connect, err := packet.ParseConnect(raw)
+			if err != nil {
+				continue
+			}
+			method, _ := connect.Properties.Str(packet.PropAuthMethod)
+			data, _ := connect.Properties.Str(packet.PropAuthData)
+			if i := strings.LastIndex(data, ",r="); strings.HasPrefix(method, "SCRAM-") && i >= 0 {
+				nonces[method] = data[i+3:]
+			}
+		}
+	}
+	return nonces
+}
+
+// Err returns the first divergence between the replay and the recording
+func (p *Replayer) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+func (p *Replayer) fail(err error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+	return err
+}
+
+// Dial returns the next recorded connection, it is a Dialer
+func (p *Replayer) Dial(network, address string, timeout time.Duration) (net.Conn, error) {
+	p.mu.Lock()
+	if p.next >= len(p.dials) {
+		p.mu.Unlock()
+		return nil, p.fail(errors.New("replay: no more connections in the recording"))
+	}
+	dial := p.dials[p.next]
+	p.next++
+	events := p.conns[dial.Conn]
+	p.mu.Unlock()
+
+	if dial.Err != "" {
+		return nil, errors.New(dial.Err)
+	}
+	return &replayedConn{p: p, id: dial.Conn, events: events, start: time.Now(), recorded: dial.Time}, nil
+}
+
+type replayedConn struct {
+	p        *Replayer
+	id       int
+	events   []Event
+	pending  []byte
+	deadline time.Time
+
+	// replay and recording times of the connection
+	start, recorded time.Time
+}
+
+// skips the events that don't matter to the replay
+func (c *replayedConn) peek() *Event {
+	for len(c.events) > 0 && c.events[0].Dir == EventClose {
+		c.events = c.events[1:]
+	}
+	if len(c.events) == 0 {
+		return nil
+	}
+	return &c.events[0]
+}
+
+func (c *replayedConn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+
+	e := c.peek()
+	if e == nil {
+		return 0, io.EOF
+	}
+	if !e.Timeout && !e.Time.IsZero() && !c.recorded.IsZero() {
+		time.Sleep(time.Until(c.start.Add(e.Time.Sub(c.recorded))))
+	}
+	switch e.Dir {
+	case EventRecv:
+		c.events = c.events[1:]
+		n := copy(b, e.Data)
+		c.pending = e.Data[n:]
+		return n, nil
+	case EventError:
+		c.events = c.events[1:]
+		switch {
+		case e.Timeout:
+			time.Sleep(time.Until(c.deadline))
+			return 0, os.ErrDeadlineExceeded
+		case e.EOF:
+			return 0, io.EOF
+		default:
+			return 0, errors.New(e.Err)
+		}
+	default:
+		return 0, c.p.fail(fmt.Errorf("replay: conn %v: read while the recording sends %x", c.id, e.Data))
+	}
+}
+
+func (c *replayedConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		e := c.peek()
+		if e == nil || e.Dir != EventSend {
+			return written, c.p.fail(fmt.Errorf("replay: conn %v: unexpected write %x", c.id, b[written:]))
+		}
+		n := len(e.Data)
+		if n > len(b)-written {
+			n = len(b) - written
+		}
+		if !bytes.Equal(e.Data[:n], b[written:written+n]) {
+			return written, c.p.fail(fmt.Errorf("replay: conn %v: wrote %x, recording has %x", c.id, b[written:], e.Data))
+		}
+		if n < len(e.Data) {
+			e.Data = e.Data[n:]
+		} else {
+			c.events = c.events[1:]
+		}
+		written += n
+	}
+	return written, nil
+}
+
+func (c *replayedConn) Close() error {
+	return nil
+}
+
+func (c *replayedConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func (c *replayedConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1883}
+}
+
+func (c *replayedConn) SetDeadline(t time.Time) error      { return c.SetReadDeadline(t) }
+func (c *replayedConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func (c *replayedConn) SetReadDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
@@ -0,0 +1,116 @@
+package mqttinfo
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/fakebroker"
+)
+
+func TestRecordReplay(t *testing.T) {
+	t.Parallel()
+
+	var recording bytes.Buffer
+	recorder := NewRecorder(&recording)
+
+	b := newTestBrokerInfo(t, fakebroker.HiveMQ())
+	b.Dialer = recorder.Wrap(b.Dialer)
+	if err := b.AnalyzeV4(); err != nil {
+		t.Fatalf("AnalyzeV4() error = %v", err)
+	}
+	if err := b.GuessBroker(); err != nil {
+		t.Fatalf("GuessBroker() error = %v", err)
+	}
+	if err := recorder.Err(); err != nil {
+		t.Fatalf("recording failed: %v", err)
+	}
+
+	events, err := ReadRecording(&recording)
+	if err != nil {
+		t.Fatalf("ReadRecording() error = %v", err)
+	}
+	replayer := NewReplayer(events)
+
+	replayed, err := NewBrokerInfo("fakebroker", 1883, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed.Dialer = replayer.Dial
+	replayed.RunID = replayer.RunID()
+	replayed.Timeout = b.Timeout
+	if err := replayed.AnalyzeV4(); err != nil {
+		t.Fatalf("replayed AnalyzeV4() error = %v", err)
+	}
+	if err := replayed.GuessBroker(); err != nil {
+		t.Fatalf("replayed GuessBroker() error = %v", err)
+	}
+	if err := replayer.Err(); err != nil {
+		t.Fatalf("replay diverged: %v", err)
+	}
+
+	want, _ := json.Marshal(b)
+	got, _ := json.Marshal(replayed)
+	if !bytes.Equal(got, want) {
+		t.Errorf("replay = %s, want %s", got, want)
+	}
+}
+
+func TestRecordReplayScan(t *testing.T) {
+	if testing.Short() {
+		t.Skip("full scan skipped in short mode")
+	}
+	t.Parallel()
+
+	var recording bytes.Buffer
+	recorder := NewRecorder(&recording)
+
+	b := newTestBrokerInfo(t, fakebroker.Mosquitto())
+	b.Dialer = recorder.Wrap(b.Dialer)
+	if err := b.Scan(); err != nil {
+		t.Fatalf("Scan() error = %v", err)
+	}
+	if err := recorder.Err(); err != nil {
+		t.Fatalf("recording failed: %v", err)
+	}
+
+	events, err := ReadRecording(&recording)
+	if err != nil {
+		t.Fatalf("ReadRecording() error = %v", err)
+	}
+	replayer := NewReplayer(events)
+
+	replayed, err := NewBrokerInfo("fakebroker", 1883, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed.Dialer = replayer.Dial
+	replayed.RunID = replayer.RunID()
+	replayed.SCRAMNonces = replayer.SCRAMNonces()
+	replayed.Timeout, replayed.ProbeKeepAlive, replayed.second = b.Timeout, b.ProbeKeepAlive, b.second
+	if err := replayed.Scan(); err != nil {
+		t.Fatalf("replayed Scan() error = %v", err)
+	}
+	if err := replayer.Err(); err != nil {
+		t.Fatalf("replay diverged: %v", err)
+	}
+
+	// Times measured during the replay are only close to the recorded ones
+	for _, k := range [][2]*KeepAliveInfo{
+		{&replayed.V3KeepAlive, &b.V3KeepAlive},
+		{&replayed.V4KeepAlive, &b.V4KeepAlive},
+		{&replayed.V5KeepAlive, &b.V5KeepAlive},
+	} {
+		if d := k[0].ClosedAfter - k[1].ClosedAfter; d < -100*time.Millisecond || d > 100*time.Millisecond {
+			t.Errorf("replayed ClosedAfter = %v, want %v", k[0].ClosedAfter, k[1].ClosedAfter)
+		}
+		k[0].ClosedAfter = k[1].ClosedAfter
+	}
+
+	want, _ := json.Marshal(b)
+	got, _ := json.Marshal(replayed)
+	if !bytes.Equal(got, want) {
+		t.Errorf("replay = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,282 @@
+package mqttinfo
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+// RetainInfo holds the results of the retained message checks
+type RetainInfo struct {
+	// Retained message delivered to a later subscriber with the retain
+	// flag, and cleared by an empty retained payload
+	Delivered bool
+	Cleared   bool
+
+	// Retain Available advertised in CONNACK, and whether retained
+	// publications are handled accordingly. v5.0 only.
+	Available        bool
+	AvailableHonored bool
+
+	// Subscription options, v5.0 only
+	RetainAsPublished bool
+	RetainHandling0   bool
+	RetainHandling1   bool
+	RetainHandling2   bool
+}
+
+// CheckRetainV3 checks the handling of retained messages in v3.1
+func (b *BrokerInfo) CheckRetainV3() error {
+	return b.checkRetain(packet.V31, &b.V3Retain)
+}
+
+// CheckRetainV4 checks the handling of retained messages in v3.1.1
+func (b *BrokerInfo) CheckRetainV4() error {
+	return b.checkRetain(packet.V311, &b.V4Retain)
+}
+
+// CheckRetainV5 checks the handling of retained messages and of the
+// retain subscription options in v5.0
+func (b *BrokerInfo) CheckRetainV5() error {
+	return b.checkRetain(packet.V5, &b.V5Retain)
+}
+
+func (b *BrokerInfo) checkRetain(version byte, r *RetainInfo) error {
+
+	name := versionName(version)
+	topic := b.probeTopic("retain")
+	payload := []byte("mqttinfo retained")
+	wait := b.quiet()
+
+	// Publish a retained message before anyone subscribes
+	b.beginCheck(name + " retained delivery")
+	pub, err := b.probeClient(version)
+	if err != nil {
+		return err
+	}
+	defer pub.Close()
+
+	if version == packet.V5 {
+		available, ok := pub.Connack.Properties.Int(packet.PropRetainAvailable)
+		r.Available = !ok || available == 1
+	}
+
+	err = pub.Publish(topic, payload, 1, true)
+	if version == packet.V5 && !r.Available {
+		// The broker must refuse retained publications, with
+		// DISCONNECT 0x9a
+		r.AvailableHonored = err != nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	s1, err := b.probeClient(version)
+	if err != nil {
+		return err
+	}
+	defer s1.Close()
+	got, err := s1.subscribeWait(packet.Subscription{Filter: topic, Options: 1}, wait)
+	if err != nil {
+		return err
+	}
+	r.Delivered = got != nil && got.Retain && bytes.Equal(got.Payload, payload)
+	b.logf(LevelDebug, "retained message delivered: %v", r.Delivered)
+
+	if version == packet.V5 {
+		r.AvailableHonored = r.Delivered
+		if err = b.checkRetainOptions(s1, pub, topic, r); err != nil {
+			return err
+		}
+	}
+
+	// Clear it, later subscribers must get nothing
+	b.beginCheck(name + " retained clearing")
+	if err = pub.Publish(topic, nil, 1, true); err != nil {
+		return err
+	}
+	s2, err := b.probeClient(version)
+	if err != nil {
+		return err
+	}
+	defer s2.Close()
+	got, err = s2.subscribeWait(packet.Subscription{Filter: topic, Options: 1}, wait)
+	if err != nil {
+		return err
+	}
+	r.Cleared = r.Delivered && got == nil
+
+	return nil
+}
+
+// checkRetainOptions checks the retain handling and retain as published
+// subscription options. s1 is subscribed to topic with retain handling 0,
+// and the retained message is still there.
+func (b *BrokerInfo) checkRetainOptions(s1, pub *Client, topic string, r *RetainInfo) error {
+
+	wait := b.quiet()
+
+	// 0: retained messages are sent at every subscribe
+	b.beginCheck("v5.0 retain handling 0")
+	got, err := s1.subscribeWait(packet.Subscription{Filter: topic, Options: 1}, wait)
+	if err != nil {
+		return err
+	}
+	r.RetainHandling0 = r.Delivered && got != nil && got.Retain
+
+	// 1: only if the subscription didn't exist
+	b.beginCheck("v5.0 retain handling 1")
+	s2, err := b.probeClient(packet.V5)
+	if err != nil {
+		return err
+	}
+	defer s2.Close()
+	sub := packet.Subscription{Filter: topic, Options: 1 | packet.RetainHandling(1)}
+	first, err := s2.subscribeWait(sub, wait)
+	if err != nil {
+		return err
+	}
+	again, err := s2.subscribeWait(sub, wait)
+	if err != nil {
+		return err
+	}
+	r.RetainHandling1 = first != nil && first.Retain && again == nil
+
+	// 2: never at subscribe
+	b.beginCheck("v5.0 retain handling 2")
+	s3, err := b.probeClient(packet.V5)
+	if err != nil {
+		return err
+	}
+	defer s3.Close()
+	got, err = s3.subscribeWait(packet.Subscription{Filter: topic, Options: 1 | packet.RetainHandling(2)}, wait)
+	if err != nil {
+		return err
+	}
+	r.RetainHandling2 = r.Delivered && got == nil
+
+	// A new retained publication must reach s4 with the retain flag,
+	// and s3 without. Copies of the first one, sent by brokers ignoring
+	// retain handling, don't count.
+	b.beginCheck("v5.0 retain as published")
+	s4, err := b.probeClient(packet.V5)
+	if err != nil {
+		return err
+	}
+	defer s4.Close()
+	sub = packet.Subscription{Filter: topic, Options: 1 | packet.RetainAsPublished | packet.RetainHandling(2)}
+	if _, err = s4.subscribe(nil, sub); err != nil {
+		return err
+	}
+	payload := []byte("mqttinfo retained again")
+	if err = pub.Publish(topic, payload, 1, true); err != nil {
+		return err
+	}
+	withRAP, err := s4.receivePayload(payload, wait)
+	if err != nil {
+		return err
+	}
+	withoutRAP, err := s3.receivePayload(payload, wait)
+	if err != nil {
+		return err
+	}
+	r.RetainAsPublished = withRAP != nil && withRAP.Retain && withoutRAP != nil && !withoutRAP.Retain
+
+	return nil
+}
+
+// retainedMessage is a retained publication made by a check
+type retainedMessage struct {
+	topic   string
+	version byte
+}
+
+// trackRetained records a retained publication, to be cleared by Cleanup
+func (b *BrokerInfo) trackRetained(topic string, version byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.retained == nil {
+		b.retained = make(map[retainedMessage]bool)
+	}
+	b.retained[retainedMessage{topic, version}] = true
+}
+
+// untrackRetained forgets a retained publication, made with any
+// protocol level if version is 0
+func (b *BrokerInfo) untrackRetained(topic string, version byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for m := range b.retained {
+		if m.topic == topic && (version == 0 || m.version == version) {
+			delete(b.retained, m)
+		}
+	}
+}
+
+// Cleanup clears the retained messages published by the checks so far,
+// with zero-length retained publications, and lists those it couldn't
+// clear in CleanupFailed. It may be called while checks are running, for
+// example when interrupted.
+func (b *BrokerInfo) Cleanup() error {
+
+	b.mu.Lock()
+	retained := b.retained
+	b.retained = nil
+	b.mu.Unlock()
+
+	messages := make([]retainedMessage, 0, len(retained))
+	for m := range retained {
+		messages = append(messages, m)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		if messages[i].topic != messages[j].topic {
+			return messages[i].topic < messages[j].topic
+		}
+		return messages[i].version < messages[j].version
+	})
+
+	// A topic is cleared once, by any of the protocol levels used
+	var failed []string
+	cleared := make(map[string]bool)
+	errs := make(map[string]error)
+	for _, m := range messages {
+		if cleared[m.topic] {
+			continue
+		}
+		b.logf(LevelDebug, "clearing retained message on %v", m.topic)
+		if err := b.clearRetained(m.topic, m.version); err != nil {
+			b.logf(LevelWarn, "could not clear retained message on %v: %v", m.topic, err)
+			errs[m.topic] = err
+			continue
+		}
+		cleared[m.topic] = true
+		delete(errs, m.topic)
+	}
+	for _, m := range messages {
+		if err, ok := errs[m.topic]; ok {
+			failed = append(failed, fmt.Sprintf("%v: %v", m.topic, err))
+			delete(errs, m.topic)
+		}
+	}
+
+	b.mu.Lock()
+	b.CleanupFailed = append(b.CleanupFailed, failed...)
+	b.mu.Unlock()
+
+	if len(failed) > 0 {
+		return fmt.Errorf("could not clear %v retained message(s)", len(failed))
+	}
+	return nil
+}
+
+func (b *BrokerInfo) clearRetained(topic string, version byte) error {
+	c, err := b.NewClient(version)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.Publish(topic, nil, 1, true)
+}
@@ -0,0 +1,119 @@
+package mqttinfo
+
+import (
+	"testing"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/fakebroker"
+)
+
+func TestCheckRetain(t *testing.T) {
+	noRetain := fakebroker.Mosquitto()
+	noRetain.NoRetain = true
+
+	noOptions := fakebroker.Mosquitto()
+	noOptions.IgnoreRetainOptions = true
+
+	tests := []struct {
+		name     string
+		behavior fakebroker.Behavior
+		v4, v5   RetainInfo
+	}{
+		{"mosquitto", fakebroker.Mosquitto(),
+			RetainInfo{Delivered: true, Cleared: true},
+			RetainInfo{Delivered: true, Cleared: true, Available: true, AvailableHonored: true,
+				RetainAsPublished: true, RetainHandling0: true, RetainHandling1: true, RetainHandling2: true},
+		},
+		{"retain unavailable", noRetain,
+			RetainInfo{},
+			RetainInfo{AvailableHonored: true},
+		},
+		{"retain options ignored", noOptions,
+			RetainInfo{Delivered: true, Cleared: true},
+			RetainInfo{Delivered: true, Cleared: true, Available: true, AvailableHonored: true,
+				RetainHandling0: true},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			b := newTestBrokerInfo(t, tt.behavior)
+
+			if err := b.CheckRetainV4(); err != nil {
+				t.Fatalf("CheckRetainV4() error = %v", err)
+			}
+			if b.V4Retain != tt.v4 {
+				t.Errorf("V4Retain = %+v, want %+v", b.V4Retain, tt.v4)
+			}
+
+			if err := b.CheckRetainV5(); err != nil {
+				t.Fatalf("CheckRetainV5() error = %v", err)
+			}
+			if b.V5Retain != tt.v5 {
+				t.Errorf("V5Retain = %+v, want %+v", b.V5Retain, tt.v5)
+			}
+		})
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	t.Run("cleared", func(t *testing.T) {
+		t.Parallel()
+		broker := fakebroker.New(lenient())
+		defer broker.Close()
+		b := brokerInfoFor(t, broker)
+
+		if err := b.AnalyzeV4(); err != nil {
+			t.Fatalf("AnalyzeV4() error = %v", err)
+		}
+		if got := broker.Retained(); len(got) != 1 || got[0] != sysProbeTopic {
+			t.Fatalf("retained after AnalyzeV4 = %v, want [%v]", got, sysProbeTopic)
+		}
+
+		if err := b.Cleanup(); err != nil {
+			t.Errorf("Cleanup() error = %v", err)
+		}
+		if got := broker.Retained(); len(got) != 0 {
+			t.Errorf("retained after Cleanup = %v, want none", got)
+		}
+		if len(b.CleanupFailed) != 0 {
+			t.Errorf("CleanupFailed = %v, want none", b.CleanupFailed)
+		}
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		t.Parallel()
+		broker := fakebroker.New(lenient())
+		b := brokerInfoFor(t, broker)
+
+		if err := b.AnalyzeV4(); err != nil {
+			t.Fatalf("AnalyzeV4() error = %v", err)
+		}
+		broker.Close()
+
+		if err := b.Cleanup(); err == nil {
+			t.Error("Cleanup() succeeded with the broker gone")
+		}
+		if len(b.CleanupFailed) != 1 {
+			t.Errorf("CleanupFailed = %v, want one topic", b.CleanupFailed)
+		}
+	})
+
+	t.Run("scan", func(t *testing.T) {
+		if testing.Short() {
+			t.Skip("full scan skipped in short mode")
+		}
+		t.Parallel()
+		broker := fakebroker.New(lenient())
+		defer broker.Close()
+		b := brokerInfoFor(t, broker)
+
+		if err := b.Scan(); err != nil {
+			t.Fatalf("Scan() error = %v", err)
+		}
+		if got := broker.Retained(); len(got) != 0 {
+			t.Errorf("retained after Scan = %v, want none", got)
+		}
+	})
+}
@@ -0,0 +1,258 @@
+// Package scram implements the SCRAM exchange of RFC 5802, without
+// channel binding, for MQTT v5.0 enhanced authentication
+package scram
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// Mechanism is a SCRAM variant, named after its hash function
+type Mechanism struct {
+	Name string
+	Hash func() hash.Hash
+}
+
+// Mechanisms supported
+var (
+	SHA1   = Mechanism{"SCRAM-SHA-1", sha1.New}
+	SHA256 = Mechanism{"SCRAM-SHA-256", sha256.New}
+)
+
+// Lookup returns the mechanism with the given name
+func Lookup(name string) (Mechanism, bool) {
+	for _, m := range []Mechanism{SHA1, SHA256} {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return Mechanism{}, false
+}
+
+// gs2Header is sent by clients that don't support channel binding
+const gs2Header = "n,,"
+
+// ErrVerification is returned when a proof or signature doesn't match
+var ErrVerification = errors.New("scram: verification failed")
+
+// Client is the client side of an exchange
+type Client struct {
+	mech     Mechanism
+	username string
+	password string
+	nonce    string
+
+	clientFirstBare string
+	serverSignature []byte
+}
+
+// NewClient starts an exchange for the given credentials
+func NewClient(mech Mechanism, username, password string) *Client {
+	return NewClientNonce(mech, username, password, newNonce())
+}
+
+// NewClientNonce starts an exchange with the given client nonce, to
+// replay one
+func NewClientNonce(mech Mechanism, username, password, nonce string) *Client {
+	return &Client{mech: mech, username: username, password: password, nonce: nonce}
+}
+
+// First returns the client-first-message
+func (c *Client) First() []byte {
+	c.clientFirstBare = "n=" + escape(c.username) + ",r=" + c.nonce
+	return []byte(gs2Header + c.clientFirstBare)
+}
+
+// Final returns the client-final-message answering the server-first-message
+func (c *Client) Final(serverFirst []byte) ([]byte, error) {
+	attrs, err := parse(serverFirst)
+	if err != nil {
+		return nil, err
+	}
+	nonce := attrs['r']
+	if !strings.HasPrefix(nonce, c.nonce) || len(nonce) == len(c.nonce) {
+		return nil, errors.New("scram: invalid server nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs['s'])
+	if err != nil {
+		return nil, fmt.Errorf("scram: invalid salt: %v", err)
+	}
+	iterations, err := strconv.Atoi(attrs['i'])
+	if err != nil || iterations < 1 {
+		return nil, fmt.Errorf("scram: invalid iteration count %q", attrs['i'])
+	}
+
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte(gs2Header)) + ",r=" + nonce
+	authMessage := []byte(c.clientFirstBare + "," + string(serverFirst) + "," + withoutProof)
+	k := keys(c.mech, c.password, salt, iterations)
+	proof := k.proof(c.mech, authMessage)
+	c.serverSignature = hmacOf(c.mech, k.server, authMessage)
+
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// Verify checks the server-final-message
+func (c *Client) Verify(serverFinal []byte) error {
+	attrs, err := parse(serverFinal)
+	if err != nil {
+		return err
+	}
+	if e, ok := attrs['e']; ok {
+		return fmt.Errorf("scram: server error %q", e)
+	}
+	signature, err := base64.StdEncoding.DecodeString(attrs['v'])
+	if err != nil || c.serverSignature == nil || !hmac.Equal(signature, c.serverSignature) {
+		return ErrVerification
+	}
+	return nil
+}
+
+// Server is the server side of an exchange, for a single user
+type Server struct {
+	mech     Mechanism
+	username string
+	k        *keySet
+
+	salt       []byte
+	iterations int
+	nonce      string
+
+	clientFirstBare string
+	serverFirst     string
+}
+
+// NewServer starts an exchange accepting the given credentials
+func NewServer(mech Mechanism, username, password string, salt []byte, iterations int) *Server {
+	return &Server{
+		mech:       mech,
+		username:   username,
+		k:          keys(mech, password, salt, iterations),
+		salt:       salt,
+		iterations: iterations,
+		nonce:      newNonce(),
+	}
+}
+
+// First returns the server-first-message answering the
+// client-first-message
+func (s *Server) First(clientFirst []byte) ([]byte, error) {
+	if !bytes.HasPrefix(clientFirst, []byte(gs2Header)) {
+		return nil, errors.New("scram: unsupported GS2 header")
+	}
+	s.clientFirstBare = string(clientFirst[len(gs2Header):])
+	attrs, err := parse([]byte(s.clientFirstBare))
+	if err != nil {
+		return nil, err
+	}
+	if attrs['r'] == "" {
+		return nil, errors.New("scram: missing client nonce")
+	}
+	if unescape(attrs['n']) != s.username {
+		return nil, ErrVerification
+	}
+	s.serverFirst = fmt.Sprintf("r=%v%v,s=%v,i=%v",
+		attrs['r'], s.nonce, base64.StdEncoding.EncodeToString(s.salt), s.iterations)
+	return []byte(s.serverFirst), nil
+}
+
+// Final checks the client-final-message, and returns the
+// server-final-message
+func (s *Server) Final(clientFinal []byte) ([]byte, error) {
+	i := bytes.LastIndex(clientFinal, []byte(",p="))
+	if i < 0 {
+		return nil, errors.New("scram: missing proof")
+	}
+	withoutProof := string(clientFinal[:i])
+	proof, err := base64.StdEncoding.DecodeString(string(clientFinal[i+len(",p="):]))
+	if err != nil {
+		return nil, ErrVerification
+	}
+	authMessage := []byte(s.clientFirstBare + "," + s.serverFirst + "," + withoutProof)
+	if subtle.ConstantTimeCompare(proof, s.k.proof(s.mech, authMessage)) != 1 {
+		return nil, ErrVerification
+	}
+	signature := hmacOf(s.mech, s.k.server, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(signature)), nil
+}
+
+// keySet holds the keys derived from a password
+type keySet struct {
+	client []byte
+	server []byte
+}
+
+func keys(mech Mechanism, password string, salt []byte, iterations int) *keySet {
+	salted := hi(mech, []byte(password), salt, iterations)
+	return &keySet{
+		client: hmacOf(mech, salted, []byte("Client Key")),
+		server: hmacOf(mech, salted, []byte("Server Key")),
+	}
+}
+
+// proof returns ClientKey XOR ClientSignature
+func (k *keySet) proof(mech Mechanism, authMessage []byte) []byte {
+	h := mech.Hash()
+	h.Write(k.client)
+	signature := hmacOf(mech, h.Sum(nil), authMessage)
+	proof := make([]byte, len(k.client))
+	for i := range proof {
+		proof[i] = k.client[i] ^ signature[i]
+	}
+	return proof
+}
+
+// hi is PBKDF2 with the mechanism's HMAC, and a key as long as the hash
+func hi(mech Mechanism, password, salt []byte, iterations int) []byte {
+	u := hmacOf(mech, password, append(append([]byte(nil), salt...), 0, 0, 0, 1))
+	result := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		u = hmacOf(mech, password, u)
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+func hmacOf(mech Mechanism, key, data []byte) []byte {
+	mac := hmac.New(mech.Hash, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// parse splits a message into its attributes, by name
+func parse(message []byte) (map[byte]string, error) {
+	attrs := make(map[byte]string)
+	for _, field := range strings.Split(string(message), ",") {
+		if len(field) < 2 || field[1] != '=' {
+			return nil, fmt.Errorf("scram: malformed message %q", message)
+		}
+		attrs[field[0]] = field[2:]
+	}
+	return attrs, nil
+}
+
+// escape encodes a username as a saslname
+func escape(s string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(s)
+}
+
+func unescape(s string) string {
+	return strings.NewReplacer("=2C", ",", "=3D", "=").Replace(s)
+}
+
+func newNonce() string {
+	b := make([]byte, 18)
+	rand.Read(b)
+	return base64.StdEncoding.EncodeToString(b)
+}
@@ -0,0 +1,80 @@
+package scram
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+// Examples of RFC 5802 and RFC 7677
+func TestExchange(t *testing.T) {
+	tests := []struct {
+		mech                     Mechanism
+		clientNonce, serverNonce string
+		salt                     string
+		clientFirst, serverFirst string
+		clientFinal, serverFinal string
+	}{
+		{
+			SHA1, "fyko+d2lbbFgONRv9qkxdawL", "3rfcNHYJY1ZVvWVs7j", "QSXCR+Q6sek8bf92",
+			"n,,n=user,r=fyko+d2lbbFgONRv9qkxdawL",
+			"r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096",
+			"c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=",
+			"v=rmF9pqV8S7suAoZWja4dJRkFsKQ=",
+		},
+		{
+			SHA256, "rOprNGfwEbeRWgbNEkqO", "%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0", "W22ZaJ0SNY7soEsUEjb6gQ==",
+			"n,,n=user,r=rOprNGfwEbeRWgbNEkqO",
+			"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+			"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+			"v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+		},
+	}
+
+	for _, tt := range tests {
+		salt, _ := base64.StdEncoding.DecodeString(tt.salt)
+		c := NewClient(tt.mech, "user", "pencil")
+		c.nonce = tt.clientNonce
+		s := NewServer(tt.mech, "user", "pencil", salt, 4096)
+		s.nonce = tt.serverNonce
+
+		clientFirst := c.First()
+		if string(clientFirst) != tt.clientFirst {
+			t.Errorf("%v: client first = %q, want %q", tt.mech.Name, clientFirst, tt.clientFirst)
+		}
+		serverFirst, err := s.First(clientFirst)
+		if err != nil || string(serverFirst) != tt.serverFirst {
+			t.Errorf("%v: server first = %q, %v, want %q", tt.mech.Name, serverFirst, err, tt.serverFirst)
+		}
+		clientFinal, err := c.Final(serverFirst)
+		if err != nil || string(clientFinal) != tt.clientFinal {
+			t.Errorf("%v: client final = %q, %v, want %q", tt.mech.Name, clientFinal, err, tt.clientFinal)
+		}
+		serverFinal, err := s.Final(clientFinal)
+		if err != nil || string(serverFinal) != tt.serverFinal {
+			t.Errorf("%v: server final = %q, %v, want %q", tt.mech.Name, serverFinal, err, tt.serverFinal)
+		}
+		if err = c.Verify(serverFinal); err != nil {
+			t.Errorf("%v: Verify() error = %v", tt.mech.Name, err)
+		}
+	}
+}
+
+func TestWrongPassword(t *testing.T) {
+	c := NewClient(SHA256, "user", "pen")
+	s := NewServer(SHA256, "user", "pencil", []byte("salt"), 4096)
+
+	serverFirst, err := s.First(c.First())
+	if err != nil {
+		t.Fatalf("server first error = %v", err)
+	}
+	clientFinal, err := c.Final(serverFirst)
+	if err != nil {
+		t.Fatalf("client final error = %v", err)
+	}
+	if _, err = s.Final(clientFinal); err != ErrVerification {
+		t.Errorf("server final error = %v, want %v", err, ErrVerification)
+	}
+	if err = c.Verify([]byte("v=" + base64.StdEncoding.EncodeToString([]byte("forged")))); err != ErrVerification {
+		t.Errorf("Verify() error = %v, want %v", err, ErrVerification)
+	}
+}
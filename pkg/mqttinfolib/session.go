@@ -0,0 +1,137 @@
+package mqttinfo
+
+import (
+	"time"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+// SessionInfo holds the results of the persistent session checks
+type SessionInfo struct {
+	// Session Present set when resuming a session, and QoS 1 messages
+	// published while offline delivered
+	SessionPresent bool
+	Queued         bool
+
+	// Session discarded after its Session Expiry Interval, v5.0 only
+	Expiry bool
+}
+
+// Session Expiry Intervals tested, in seconds
+const (
+	sessionExpiry      = 60
+	shortSessionExpiry = 1
+)
+
+// persistentConnect returns a CONNECT resuming the session of its client
+// ID, which lasts expiry seconds in v5.0
+func (b *BrokerInfo) persistentConnect(version byte, expiry uint32) *packet.Connect {
+	connect := b.connectPacket(version)
+	connect.CleanStart = false
+	if version == packet.V5 {
+		connect.Properties = packet.Properties{packet.IntProperty(packet.PropSessionExpiry, expiry)}
+	}
+	return connect
+}
+
+// discardSession ends the session of a persistent CONNECT's client ID
+func (b *BrokerInfo) discardSession(connect *packet.Connect) {
+	clean := *connect
+	clean.CleanStart = true
+	clean.Properties = nil
+	c, err := b.newClient(&clean)
+	if err != nil {
+		b.logf(LevelWarn, "could not discard session %v: %v", connect.ClientID, err)
+		return
+	}
+	c.Close()
+}
+
+// CheckSessionV3 checks persistent sessions in v3.1, with clean
+// session false
+func (b *BrokerInfo) CheckSessionV3() error {
+	return b.checkSession(packet.V31, &b.V3Session)
+}
+
+// CheckSessionV4 checks persistent sessions in v3.1.1, with clean
+// session false
+func (b *BrokerInfo) CheckSessionV4() error {
+	return b.checkSession(packet.V311, &b.V4Session)
+}
+
+// CheckSessionV5 checks persistent sessions in v5.0, with Clean Start 0
+// and a Session Expiry Interval, and their expiry
+func (b *BrokerInfo) CheckSessionV5() error {
+	return b.checkSession(packet.V5, &b.V5Session)
+}
+
+func (b *BrokerInfo) checkSession(version byte, s *SessionInfo) error {
+
+	name := versionName(version)
+	topic := b.probeTopic("session")
+	payload := []byte("mqttinfo queued")
+	wait := b.quiet()
+
+	// Subscribe in a persistent session, then go offline
+	b.beginCheck(name + " session resume")
+	connect := b.persistentConnect(version, sessionExpiry)
+	c, err := b.newClient(connect)
+	if err != nil {
+		return err
+	}
+	defer b.discardSession(connect)
+	if _, err = c.subscribeWait(packet.Subscription{Filter: topic, Options: 1}, wait); err != nil {
+		c.Close()
+		return err
+	}
+	c.Close()
+
+	// The publication comes from another connection, so give the
+	// broker time to process the DISCONNECT first
+	time.Sleep(wait)
+
+	pub, err := b.probeClient(version)
+	if err != nil {
+		return err
+	}
+	defer pub.Close()
+	if err = pub.Publish(topic, payload, 1, false); err != nil {
+		return err
+	}
+
+	// Back online, the message must be waiting
+	c, err = b.newClient(connect)
+	if err != nil {
+		return err
+	}
+	s.SessionPresent = c.Connack.SessionPresent
+	got, err := c.receivePayload(payload, wait)
+	c.Close()
+	if err != nil {
+		return err
+	}
+	s.Queued = got != nil
+
+	if version != packet.V5 || !s.SessionPresent {
+		return nil
+	}
+
+	// Offline for longer than the session expiry, it must be gone
+	b.beginCheck("v5.0 session expiry")
+	connect = b.persistentConnect(version, shortSessionExpiry)
+	c, err = b.newClient(connect)
+	if err != nil {
+		return err
+	}
+	defer b.discardSession(connect)
+	c.Close()
+	time.Sleep(b.seconds(shortSessionExpiry) + wait)
+	c, err = b.newClient(connect)
+	if err != nil {
+		return err
+	}
+	c.Close()
+	s.Expiry = !c.Connack.SessionPresent
+
+	return nil
+}
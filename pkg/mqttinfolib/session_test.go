@@ -0,0 +1,56 @@
+package mqttinfo
+
+import (
+	"testing"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/fakebroker"
+)
+
+func TestCheckSession(t *testing.T) {
+	noSessions := fakebroker.Mosquitto()
+	noSessions.NoSessions = true
+
+	noExpiry := fakebroker.Mosquitto()
+	noExpiry.IgnoreSessionExpiry = true
+
+	tests := []struct {
+		name     string
+		behavior fakebroker.Behavior
+		v4, v5   SessionInfo
+	}{
+		{"mosquitto", fakebroker.Mosquitto(),
+			SessionInfo{SessionPresent: true, Queued: true},
+			SessionInfo{SessionPresent: true, Queued: true, Expiry: true},
+		},
+		{"no sessions", noSessions,
+			SessionInfo{},
+			SessionInfo{},
+		},
+		{"session expiry ignored", noExpiry,
+			SessionInfo{SessionPresent: true, Queued: true},
+			SessionInfo{SessionPresent: true, Queued: true},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			b := newTestBrokerInfo(t, tt.behavior)
+
+			if err := b.CheckSessionV4(); err != nil {
+				t.Fatalf("CheckSessionV4() error = %v", err)
+			}
+			if b.V4Session != tt.v4 {
+				t.Errorf("V4Session = %+v, want %+v", b.V4Session, tt.v4)
+			}
+
+			if err := b.CheckSessionV5(); err != nil {
+				t.Fatalf("CheckSessionV5() error = %v", err)
+			}
+			if b.V5Session != tt.v5 {
+				t.Errorf("V5Session = %+v, want %+v", b.V5Session, tt.v5)
+			}
+		})
+	}
+}
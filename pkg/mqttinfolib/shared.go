@@ -0,0 +1,161 @@
+package mqttinfo
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+// Distributions of the messages of a shared subscription
+const (
+	DistributionRoundRobin = "round-robin"
+	DistributionRandom     = "random"
+	DistributionSticky     = "sticky"
+)
+
+// SharedInfo holds the results of the shared subscription checks
+type SharedInfo struct {
+	// Each message delivered to exactly one member of the group, and
+	// how members were chosen
+	Supported    bool
+	Distribution string
+
+	// Shared Subscription Available advertised in CONNACK, and whether
+	// it matches Supported. v5.0 only.
+	Available        bool
+	AvailableMatches bool
+}
+
+// Shared subscription members and messages published to them
+const (
+	sharedMembers  = 3
+	sharedMessages = 4 * sharedMembers
+)
+
+// CheckSharedV3 checks $share subscriptions in v3.1, which brokers
+// may support although it's a v5.0 feature
+func (b *BrokerInfo) CheckSharedV3() error {
+	return b.checkShared(packet.V31, &b.V3Shared)
+}
+
+// CheckSharedV4 checks $share subscriptions in v3.1.1, which brokers
+// may support although it's a v5.0 feature
+func (b *BrokerInfo) CheckSharedV4() error {
+	return b.checkShared(packet.V311, &b.V4Shared)
+}
+
+// CheckSharedV5 checks shared subscriptions in v5.0
+func (b *BrokerInfo) CheckSharedV5() error {
+	return b.checkShared(packet.V5, &b.V5Shared)
+}
+
+func (b *BrokerInfo) checkShared(version byte, s *SharedInfo) error {
+
+	name := versionName(version)
+	// Per version, so that the members of the other check are gone
+	topic := b.probeTopic(fmt.Sprintf("shared%v", version))
+	group := fmt.Sprintf("mqttinfo%v-%v", b.run(), version)
+	wait := b.quiet()
+
+	b.beginCheck(name + " shared subscription")
+	pub, err := b.probeClient(version)
+	if err != nil {
+		return err
+	}
+	defer pub.Close()
+
+	if version == packet.V5 {
+		available, ok := pub.Connack.Properties.Int(packet.PropSharedSubAvailable)
+		s.Available = !ok || available == 1
+		defer func() {
+			s.AvailableMatches = s.Available == s.Supported
+		}()
+	}
+
+	filter := "$share/" + group + "/" + topic
+	members := make([]*Client, sharedMembers)
+	for i := range members {
+		members[i], err = b.probeClient(version)
+		if err != nil {
+			return err
+		}
+		defer members[i].Close()
+
+		suback, err := members[i].subscribe(nil, packet.Subscription{Filter: filter, Options: 1})
+		if err != nil {
+			return err
+		}
+		if len(suback.ReasonCodes) != 1 || suback.ReasonCodes[0] >= 0x80 {
+			b.logf(LevelDebug, "shared subscription refused (codes % x)", suback.ReasonCodes)
+			return nil
+		}
+	}
+
+	for i := 0; i < sharedMessages; i++ {
+		if err = pub.Publish(topic, []byte(strconv.Itoa(i)), 1, false); err != nil {
+			return err
+		}
+	}
+
+	// Which member got each message, -1 for none
+	receivers := make([]int, sharedMessages)
+	for i := range receivers {
+		receivers[i] = -1
+	}
+	for m, c := range members {
+		for {
+			got, err := c.receive(wait)
+			if err != nil {
+				return err
+			}
+			if got == nil {
+				break
+			}
+			i, err := strconv.Atoi(string(got.Payload))
+			if err != nil || i < 0 || i >= sharedMessages || receivers[i] != -1 {
+				b.logf(LevelDebug, "member %v got unexpected message %q", m, got.Payload)
+				return nil
+			}
+			receivers[i] = m
+		}
+	}
+	b.logf(LevelDebug, "receiving members: %v", receivers)
+
+	for _, m := range receivers {
+		if m == -1 {
+			return nil
+		}
+	}
+	s.Supported = true
+	s.Distribution = distribution(receivers, sharedMembers)
+
+	return nil
+}
+
+// distribution names how messages were spread across n members, given
+// the member that received each message
+func distribution(receivers []int, n int) string {
+	sticky, roundRobin := true, true
+	for i, m := range receivers {
+		if m != receivers[0] {
+			sticky = false
+		}
+		// The members take turns, in any order
+		if i >= n && m != receivers[i-n] {
+			roundRobin = false
+		}
+		for j := i - 1; j >= 0 && j > i-n; j-- {
+			if receivers[j] == m {
+				roundRobin = false
+			}
+		}
+	}
+	switch {
+	case sticky:
+		return DistributionSticky
+	case roundRobin:
+		return DistributionRoundRobin
+	}
+	return DistributionRandom
+}
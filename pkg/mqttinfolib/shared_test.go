@@ -0,0 +1,86 @@
+package mqttinfo
+
+import (
+	"testing"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/fakebroker"
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+func TestCheckShared(t *testing.T) {
+	sticky := fakebroker.Mosquitto()
+	sticky.SharedSubscriptions = fakebroker.Sticky
+
+	unsupported := fakebroker.Mosquitto()
+	unsupported.SharedSubscriptions = ""
+
+	unadvertised := fakebroker.Mosquitto()
+	unadvertised.ConnackProperties = packet.Properties{packet.IntProperty(packet.PropSharedSubAvailable, 0)}
+
+	tests := []struct {
+		name     string
+		behavior fakebroker.Behavior
+		v4, v5   SharedInfo
+	}{
+		{"mosquitto", fakebroker.Mosquitto(),
+			SharedInfo{Supported: true, Distribution: DistributionRoundRobin},
+			SharedInfo{Supported: true, Distribution: DistributionRoundRobin, Available: true, AvailableMatches: true},
+		},
+		{"EMQX", fakebroker.EMQX(),
+			SharedInfo{Supported: true, Distribution: DistributionRandom},
+			SharedInfo{Supported: true, Distribution: DistributionRandom, Available: true, AvailableMatches: true},
+		},
+		{"sticky", sticky,
+			SharedInfo{Supported: true, Distribution: DistributionSticky},
+			SharedInfo{Supported: true, Distribution: DistributionSticky, Available: true, AvailableMatches: true},
+		},
+		{"unsupported", unsupported,
+			SharedInfo{},
+			SharedInfo{Available: true},
+		},
+		{"unadvertised", unadvertised,
+			SharedInfo{Supported: true, Distribution: DistributionRoundRobin},
+			SharedInfo{Supported: true, Distribution: DistributionRoundRobin},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			b := newTestBrokerInfo(t, tt.behavior)
+
+			if err := b.CheckSharedV4(); err != nil {
+				t.Fatalf("CheckSharedV4() error = %v", err)
+			}
+			if b.V4Shared != tt.v4 {
+				t.Errorf("V4Shared = %+v, want %+v", b.V4Shared, tt.v4)
+			}
+
+			if err := b.CheckSharedV5(); err != nil {
+				t.Fatalf("CheckSharedV5() error = %v", err)
+			}
+			if b.V5Shared != tt.v5 {
+				t.Errorf("V5Shared = %+v, want %+v", b.V5Shared, tt.v5)
+			}
+		})
+	}
+}
+
+func TestDistribution(t *testing.T) {
+	tests := []struct {
+		receivers []int
+		want      string
+	}{
+		{[]int{0, 1, 2, 0, 1, 2}, DistributionRoundRobin},
+		{[]int{2, 0, 1, 2, 0, 1}, DistributionRoundRobin},
+		{[]int{1, 1, 1, 1, 1, 1}, DistributionSticky},
+		{[]int{0, 1, 0, 2, 1, 2}, DistributionRandom},
+		{[]int{0, 1, 2, 1, 0, 2}, DistributionRandom},
+	}
+	for _, tt := range tests {
+		if got := distribution(tt.receivers, 3); got != tt.want {
+			t.Errorf("distribution(%v) = %v, want %v", tt.receivers, got, tt.want)
+		}
+	}
+}
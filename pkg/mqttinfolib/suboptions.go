@@ -0,0 +1,135 @@
+package mqttinfo
+
+import "github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+
+// SubOptionsInfo holds the results of the v5.0 subscription option checks
+type SubOptionsInfo struct {
+	// Our own messages not sent back on No Local subscriptions
+	NoLocal bool
+
+	// Subscription Identifier Available advertised in CONNACK, identifiers
+	// sent with the messages, and whether both match
+	IDAvailable bool
+	IDDelivered bool
+	IDMatches   bool
+
+	// Copies received of a message matching two subscriptions, 1 or 2,
+	// and whether they carried the identifiers of both. Not tried if
+	// Wildcard Subscription Available is 0, identifiers are then tried
+	// with one subscription.
+	OverlapCopies int
+	OverlapIDs    bool
+}
+
+// wildcardsAvailable tells whether the v5.0 CONNACK of c allows wildcard
+// subscriptions, always true in v3.1.1
+func wildcardsAvailable(c *Client) bool {
+	available, ok := c.Connack.Properties.Int(packet.PropWildcardSubAvailable)
+	return !ok || available == 1
+}
+
+// subscriptionIDs returns the Subscription Identifiers of a message
+func subscriptionIDs(pub *packet.Publish) []uint32 {
+	var ids []uint32
+	for _, p := range pub.Properties {
+		if p.ID == packet.PropSubscriptionID {
+			ids = append(ids, p.Value)
+		}
+	}
+	return ids
+}
+
+// CheckSubOptionsV5 checks No Local, Subscription Identifiers, and the
+// delivery of messages matching overlapping subscriptions
+func (b *BrokerInfo) CheckSubOptionsV5() error {
+
+	so := &b.V5SubOptions
+	topic := b.probeTopic("suboptions")
+	wait := b.quiet()
+
+	c, err := b.probeClient(packet.V5)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	other, err := b.probeClient(packet.V5)
+	if err != nil {
+		return err
+	}
+	defer other.Close()
+
+	available, ok := c.Connack.Properties.Int(packet.PropSubscriptionIDAvailable)
+	so.IDAvailable = !ok || available == 1
+	defer func() {
+		so.IDMatches = so.IDAvailable == so.IDDelivered
+	}()
+
+	// Our message must not come back, unlike another client's
+	b.beginCheck("v5.0 no local")
+	noLocal := topic + "/nolocal"
+	if _, err = c.subscribeWait(packet.Subscription{Filter: noLocal, Options: 1 | packet.NoLocal}, wait); err != nil {
+		return err
+	}
+	own, theirs := []byte("mqttinfo no local own"), []byte("mqttinfo no local other")
+	// QoS 0, so that an echo isn't skipped waiting for PUBACK
+	if err = c.Publish(noLocal, own, 0, false); err != nil {
+		return err
+	}
+	gotOwn, err := c.receivePayload(own, wait)
+	if err != nil {
+		return err
+	}
+	if err = other.Publish(noLocal, theirs, 1, false); err != nil {
+		return err
+	}
+	gotTheirs, err := c.receivePayload(theirs, wait)
+	if err != nil {
+		return err
+	}
+	so.NoLocal = gotOwn == nil && gotTheirs != nil
+
+	// Two subscriptions matching the same topic, with identifiers 1 and 2
+	// if the broker takes them
+	b.beginCheck("v5.0 subscription identifiers")
+	overlap := topic + "/overlap"
+	filters := []string{overlap, overlap + "/#"}
+	if !wildcardsAvailable(c) {
+		b.logf(LevelDebug, "wildcard subscriptions unavailable, no overlap")
+		filters = filters[:1]
+	}
+	for i, filter := range filters {
+		var props packet.Properties
+		if so.IDAvailable {
+			props = packet.Properties{packet.IntProperty(packet.PropSubscriptionID, uint32(i+1))}
+		}
+		if err = c.subscribeOK(props, packet.Subscription{Filter: filter, Options: 1}); err != nil {
+			return err
+		}
+	}
+	payload := []byte("mqttinfo overlap")
+	if err = other.Publish(overlap, payload, 1, false); err != nil {
+		return err
+	}
+	ids := make(map[uint32]bool)
+	for {
+		got, err := c.receivePayload(payload, wait)
+		if err != nil {
+			return err
+		}
+		if got == nil {
+			break
+		}
+		so.OverlapCopies++
+		for _, id := range subscriptionIDs(got) {
+			ids[id] = true
+		}
+	}
+	b.logf(LevelDebug, "overlap copies: %v, identifiers: %v", so.OverlapCopies, ids)
+	so.IDDelivered = len(ids) > 0
+	so.OverlapIDs = len(filters) > 1 && so.OverlapCopies > 0 && ids[1] && ids[2]
+	if len(filters) == 1 {
+		so.OverlapCopies = 0
+	}
+
+	return nil
+}
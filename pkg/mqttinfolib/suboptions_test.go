@@ -0,0 +1,68 @@
+package mqttinfo
+
+import (
+	"testing"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/fakebroker"
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+func TestCheckSubOptions(t *testing.T) {
+	noLocalIgnored := fakebroker.Mosquitto()
+	noLocalIgnored.IgnoreNoLocal = true
+
+	idsDropped := fakebroker.Mosquitto()
+	idsDropped.NoSubscriptionIDs = true
+
+	idsUnavailable := fakebroker.Mosquitto()
+	idsUnavailable.NoSubscriptionIDs = true
+	idsUnavailable.ConnackProperties = append(packet.Properties{
+		packet.IntProperty(packet.PropSubscriptionIDAvailable, 0),
+	}, idsUnavailable.ConnackProperties...)
+
+	duplicates := fakebroker.Mosquitto()
+	duplicates.DuplicateOverlaps = true
+
+	noWildcards := fakebroker.Mosquitto()
+	noWildcards.NoWildcards = true
+
+	tests := []struct {
+		name     string
+		behavior fakebroker.Behavior
+		want     SubOptionsInfo
+	}{
+		{"mosquitto", fakebroker.Mosquitto(), SubOptionsInfo{
+			NoLocal: true, IDAvailable: true, IDDelivered: true, IDMatches: true, OverlapCopies: 1, OverlapIDs: true,
+		}},
+		{"no local ignored", noLocalIgnored, SubOptionsInfo{
+			IDAvailable: true, IDDelivered: true, IDMatches: true, OverlapCopies: 1, OverlapIDs: true,
+		}},
+		{"identifiers dropped", idsDropped, SubOptionsInfo{
+			NoLocal: true, IDAvailable: true, OverlapCopies: 1,
+		}},
+		{"identifiers unavailable", idsUnavailable, SubOptionsInfo{
+			NoLocal: true, IDMatches: true, OverlapCopies: 1,
+		}},
+		{"duplicate overlaps", duplicates, SubOptionsInfo{
+			NoLocal: true, IDAvailable: true, IDDelivered: true, IDMatches: true, OverlapCopies: 2, OverlapIDs: true,
+		}},
+		{"wildcards unavailable", noWildcards, SubOptionsInfo{
+			NoLocal: true, IDAvailable: true, IDDelivered: true, IDMatches: true,
+		}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			b := newTestBrokerInfo(t, tt.behavior)
+
+			if err := b.CheckSubOptionsV5(); err != nil {
+				t.Fatalf("CheckSubOptionsV5() error = %v", err)
+			}
+			if b.V5SubOptions != tt.want {
+				t.Errorf("V5SubOptions = %+v, want %+v", b.V5SubOptions, tt.want)
+			}
+		})
+	}
+}
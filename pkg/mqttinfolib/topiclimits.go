@@ -0,0 +1,172 @@
+package mqttinfo
+
+import (
+	"strings"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+// TopicLimitsInfo holds the results of the topic limit checks. Each limit
+// is Capped if no refusal was found up to the longest topic MQTT allows,
+// or the longest that fits in the largest PUBLISH delivered by the packet
+// size check, when it ran first and found a limit. Otherwise, a packet
+// size limit would show as a topic limit.
+type TopicLimitsInfo struct {
+	// Longest topic name delivered, in bytes
+	Length       int
+	LengthCapped bool
+
+	// Most levels in a topic name delivered, with one-byte levels, so
+	// no more than the length limit allows
+	Levels       int
+	LevelsCapped bool
+
+	// Most single-level wildcards in a subscription filter granted. The
+	// depth of filters and multi-level wildcards aren't tried.
+	FilterWildcards       int
+	FilterWildcardsCapped bool
+}
+
+// maxTopicLength is the length of the longest UTF-8 string of MQTT
+const maxTopicLength = 65535
+
+// topicRoom returns the length of the longest topic of a probe PUBLISH
+// within size bytes
+func topicRoom(version byte, size int) int {
+	pub := &packet.Publish{QoS: 1, PacketID: 1, Payload: []byte("mqttinfo probe 1000000 ")}
+	// Up to 3 more bytes of remaining length
+	return size - len(pub.Encode(version)) - 3
+}
+
+// searchLimit returns the largest n from lo to hi accepted, doubling n
+// from lo until refused, then bisecting. It returns lo-1 if lo is
+// refused, and capped if hi is accepted.
+func searchLimit(lo, hi int, accepted func(n int) (bool, error)) (n int, capped bool, err error) {
+	ok, err := accepted(lo)
+	if err != nil || !ok {
+		return lo - 1, false, err
+	}
+
+	good, bad := lo, hi+1
+	for good < hi {
+		n := min(2*good, hi)
+		ok, err := accepted(n)
+		if err != nil {
+			return 0, false, err
+		}
+		if !ok {
+			bad = n
+			break
+		}
+		good = n
+	}
+	if good == hi {
+		return hi, true, nil
+	}
+
+	for bad-good > 1 {
+		mid := good + (bad-good)/2
+		ok, err := accepted(mid)
+		if err != nil {
+			return 0, false, err
+		}
+		if ok {
+			good = mid
+		} else {
+			bad = mid
+		}
+	}
+	return good, false, nil
+}
+
+// CheckTopicLimitsV3 finds the topic limits of v3.1
+func (b *BrokerInfo) CheckTopicLimitsV3() error {
+	return b.checkTopicLimits(packet.V31, &b.V3TopicLimits)
+}
+
+// CheckTopicLimitsV4 finds the topic limits of v3.1.1
+func (b *BrokerInfo) CheckTopicLimitsV4() error {
+	return b.checkTopicLimits(packet.V311, &b.V4TopicLimits)
+}
+
+// CheckTopicLimitsV5 finds the topic limits of v5.0
+func (b *BrokerInfo) CheckTopicLimitsV5() error {
+	return b.checkTopicLimits(packet.V5, &b.V5TopicLimits)
+}
+
+// checkTopicLimits publishes to ever longer and deeper topics, and
+// subscribes to filters with ever more wildcards, until refused
+func (b *BrokerInfo) checkTopicLimits(version byte, t *TopicLimitsInfo) error {
+
+	name := versionName(version)
+	topic := b.probeTopic("topics")
+	*t = TopicLimitsInfo{}
+
+	room := maxTopicLength
+	s := &b.V5PacketSize
+	switch version {
+	case packet.V31:
+		s = &b.V3PacketSize
+	case packet.V311:
+		s = &b.V4PacketSize
+	}
+	if s.Refused > 0 && s.Largest > 0 {
+		room = max(min(room, topicRoom(version, s.Largest)), len(topic)+2)
+		b.logf(LevelDebug, "topics up to %v bytes, within %v byte packets", room, s.Largest)
+	}
+
+	p, err := b.newPublishProbe(version, topic+"/#")
+	if err != nil {
+		return err
+	}
+	defer p.close()
+
+	delivered := func(to string) (bool, error) {
+		refusal, code, err := p.try(&packet.Publish{Topic: to, QoS: 1, Payload: p.mark()})
+		if refusal != "" {
+			b.logf(LevelDebug, "%v bytes, %v levels: %v (code 0x%02x)",
+				len(to), strings.Count(to, "/")+1, refusal, code)
+		}
+		return refusal == "" && err == nil, err
+	}
+
+	b.beginCheck(name + " topic length")
+	t.Length, t.LengthCapped, err = searchLimit(len(topic)+2, room, func(n int) (bool, error) {
+		return delivered(topic + "/" + strings.Repeat("a", n-len(topic)-1))
+	})
+	if err != nil {
+		return err
+	}
+
+	b.beginCheck(name + " topic levels")
+	base := strings.Count(topic, "/") + 1
+	t.Levels, t.LevelsCapped, err = searchLimit(base+1, base+(room-len(topic))/2, func(n int) (bool, error) {
+		return delivered(topic + strings.Repeat("/a", n-base))
+	})
+	if err != nil {
+		return err
+	}
+
+	b.beginCheck(name + " filter wildcards")
+	filters := b.probeTopic("filters")
+	t.FilterWildcards, t.FilterWildcardsCapped, err = searchLimit(1, (room-len(filters))/2, func(n int) (bool, error) {
+		return p.granted(filters + strings.Repeat("/+", n))
+	})
+	return err
+}
+
+// granted subscribes the publishing client to a filter, and tells
+// whether the broker granted it
+func (p *publishProbe) granted(filter string) (bool, error) {
+	c, err := p.publisher()
+	if err != nil {
+		return false, err
+	}
+	suback, err := c.subscribe(nil, packet.Subscription{Filter: filter})
+	if err != nil {
+		p.b.logf(LevelDebug, "%v wildcards: %v", strings.Count(filter, "+"), err)
+		p.drop()
+		return false, nil
+	}
+	return len(suback.ReasonCodes) == 1 && suback.ReasonCodes[0] < 0x80, nil
+}
@@ -0,0 +1,115 @@
+package mqttinfo
+
+import (
+	"testing"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/fakebroker"
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+func TestCheckTopicLimits(t *testing.T) {
+	// Probe topics are mqttinfo/{run ID}/topics, 24 bytes and 3 levels,
+	// and mqttinfo/{run ID}/filters, 25 bytes
+	short := fakebroker.Mosquitto()
+	short.MaxTopicLength = 200
+
+	shallow := fakebroker.Mosquitto()
+	shallow.MaxTopicLevels = 20
+
+	simple := fakebroker.Mosquitto()
+	simple.MaxFilterWildcards = 5
+
+	tests := []struct {
+		name     string
+		behavior fakebroker.Behavior
+		version  byte
+		want     TopicLimitsInfo
+	}{
+		{"mosquitto", fakebroker.Mosquitto(), packet.V5, TopicLimitsInfo{
+			Length: 65535, LengthCapped: true,
+			Levels: 32758, LevelsCapped: true,
+			FilterWildcards: 32755, FilterWildcardsCapped: true,
+		}},
+		{"length", short, packet.V5, TopicLimitsInfo{
+			Length: 200, Levels: 91, FilterWildcards: 87,
+		}},
+		{"levels", shallow, packet.V5, TopicLimitsInfo{
+			Length: 65535, LengthCapped: true, Levels: 20, FilterWildcards: 17,
+		}},
+		{"wildcards", simple, packet.V5, TopicLimitsInfo{
+			Length: 65535, LengthCapped: true,
+			Levels: 32758, LevelsCapped: true,
+			FilterWildcards: 5,
+		}},
+		{"v3.1.1", short, packet.V311, TopicLimitsInfo{
+			Length: 200, Levels: 91, FilterWildcards: 87,
+		}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			b := newTestBrokerInfo(t, tt.behavior)
+
+			l := &b.V5TopicLimits
+			if tt.version == packet.V311 {
+				l = &b.V4TopicLimits
+			}
+			if err := b.checkTopicLimits(tt.version, l); err != nil {
+				t.Fatalf("checkTopicLimits() error = %v", err)
+			}
+			if *l != tt.want {
+				t.Errorf("TopicLimitsInfo = %+v, want %+v", *l, tt.want)
+			}
+		})
+	}
+}
+
+func TestTopicLimitsWithinPacketSize(t *testing.T) {
+	small := fakebroker.Mosquitto()
+	small.MaxPacketSize = 300
+	b := newTestBrokerInfo(t, small)
+
+	if err := b.CheckPacketSizeV5(); err != nil {
+		t.Fatalf("CheckPacketSizeV5() error = %v", err)
+	}
+	if err := b.CheckTopicLimitsV5(); err != nil {
+		t.Fatalf("CheckTopicLimitsV5() error = %v", err)
+	}
+
+	room := topicRoom(packet.V5, b.V5PacketSize.Largest)
+	want := TopicLimitsInfo{
+		Length: room, LengthCapped: true,
+		Levels: 3 + (room-24)/2, LevelsCapped: true,
+		FilterWildcards: (room - 25) / 2, FilterWildcardsCapped: true,
+	}
+	if b.V5TopicLimits != want {
+		t.Errorf("TopicLimitsInfo = %+v, want %+v", b.V5TopicLimits, want)
+	}
+}
+
+func TestSearchLimit(t *testing.T) {
+	tests := []struct {
+		lo, hi, limit int
+		want          int
+		capped        bool
+	}{
+		{1, 100, 37, 37, false},
+		{1, 100, 100, 100, true},
+		{1, 100, 1000, 100, true},
+		{10, 100, 5, 9, false},
+		{10, 100, 10, 10, false},
+		{10, 100, 99, 99, false},
+	}
+
+	for _, tt := range tests {
+		got, capped, err := searchLimit(tt.lo, tt.hi, func(n int) (bool, error) {
+			return n <= tt.limit, nil
+		})
+		if err != nil || got != tt.want || capped != tt.capped {
+			t.Errorf("searchLimit(%v, %v) with limit %v = %v, %v, %v, want %v, %v",
+				tt.lo, tt.hi, tt.limit, got, capped, err, tt.want, tt.capped)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package mqttinfo
+
+import (
+	"errors"
+	"os"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+// UnsubscribeInfo holds the results of the unsubscribe checks
+type UnsubscribeInfo struct {
+	// Message delivered to a subscription, UNSUBACK received for it, and
+	// no message delivered once it was, which needs the first delivery
+	Delivered bool
+	Acked     bool
+	Stopped   bool
+
+	// v5.0 reason codes of the subscription, and of a filter never
+	// subscribed in the same UNSUBSCRIBE, and whether they are 0x00
+	// Success and 0x11 No subscription existed
+	Reason        byte
+	MissingReason byte
+	ReasonsMatch  bool
+
+	// How the UNSUBSCRIBE of an invalid filter was refused, "" if it was
+	// acknowledged as a success, and the reason code of the UNSUBACK or
+	// DISCONNECT, if any
+	InvalidRefusal string
+	InvalidReason  byte
+}
+
+// CheckUnsubscribeV3 checks UNSUBSCRIBE in v3.1
+func (b *BrokerInfo) CheckUnsubscribeV3() error {
+	return b.checkUnsubscribe(packet.V31, &b.V3Unsubscribe)
+}
+
+// CheckUnsubscribeV4 checks UNSUBSCRIBE in v3.1.1
+func (b *BrokerInfo) CheckUnsubscribeV4() error {
+	return b.checkUnsubscribe(packet.V311, &b.V4Unsubscribe)
+}
+
+// CheckUnsubscribeV5 checks UNSUBSCRIBE in v5.0, and the reason codes of
+// UNSUBACK
+func (b *BrokerInfo) CheckUnsubscribeV5() error {
+	return b.checkUnsubscribe(packet.V5, &b.V5Unsubscribe)
+}
+
+// checkUnsubscribe unsubscribes from a subscription along with a filter
+// never subscribed, publishes to the former, then unsubscribes from an
+// invalid filter
+func (b *BrokerInfo) checkUnsubscribe(version byte, u *UnsubscribeInfo) error {
+
+	name := versionName(version)
+	topic := b.probeTopic("unsubscribe")
+	wait := b.quiet()
+	*u = UnsubscribeInfo{}
+
+	sub, err := b.NewClient(version)
+	if err != nil {
+		return err
+	}
+	defer sub.abort()
+	if err = sub.subscribeOK(nil, packet.Subscription{Filter: topic, Options: 1}); err != nil {
+		return err
+	}
+
+	pub, err := b.NewClient(version)
+	if err != nil {
+		return err
+	}
+	defer pub.Close()
+	before := []byte("mqttinfo subscribed")
+	if err = pub.Publish(topic, before, 1, false); err != nil {
+		return err
+	}
+	got, err := sub.receivePayload(before, wait)
+	if err != nil {
+		return err
+	}
+	u.Delivered = got != nil
+	if !u.Delivered {
+		b.logf(LevelDebug, "message to %v not delivered before UNSUBSCRIBE", topic)
+	}
+
+	b.beginCheck(name + " UNSUBSCRIBE")
+	unsuback, err := sub.unsubscribe(topic, b.probeTopic("unsubscribed"))
+	if err != nil {
+		return err
+	}
+	u.Acked = true
+	if version == packet.V5 && len(unsuback.ReasonCodes) == 2 {
+		u.Reason, u.MissingReason = unsuback.ReasonCodes[0], unsuback.ReasonCodes[1]
+		u.ReasonsMatch = u.Reason == 0x00 && u.MissingReason == 0x11
+	}
+	b.logf(LevelDebug, "UNSUBACK codes % x", unsuback.ReasonCodes)
+
+	after := []byte("mqttinfo unsubscribed")
+	if err = pub.Publish(topic, after, 1, false); err != nil {
+		return err
+	}
+	got, err = sub.receivePayload(after, wait)
+	if err != nil {
+		return err
+	}
+	u.Stopped = u.Delivered && got == nil
+
+	b.beginCheck(name + " UNSUBSCRIBE invalid filter")
+	unsuback, err = sub.unsubscribe(topic + "/#/invalid")
+	switch {
+	case sub.Disconnect != nil:
+		u.InvalidRefusal, u.InvalidReason = RefusalDisconnect, sub.Disconnect.ReasonCode
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		u.InvalidRefusal = RefusalDrop
+	case err != nil:
+		u.InvalidRefusal = RefusalClose
+	case len(unsuback.ReasonCodes) > 0 && unsuback.ReasonCodes[0] >= 0x80:
+		u.InvalidRefusal, u.InvalidReason = RefusalAck, unsuback.ReasonCodes[0]
+	}
+	b.logf(LevelDebug, "invalid filter: %q", u.InvalidRefusal)
+
+	return nil
+}
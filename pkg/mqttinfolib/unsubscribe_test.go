@@ -0,0 +1,72 @@
+package mqttinfo
+
+import (
+	"testing"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/fakebroker"
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+func TestCheckUnsubscribe(t *testing.T) {
+	success := fakebroker.Mosquitto()
+	success.UnsubackSuccess = true
+
+	kept := fakebroker.Mosquitto()
+	kept.KeepUnsubscribed = true
+
+	unvalidated := fakebroker.Mosquitto()
+	unvalidated.ValidateTopics = false
+
+	dropped := fakebroker.Mosquitto()
+	dropped.MaxPacketSize = 10
+	dropped.OversizeRefusal = fakebroker.OversizeDrop
+
+	tests := []struct {
+		name     string
+		behavior fakebroker.Behavior
+		version  byte
+		want     UnsubscribeInfo
+	}{
+		{"mosquitto", fakebroker.Mosquitto(), packet.V5, UnsubscribeInfo{
+			Delivered: true, Acked: true, Stopped: true, MissingReason: 0x11, ReasonsMatch: true,
+			InvalidRefusal: RefusalAck, InvalidReason: 0x8f,
+		}},
+		{"v3.1.1", fakebroker.Mosquitto(), packet.V311, UnsubscribeInfo{
+			Delivered: true, Acked: true, Stopped: true, InvalidRefusal: RefusalClose,
+		}},
+		{"always success", success, packet.V5, UnsubscribeInfo{
+			Delivered: true, Acked: true, Stopped: true,
+			InvalidRefusal: RefusalAck, InvalidReason: 0x8f,
+		}},
+		{"subscription kept", kept, packet.V5, UnsubscribeInfo{
+			Delivered: true, Acked: true, ReasonsMatch: true, MissingReason: 0x11,
+			InvalidRefusal: RefusalAck, InvalidReason: 0x8f,
+		}},
+		{"unvalidated", unvalidated, packet.V5, UnsubscribeInfo{
+			Delivered: true, Acked: true, Stopped: true, MissingReason: 0x11, ReasonsMatch: true,
+		}},
+		{"messages dropped", dropped, packet.V5, UnsubscribeInfo{
+			Acked: true, MissingReason: 0x11, ReasonsMatch: true,
+			InvalidRefusal: RefusalAck, InvalidReason: 0x8f,
+		}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			b := newTestBrokerInfo(t, tt.behavior)
+
+			u := &b.V5Unsubscribe
+			if tt.version == packet.V311 {
+				u = &b.V4Unsubscribe
+			}
+			if err := b.checkUnsubscribe(tt.version, u); err != nil {
+				t.Fatalf("checkUnsubscribe() error = %v", err)
+			}
+			if *u != tt.want {
+				t.Errorf("UnsubscribeInfo = %+v, want %+v", *u, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package mqttinfo
+
+import (
+	"bytes"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/packet"
+)
+
+// WillInfo holds the results of the will message checks
+type WillInfo struct {
+	// Will published when the connection is lost, and not after a
+	// DISCONNECT
+	Published  bool
+	Suppressed bool
+
+	// Will delivered with its QoS, and retained if asked. Retained wills
+	// aren't tried if the v5.0 Retain Available is 0, since the CONNECT
+	// would be refused.
+	QoS    bool
+	Retain bool
+
+	// Will Delay Interval respected, v5.0 only
+	Delay bool
+}
+
+// willDelay is the Will Delay Interval tested, in seconds
+const willDelay = 2
+
+// willClient connects a client with a will message
+func (b *BrokerInfo) willClient(version byte, will *packet.Will, props packet.Properties) (*Client, error) {
+	if will.Retain {
+		b.trackRetained(will.Topic, version)
+	}
+	connect := b.connectPacket(version)
+	connect.Will = will
+	connect.Properties = props
+	c, err := b.newClient(connect)
+	if err != nil {
+		return nil, err
+	}
+	c.probe = b
+	return c, nil
+}
+
+// abort closes the connection without DISCONNECT, as if it was lost
+func (c *Client) abort() error {
+	return c.conn.Close()
+}
+
+// CheckWillV3 checks the handling of will messages in v3.1
+func (b *BrokerInfo) CheckWillV3() error {
+	return b.checkWill(packet.V31, &b.V3Will)
+}
+
+// CheckWillV4 checks the handling of will messages in v3.1.1
+func (b *BrokerInfo) CheckWillV4() error {
+	return b.checkWill(packet.V311, &b.V4Will)
+}
+
+// CheckWillV5 checks the handling of will messages in v5.0, including
+// the Will Delay Interval
+func (b *BrokerInfo) CheckWillV5() error {
+	return b.checkWill(packet.V5, &b.V5Will)
+}
+
+func (b *BrokerInfo) checkWill(version byte, w *WillInfo) error {
+
+	name := versionName(version)
+	topic := b.probeTopic("will")
+	wait := b.quiet()
+
+	sub, err := b.probeClient(version)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+	if _, err = sub.subscribeWait(packet.Subscription{Filter: topic, Options: 1}, wait); err != nil {
+		return err
+	}
+
+	// Connection lost, the will must be published with its QoS
+	b.beginCheck(name + " will on connection loss")
+	payload := []byte("mqttinfo will lost")
+	c, err := b.willClient(version, &packet.Will{QoS: 1, Topic: topic, Payload: payload}, nil)
+	if err != nil {
+		return err
+	}
+	c.abort()
+	got, err := sub.receivePayload(payload, wait)
+	if err != nil {
+		return err
+	}
+	w.Published = got != nil
+	w.QoS = got != nil && got.QoS == 1
+
+	// DISCONNECT, the will must be discarded
+	b.beginCheck(name + " will on DISCONNECT")
+	payload = []byte("mqttinfo will disconnect")
+	c, err = b.willClient(version, &packet.Will{QoS: 1, Topic: topic, Payload: payload}, nil)
+	if err != nil {
+		return err
+	}
+	c.Close()
+	got, err = sub.receivePayload(payload, wait)
+	if err != nil {
+		return err
+	}
+	w.Suppressed = w.Published && got == nil
+
+	// Retained will, a later subscriber must get it
+	if available, ok := sub.Connack.Properties.Int(packet.PropRetainAvailable); ok && available == 0 {
+		b.logf(LevelDebug, "retain unavailable, retained will not tried")
+	} else if err = b.checkWillRetain(version, sub, w); err != nil {
+		return err
+	}
+
+	if version != packet.V5 {
+		return nil
+	}
+
+	// Will Delay Interval, the session must outlive it for the delay
+	// to apply
+	b.beginCheck("v5.0 will delay")
+	payload = []byte("mqttinfo will delayed")
+	will := &packet.Will{
+		QoS:        1,
+		Topic:      topic,
+		Payload:    payload,
+		Properties: packet.Properties{packet.IntProperty(packet.PropWillDelay, willDelay)},
+	}
+	props := packet.Properties{packet.IntProperty(packet.PropSessionExpiry, 4*willDelay)}
+	c, err = b.willClient(version, will, props)
+	if err != nil {
+		return err
+	}
+	c.abort()
+	early, err := sub.receivePayload(payload, b.seconds(willDelay)/2)
+	if err != nil {
+		return err
+	}
+	if early != nil {
+		b.logf(LevelDebug, "will published before its delay")
+		return nil
+	}
+	late, err := sub.receivePayload(payload, b.seconds(willDelay)+b.timeout())
+	if err != nil {
+		return err
+	}
+	w.Delay = late != nil
+
+	return nil
+}
+
+// checkWillRetain checks that a retained will reaches later subscribers
+func (b *BrokerInfo) checkWillRetain(version byte, sub *Client, w *WillInfo) error {
+	topic := b.probeTopic("will")
+	wait := b.quiet()
+
+	b.beginCheck(versionName(version) + " will retain")
+	payload := []byte("mqttinfo will retained")
+	c, err := b.willClient(version, &packet.Will{QoS: 1, Retain: true, Topic: topic, Payload: payload}, nil)
+	if err != nil {
+		return err
+	}
+	c.abort()
+	if _, err = sub.receivePayload(payload, wait); err != nil {
+		return err
+	}
+	later, err := b.probeClient(version)
+	if err != nil {
+		return err
+	}
+	defer later.Close()
+	got, err := later.subscribeWait(packet.Subscription{Filter: topic, Options: 1}, wait)
+	if err != nil {
+		return err
+	}
+	w.Retain = got != nil && got.Retain && bytes.Equal(got.Payload, payload)
+	return later.Publish(topic, nil, 1, true)
+}
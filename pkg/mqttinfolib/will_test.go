@@ -0,0 +1,59 @@
+package mqttinfo
+
+import (
+	"testing"
+
+	"github.com/Teserakt-io/mqttinfo/pkg/mqttinfolib/fakebroker"
+)
+
+func TestCheckWill(t *testing.T) {
+	noDelay := fakebroker.Mosquitto()
+	noDelay.IgnoreWillDelay = true
+
+	noRetain := fakebroker.Mosquitto()
+	noRetain.NoRetain = true
+
+	tests := []struct {
+		name     string
+		behavior fakebroker.Behavior
+		v4, v5   WillInfo
+	}{
+		{"mosquitto", fakebroker.Mosquitto(),
+			WillInfo{Published: true, Suppressed: true, QoS: true, Retain: true},
+			WillInfo{Published: true, Suppressed: true, QoS: true, Retain: true, Delay: true},
+		},
+		{"will delay ignored", noDelay,
+			WillInfo{Published: true, Suppressed: true, QoS: true, Retain: true},
+			WillInfo{Published: true, Suppressed: true, QoS: true, Retain: true},
+		},
+		{"retain unavailable", noRetain,
+			WillInfo{Published: true, Suppressed: true, QoS: true},
+			WillInfo{Published: true, Suppressed: true, QoS: true, Delay: true},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			b := newTestBrokerInfo(t, tt.behavior)
+
+			if err := b.CheckWillV4(); err != nil {
+				t.Fatalf("CheckWillV4() error = %v", err)
+			}
+			if b.V4Will != tt.v4 {
+				t.Errorf("V4Will = %+v, want %+v", b.V4Will, tt.v4)
+			}
+
+			if !tt.behavior.V5 {
+				return
+			}
+			if err := b.CheckWillV5(); err != nil {
+				t.Fatalf("CheckWillV5() error = %v", err)
+			}
+			if b.V5Will != tt.v5 {
+				t.Errorf("V5Will = %+v, want %+v", b.V5Will, tt.v5)
+			}
+		})
+	}
+}